@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"nchc-vmbr/internal/backup"
+)
+
+func runBackup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.Var(envFlag{env: "BACKUP_SRC_VM"}, "vm", "comma-separated VM names to snapshot (BACKUP_SRC_VM)")
+	fs.Var(envFlag{env: "BACKUP_SRC_VM_ID"}, "vm-id", "comma-separated VM IDs to snapshot; overrides --vm (BACKUP_SRC_VM_ID)")
+	fs.Var(envFlag{env: "BACKUP_SRC_VM_PATTERN"}, "vm-pattern", "glob matched against VM names, e.g. web-* (BACKUP_SRC_VM_PATTERN)")
+	fs.Var(envFlag{env: "BACKUP_SRC_VM_SELECTOR"}, "vm-selector", "VM metadata selector, e.g. role=web,env=prod (BACKUP_SRC_VM_SELECTOR)")
+	fs.Var(envFlag{env: "BACKUP_REPO"}, "repo", "VRM repository template for the snapshot tags (BACKUP_REPO)")
+	fs.Var(envFlag{env: "BACKUP_TAG_NUM"}, "tag-num", "number of tags to retain in the repository (BACKUP_TAG_NUM)")
+	fs.Var(envFlag{env: "BACKUP_PRUNE_MODE"}, "prune-mode", "prune old tags after the new one is exported (after) or before the snapshot (before) (BACKUP_PRUNE_MODE)")
+	fs.Var(envBoolFlag{env: "BACKUP_PRUNE_ALL_TAGS"}, "prune-all-tags", "also prune tags not created by vmbr, e.g. uploaded by hand (BACKUP_PRUNE_ALL_TAGS)")
+	fs.Var(envFlag{env: "BACKUP_CS_BUCKET"}, "bucket", "CS bucket the snapshot is exported to (BACKUP_CS_BUCKET)")
+	fs.Var(envFlag{env: "BACKUP_IMAGE"}, "image", "exported image filename template (BACKUP_IMAGE)")
+	fs.Var(envBoolFlag{env: "BACKUP_TRANSFR_TO_S3"}, "transfer", "transfer the exported image to the destination S3 (BACKUP_TRANSFR_TO_S3)")
+	fs.Var(envFlag{env: "DATE_TAG_FORMAT"}, "date-format", "strftime format of the tag version (DATE_TAG_FORMAT)")
+	fs.Var(envFlag{env: "BACKUP_WORKERS"}, "workers", "number of VMs backed up concurrently (BACKUP_WORKERS)")
+	fs.Var(envFlag{env: "BACKUP_MAX_EXPORTS"}, "max-exports", "maximum concurrent tag exports to CS (BACKUP_MAX_EXPORTS)")
+	fs.Var(envFlag{env: "BACKUP_MAX_TRANSFERS"}, "max-transfers", "maximum concurrent S3 transfers (BACKUP_MAX_TRANSFERS)")
+	fs.Var(envFlag{env: "STATE_DIR"}, "state-dir", "directory of the run state files (STATE_DIR)")
+	resume := fs.String("resume", "", "resume the backup run with this ID at its first incomplete stage")
+	dryRun, asJSON := dryRunFlags(fs)
+	_ = fs.Parse(args)
+	if *asJSON && !*dryRun {
+		return fmt.Errorf("--json requires --dry-run")
+	}
+	if *dryRun && *resume != "" {
+		return fmt.Errorf("--dry-run cannot be combined with --resume")
+	}
+
+	cfg, err := backup.LoadConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	cfg.RunID = *resume
+
+	if *dryRun {
+		p, err := backup.BuildPlan(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		return writePlan(p, *asJSON)
+	}
+
+	// If transfer is not configured or no source location is provided, skip transfer.
+	if cfg.SrcLocation == nil || !cfg.TransferS3 {
+		log.Println("Transfer disabled (no source location or transfer flag off); skipping transfer")
+	}
+
+	start := time.Now()
+	results, err := backup.RunAll(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	log.Printf("Backup summary (%d VMs, %d workers):", len(results), cfg.Workers)
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			log.Printf("  FAILED  %s (%s) after %s: %v", r.VMName, r.VMID, r.Duration.Round(time.Second), r.Err)
+			continue
+		}
+		log.Printf("  OK      %s (%s) -> %s/%s in %s", r.VMName, r.VMID, r.RepoName, r.Image, r.Duration.Round(time.Second))
+	}
+	log.Printf("  %d succeeded, %d failed, total %s", len(results)-failed, failed, time.Since(start).Round(time.Second))
+	if failed > 0 {
+		log.Printf("Retry the failed VMs with: vmbr backup --resume %s", results[0].RunID)
+		return fmt.Errorf("%d of %d VM backups failed", failed, len(results))
+	}
+	return nil
+}
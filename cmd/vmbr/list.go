@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"nchc-vmbr/internal/util"
+)
+
+func runList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	repo := fs.String("repo", os.Getenv("BACKUP_REPO"), "VRM repository to list (default BACKUP_REPO)")
+	_ = fs.Parse(args)
+
+	if *repo == "" {
+		return fmt.Errorf("no repository given; use --repo or set BACKUP_REPO")
+	}
+
+	cfg, err := loadAPIConfig()
+	if err != nil {
+		return err
+	}
+	projClient, err := util.NewProjectClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	vrmClient := projClient.VRM()
+
+	repoID, err := util.FindRepositoryID(ctx, vrmClient, *repo)
+	if err != nil {
+		return err
+	}
+	if repoID == "" {
+		return fmt.Errorf("repository %s not found", *repo)
+	}
+
+	tags, err := util.ListRepositoryTags(ctx, vrmClient, repoID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTAG ID\tSTATUS\tSIZE\tCREATED")
+	for _, t := range tags {
+		if t == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", t.Name, t.ID, t.Status, t.Size, t.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
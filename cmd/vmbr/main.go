@@ -0,0 +1,160 @@
+// Command vmbr is the VM Backup & Restore tool. It bundles the backup,
+// restore and housekeeping workflows into a single binary with subcommands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/plan"
+	"nchc-vmbr/internal/util"
+)
+
+// command is a vmbr subcommand. run receives the arguments that follow the
+// subcommand name.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{name: "backup", usage: "snapshot a VM, export it to CS and optionally transfer it to S3", run: runBackup},
+	{name: "restore", usage: "transfer an image back, upload it to VRM and create a VM from it", run: runRestore},
+	{name: "list", usage: "list the tags of a VRM repository", run: runList},
+	{name: "prune", usage: "delete the oldest tags of a VRM repository", run: runPrune},
+	{name: "verify", usage: "check that the backup image exists in the destination S3", run: runVerify},
+	{name: "transfer", usage: "run only the S3 transfer step of a backup or restore", run: runTransfer},
+}
+
+func main() {
+	global := flag.NewFlagSet("vmbr", flag.ExitOnError)
+	envFile := global.String("env-file", "", "load environment variables from this file (default .env when present)")
+	global.Var(envFlag{env: "PROJECT_SYS_CODE"}, "project", "project system code (PROJECT_SYS_CODE)")
+	logFormat := global.String("log-format", "text", "log output format: text or json")
+	global.Usage = func() { usage(global) }
+	_ = global.Parse(os.Args[1:])
+
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatalf("configuration error: %v", err)
+	}
+	if err := loadEnvFile(*envFile); err != nil {
+		log.Fatalf("configuration error: %v", err)
+	}
+
+	args := global.Args()
+	if len(args) == 0 {
+		usage(global)
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			if err := c.run(context.Background(), args[1:]); err != nil {
+				log.Fatalf("%s failed: %v", c.name, err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	usage(global)
+	os.Exit(2)
+}
+
+func usage(global *flag.FlagSet) {
+	out := global.Output()
+	fmt.Fprintf(out, "Usage: vmbr [global flags] <command> [command flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(out, "\nGlobal flags:\n")
+	global.PrintDefaults()
+	fmt.Fprintf(out, "\nRun 'vmbr <command> -h' for command flags.\n")
+}
+
+// loadEnvFile loads path into the environment without overriding variables
+// that are already set. An empty path loads .env if it exists.
+func loadEnvFile(path string) error {
+	if path == "" {
+		if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("warning: failed to load .env: %v", err)
+		}
+		return nil
+	}
+	if err := godotenv.Load(path); err != nil {
+		return fmt.Errorf("failed to load env file %s: %w", path, err)
+	}
+	return nil
+}
+
+// setupLogging routes the standard logger through slog so that --log-format
+// json also applies to log.Printf calls in the internal packages.
+func setupLogging(format string) error {
+	switch format {
+	case "", "text":
+		return nil
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		return nil
+	default:
+		return fmt.Errorf("unsupported log format %q (want text or json)", format)
+	}
+}
+
+// envFlag is a flag.Value that writes its value into an environment
+// variable, so command-line flags override what LoadConfigFromEnv reads.
+type envFlag struct {
+	env string
+}
+
+func (f envFlag) String() string { return "" }
+
+func (f envFlag) Set(v string) error { return os.Setenv(f.env, v) }
+
+// envBoolFlag is the boolean counterpart of envFlag.
+type envBoolFlag struct {
+	env string
+}
+
+func (f envBoolFlag) String() string { return "" }
+
+func (f envBoolFlag) Set(v string) error { return os.Setenv(f.env, v) }
+
+func (f envBoolFlag) IsBoolFlag() bool { return true }
+
+// dryRunFlags registers --dry-run and --json on fs.
+func dryRunFlags(fs *flag.FlagSet) (dryRun, asJSON *bool) {
+	dryRun = fs.Bool("dry-run", false, "print the plan without changing anything")
+	asJSON = fs.Bool("json", false, "print the --dry-run plan as JSON")
+	return dryRun, asJSON
+}
+
+// writePlan prints p to stdout as text or, with asJSON, as JSON.
+func writePlan(p *plan.Plan, asJSON bool) error {
+	if asJSON {
+		return p.WriteJSON(os.Stdout)
+	}
+	return p.WriteText(os.Stdout)
+}
+
+// loadAPIConfig reads the API and project settings shared by every command.
+// It is used by the housekeeping commands that need neither the BACKUP_* nor
+// the RESTORE_* variables.
+func loadAPIConfig() (*config.Config, error) {
+	if err := util.RequireEnv("API_TOKEN", "API_PROTOCOL", "API_HOST", "PROJECT_SYS_CODE"); err != nil {
+		return nil, err
+	}
+	return &config.Config{
+		BaseURL:        fmt.Sprintf("%s://%s", os.Getenv("API_PROTOCOL"), os.Getenv("API_HOST")),
+		Token:          os.Getenv("API_TOKEN"),
+		ProjectSysCode: os.Getenv("PROJECT_SYS_CODE"),
+	}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"nchc-vmbr/internal/backup"
+	"nchc-vmbr/internal/catalog"
+	"nchc-vmbr/internal/manifest"
+	"nchc-vmbr/internal/plan"
+	"nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
+	"nchc-vmbr/internal/util"
+)
+
+func runPrune(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	repo := fs.String("repo", os.Getenv("BACKUP_REPO"), "VRM repository to prune (default BACKUP_REPO)")
+	keep := fs.Int("keep", envInt("BACKUP_TAG_NUM", 2), "number of newest tags to keep (default BACKUP_TAG_NUM)")
+	policyFlag := fs.String("policy", os.Getenv("BACKUP_RETENTION"), "retention policy such as daily=7,weekly=4,monthly=12,yearly=2; overrides --keep (default BACKUP_RETENTION)")
+	pins := fs.String("pin", os.Getenv("BACKUP_PIN_TAGS"), "comma-separated tag versions or IDs (object names with --s3) never pruned (default BACKUP_PIN_TAGS)")
+	pinPatterns := fs.String("pin-pattern", os.Getenv("BACKUP_PIN_PATTERNS"), "comma-separated globs of tag versions (object names with --s3) never pruned (default BACKUP_PIN_PATTERNS)")
+	allTags := fs.Bool("all-tags", util.IsTrue(os.Getenv("BACKUP_PRUNE_ALL_TAGS")), "also prune tags not created by vmbr, e.g. uploaded by hand (default BACKUP_PRUNE_ALL_TAGS)")
+	dateFormat := fs.String("date-format", os.Getenv("DATE_TAG_FORMAT"), "strftime format of the versions of tags created by vmbr (default DATE_TAG_FORMAT)")
+	s3 := fs.Bool("s3", false, "prune backup objects in the backup destination (BACKUP_DST_*) instead of VRM tags")
+	s3Prefix := fs.String("s3-prefix", "", "with --s3, only consider objects whose name starts with this prefix")
+	image := fs.String("image", envOr("BACKUP_IMAGE", backup.DefaultImage), "with --s3, image name template selecting the backups of the VM, dated by the time in their name; empty to select by --s3-prefix and modification time (default BACKUP_IMAGE)")
+	vm := fs.String("vm", os.Getenv("BACKUP_SRC_VM"), "with --s3, VM whose backups are pruned when the image template contains {{.VM}} (default BACKUP_SRC_VM)")
+	dryRun, asJSON := dryRunFlags(fs)
+	_ = fs.Parse(args)
+	if *asJSON && !*dryRun {
+		return fmt.Errorf("--json requires --dry-run")
+	}
+
+	policy, err := retention.ParsePolicy(*policyFlag)
+	if err != nil {
+		return err
+	}
+	if policy.IsZero() {
+		if *keep <= 0 {
+			return fmt.Errorf("--keep must be greater than zero")
+		}
+		policy = retention.Policy{Last: *keep}
+	}
+	opts := util.PruneOptions{
+		Policy:   policy,
+		Location: util.TaipeiLocation(),
+		Pins:     util.TagPins{Tags: util.SplitList(*pins), Patterns: util.SplitList(*pinPatterns)},
+	}
+	if !*allTags {
+		if *dateFormat == "" {
+			*dateFormat = util.DefaultDateTagFormat
+		}
+		opts.Managed = util.NewManagedTags(*dateFormat)
+	}
+
+	if *s3 {
+		return pruneS3(*image, *vm, *s3Prefix, opts, *dryRun, *asJSON)
+	}
+
+	if *repo == "" {
+		return fmt.Errorf("no repository given; use --repo or set BACKUP_REPO")
+	}
+
+	cfg, err := loadAPIConfig()
+	if err != nil {
+		return err
+	}
+	projClient, err := util.NewProjectClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	vrmClient := projClient.VRM()
+
+	repoID, err := util.FindRepositoryID(ctx, vrmClient, *repo)
+	if err != nil {
+		return err
+	}
+	if repoID == "" {
+		return fmt.Errorf("repository %s not found", *repo)
+	}
+
+	if *dryRun {
+		tags, err := util.ListRepositoryTags(ctx, vrmClient, repoID)
+		if err != nil {
+			return err
+		}
+		p := &plan.Plan{
+			Kind:    "prune",
+			Project: cfg.ProjectSysCode,
+			Targets: []plan.Target{{
+				RepoName:  *repo,
+				RepoID:    repoID,
+				PruneTags: plan.Tags(util.SelectPruneTags(tags, opts)),
+			}},
+		}
+		return writePlan(p, *asJSON)
+	}
+
+	if _, err := util.PruneRepository(ctx, vrmClient, repoID, opts); err != nil {
+		return fmt.Errorf("failed to prune repository tags: %w", err)
+	}
+	log.Printf("Pruned repository %s with policy %s", *repo, policy)
+	return nil
+}
+
+// pruneS3 applies opts to the backup images of vm in the backup destination
+// (an S3 bucket unless BACKUP_DST_TYPE says otherwise): the objects named by
+// the image template, dated by the time in their name, so that the backups
+// of other VMs sharing the bucket are left alone. Without a template, the
+// objects whose name starts with prefix are dated by their modification
+// time; an empty prefix is refused as it would select the whole bucket. The
+// manifest of a deleted image is deleted with it.
+func pruneS3(image, vm, prefix string, opts util.PruneOptions, dryRun, asJSON bool) error {
+	dst, err := util.LocationFromEnv("BACKUP_DST")
+	if err != nil {
+		return err
+	}
+
+	var template, dir string
+	if image != "" {
+		if strings.Contains(image, util.VMPlaceholder) && (vm == "" || strings.ContainsAny(vm, ",*?[")) {
+			return fmt.Errorf("image template %s contains %s; name a single VM with --vm", image, util.VMPlaceholder)
+		}
+		template = util.ApplyTemplate(image, util.TemplateVars{VM: vm, Project: os.Getenv("PROJECT_SYS_CODE")})
+		if strings.Contains(template, "{{.") {
+			return fmt.Errorf("image template %s: placeholders other than %s and %s cannot be matched", template, util.VMPlaceholder, util.ProjectPlaceholder)
+		}
+		if !strings.Contains(template, "%") {
+			return fmt.Errorf("image template %s has no strftime tokens to date the backups by", template)
+		}
+		if dir, err = catalog.Dir(template); err != nil {
+			return err
+		}
+	} else if prefix == "" {
+		return fmt.Errorf("refusing to prune every object in %s; give the image template with --image or a name prefix with --s3-prefix", dst)
+	}
+
+	rclone.Init()
+	defer rclone.Close()
+
+	objects, err := rclone.ListObjects(dst, dir)
+	if err != nil {
+		return err
+	}
+	var items []retention.Item
+	if template != "" {
+		for _, img := range catalog.Match(objects, template, opts.Location) {
+			name := path.Base(img.Name)
+			if strings.HasPrefix(name, prefix) && !opts.Pins.MatchName(name) {
+				items = append(items, retention.Item{ID: img.Name, Name: name, Time: img.Time})
+			}
+		}
+	} else {
+		var matched []rclone.Object
+		for _, o := range objects {
+			// Manifests go with their images rather than counting as backups.
+			if strings.HasPrefix(o.Name, prefix) && !manifest.IsManifest(o.Name) && !opts.Pins.MatchName(o.Name) {
+				matched = append(matched, o)
+			}
+		}
+		items = retention.FromObjects(matched)
+	}
+	del := retention.Select(opts.Policy, items, opts.Location)
+	names := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		names[o.Path] = true
+	}
+
+	if dryRun {
+		t := plan.Target{}
+		for _, it := range del {
+			t.PruneObjects = append(t.PruneObjects, plan.Object{Endpoint: dst.Endpoint(), Bucket: dst.Dir(), Key: it.ID})
+			if m := manifest.Name(it.ID); names[m] {
+				t.PruneObjects = append(t.PruneObjects, plan.Object{Endpoint: dst.Endpoint(), Bucket: dst.Dir(), Key: m})
+			}
+		}
+		return writePlan(&plan.Plan{Kind: "prune", Project: os.Getenv("PROJECT_SYS_CODE"), Targets: []plan.Target{t}}, asJSON)
+	}
+
+	for _, it := range del {
+		if err := rclone.DeleteObject(dst, it.ID); err != nil {
+			return err
+		}
+		log.Printf("Deleted %s from %s", it.ID, dst)
+		if m := manifest.Name(it.ID); names[m] {
+			if err := rclone.DeleteObject(dst, m); err != nil {
+				return err
+			}
+			log.Printf("Deleted %s from %s", m, dst)
+		}
+	}
+	log.Printf("Pruned %d of %d objects in %s with policy %s", len(del), len(items), dst, opts.Policy)
+	return nil
+}
+
+// envInt returns the integer value of the environment variable name, or def
+// when it is unset or not a valid integer.
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// envOr returns the value of the environment variable name, or def when it
+// is unset or empty.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
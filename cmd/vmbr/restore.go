@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"nchc-vmbr/internal/catalog"
+	"nchc-vmbr/internal/restore"
+)
+
+func runRestore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Var(envFlag{env: "RESTORE_DST_VM"}, "vm-prefix", "name prefix of the created VM (RESTORE_DST_VM)")
+	fs.Var(envFlag{env: "RESTORE_REPO"}, "repo", "VRM repository to upload the image into (RESTORE_REPO)")
+	fs.Var(envFlag{env: "RESTORE_TAG_NUM"}, "tag-num", "number of tags to retain in the repository (RESTORE_TAG_NUM)")
+	fs.Var(envFlag{env: "RESTORE_PRUNE_MODE"}, "prune-mode", "prune old tags after the new one is active (after) or before the upload (before) (RESTORE_PRUNE_MODE)")
+	fs.Var(envBoolFlag{env: "RESTORE_PRUNE_ALL_TAGS"}, "prune-all-tags", "also prune tags not created by vmbr, e.g. uploaded by hand (RESTORE_PRUNE_ALL_TAGS)")
+	fs.Var(envFlag{env: "RESTORE_CS_BUCKET"}, "bucket", "CS bucket holding the image (RESTORE_CS_BUCKET)")
+	fs.Var(envFlag{env: "RESTORE_IMAGE"}, "image", "image filename template (RESTORE_IMAGE)")
+	fs.Var(envFlag{env: "RESTORE_FLAVOR_ID"}, "flavor", "flavor ID of the created VM (RESTORE_FLAVOR_ID)")
+	fs.Var(envFlag{env: "RESTORE_NETWORK_ID"}, "network", "network ID of the created VM NIC (RESTORE_NETWORK_ID)")
+	fs.Var(envFlag{env: "RESTORE_KEYPAIR_ID"}, "keypair", "keypair ID of the created VM (RESTORE_KEYPAIR_ID)")
+	fs.Var(envFlag{env: "RESTORE_SECURITYGROUP_ID"}, "security-group", "security group ID of the created VM (RESTORE_SECURITYGROUP_ID)")
+	fs.Var(envFlag{env: "RESTORE_NICS"}, "nics", "NICs of the created VM, e.g. 'network=net-1,sg=sg-1,sg=sg-2,ip=10.0.0.5;network=net-2'; replaces --network and --security-group (RESTORE_NICS)")
+	fs.Var(envFlag{env: "RESTORE_FROM_TAG"}, "from-tag", "boot from this existing VRM tag, <repo>:<version>, skipping the transfer and upload (RESTORE_FROM_TAG)")
+	fs.Var(envFlag{env: "RESTORE_REBUILD_VM"}, "rebuild", "rebuild this existing server (name or ID) from the uploaded tag instead of creating a new VM; the server is deleted and recreated with a new ID (RESTORE_REBUILD_VM)")
+	fs.Var(envBoolFlag{env: "RESTORE_HEALTH_WAIT_IP"}, "health-wait-ip", "fail unless the restored VM reports an IP address (RESTORE_HEALTH_WAIT_IP)")
+	fs.Var(envFlag{env: "RESTORE_HEALTH_TCP_PORT"}, "health-tcp-port", "fail unless this TCP port of the restored VM accepts connections, e.g. 22 (RESTORE_HEALTH_TCP_PORT)")
+	fs.Var(envFlag{env: "RESTORE_HEALTH_HTTP_URL"}, "health-http-url", "fail unless this URL answers with a 2xx or 3xx status; {{.IP}} is the VM address (RESTORE_HEALTH_HTTP_URL)")
+	fs.Var(envFlag{env: "RESTORE_HEALTH_COMMAND"}, "health-command", "fail unless this shell command succeeds; it gets VMBR_SERVER_ID and VMBR_SERVER_IP (RESTORE_HEALTH_COMMAND)")
+	fs.Var(envFlag{env: "RESTORE_HEALTH_TIMEOUT"}, "health-timeout", "time allowed for the health checks, e.g. 10m (RESTORE_HEALTH_TIMEOUT)")
+	fs.Var(envBoolFlag{env: "RESTORE_HEALTH_DELETE_ON_FAILURE"}, "health-delete-on-failure", "delete the created VM when the health checks fail (RESTORE_HEALTH_DELETE_ON_FAILURE)")
+	fs.Var(envBoolFlag{env: "RESTORE_TRANSFR_FROM_S3"}, "transfer", "fetch the image from the source S3 first (RESTORE_TRANSFR_FROM_S3)")
+	fs.Var(envFlag{env: "DATE_TAG_FORMAT"}, "date-format", "strftime format of the tag version (DATE_TAG_FORMAT)")
+	fs.Var(envFlag{env: "STATE_DIR"}, "state-dir", "directory of the run state files (STATE_DIR)")
+	resume := fs.String("resume", "", "resume the restore run with this ID at its first incomplete stage")
+	at := fs.String("at", "", "restore the newest backup image taken on this date or at this time, e.g. 2026-10-10 or 2026-10-10T02:00")
+	before := fs.String("before", "", "restore the newest backup image taken before this date or time")
+	latest := fs.Bool("latest", false, "restore the newest backup image")
+	confirmRebuild := fs.Bool("confirm-rebuild", false, "confirm that --rebuild may delete the existing server and recreate it with a new ID")
+	dryRun, asJSON := dryRunFlags(fs)
+	_ = fs.Parse(args)
+	if *asJSON && !*dryRun {
+		return fmt.Errorf("--json requires --dry-run")
+	}
+	if *dryRun && *resume != "" {
+		return fmt.Errorf("--dry-run cannot be combined with --resume")
+	}
+
+	cfg, err := restore.LoadConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	cfg.RunID = *resume
+	cfg.ConfirmRebuild = *confirmRebuild
+
+	if *at != "" || *before != "" || *latest {
+		if *resume != "" {
+			return fmt.Errorf("--at, --before and --latest cannot be combined with --resume; a resumed run restores its original image")
+		}
+		if cfg.FromTag != "" {
+			return fmt.Errorf("--at, --before and --latest select an image to upload and cannot be combined with --from-tag")
+		}
+		q, err := catalog.ParseQuery(*at, *before, *latest, cfg.Now.Location())
+		if err != nil {
+			return err
+		}
+		img, err := restore.SelectImage(cfg, q)
+		if err != nil {
+			return err
+		}
+		log.Printf("Selected backup image %s taken at %s", img.Name, img.Time.Format(time.RFC3339))
+	}
+	// Compression is detected next to the image actually restored.
+	if err := restore.DetectCompression(cfg); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		p, err := restore.BuildPlan(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		return writePlan(p, *asJSON)
+	}
+
+	// If transfer is not configured or no destination location is provided, skip the transfer and the wait.
+	if cfg.FromTag == "" && (cfg.DstLocation == nil || !cfg.TransferS3) {
+		log.Println("Transfer disabled (no destination location or transfer flag off); skipping transfer and wait")
+	}
+
+	return restore.Run(ctx, cfg)
+}
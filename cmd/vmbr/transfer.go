@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"nchc-vmbr/internal/backup"
+	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/restore"
+	"nchc-vmbr/internal/util"
+)
+
+func runTransfer(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	direction := fs.String("direction", "backup", "transfer direction: backup (CS to S3, BACKUP_* vars) or restore (S3 to CS, RESTORE_* vars)")
+	image := fs.String("image", "", "image filename template; overrides BACKUP_IMAGE or RESTORE_IMAGE")
+	fs.Var(envFlag{env: "BACKUP_SRC_VM"}, "vm", "comma-separated VM names expanded into {{.VM}} for the backup direction (BACKUP_SRC_VM)")
+	_ = fs.Parse(args)
+
+	switch *direction {
+	case "backup":
+		if *image != "" {
+			os.Setenv("BACKUP_IMAGE", *image)
+		}
+		cfg, err := backup.LoadTransferConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		vmCfgs, err := namedBackupConfigs(cfg)
+		if err != nil {
+			return err
+		}
+		for _, vmCfg := range vmCfgs {
+			if err := backup.Transfer(vmCfg); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "restore":
+		if *image != "" {
+			os.Setenv("RESTORE_IMAGE", *image)
+		}
+		cfg, err := restore.LoadTransferConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		if err := restore.DetectCompression(cfg); err != nil {
+			return err
+		}
+		return restore.Transfer(cfg)
+	default:
+		return fmt.Errorf("unknown transfer direction %q (want backup or restore)", *direction)
+	}
+}
+
+// namedBackupConfigs returns one config per VM named in cfg.VMNames. Commands
+// that do not talk to the VPS API cannot resolve BACKUP_SRC_VM_PATTERN or
+// BACKUP_SRC_VM_SELECTOR, so those need explicit names when the image
+// template depends on the VM.
+func namedBackupConfigs(cfg *config.Config) ([]*config.Config, error) {
+	if len(cfg.VMNames) == 0 {
+		if strings.Contains(cfg.BackupRestoreImage, util.VMPlaceholder) {
+			return nil, fmt.Errorf("image template %s needs explicit VM names; use --vm or BACKUP_SRC_VM", cfg.BackupRestoreImage)
+		}
+		return []*config.Config{backup.ForVM(cfg, "", "")}, nil
+	}
+	if strings.Contains(cfg.BackupRestoreImage, util.VMIDPlaceholder) {
+		return nil, fmt.Errorf("image template %s contains %s, which needs the VPS API; run the backup command instead", cfg.BackupRestoreImage, util.VMIDPlaceholder)
+	}
+	vmCfgs := make([]*config.Config, 0, len(cfg.VMNames))
+	for _, name := range cfg.VMNames {
+		vmCfgs = append(vmCfgs, backup.ForVM(cfg, name, ""))
+	}
+	return vmCfgs, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"nchc-vmbr/internal/backup"
+	"nchc-vmbr/internal/catalog"
+	"nchc-vmbr/internal/manifest"
+	"nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/util"
+)
+
+func runVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Var(envFlag{env: "BACKUP_IMAGE"}, "image", "image filename template to check (BACKUP_IMAGE)")
+	fs.Var(envFlag{env: "BACKUP_SRC_VM"}, "vm", "comma-separated VM names expanded into {{.VM}} (BACKUP_SRC_VM)")
+	date := fs.String("date", "", "check the newest image taken on this date or at this time, e.g. 2026-10-10 or 2026-10-10T02:00, instead of today's")
+	fs.Var(envBoolFlag{env: "BACKUP_VERIFY_DOWNLOAD"}, "download", "read the image to compute checksums the storage does not report (BACKUP_VERIFY_DOWNLOAD)")
+	_ = fs.Parse(args)
+
+	// The image is checked in the backup destination; nothing else of the
+	// backup settings is needed.
+	cfg := backup.LoadImageConfigFromEnv()
+	dst, err := util.LocationFromEnv("BACKUP_DST")
+	if err != nil {
+		return err
+	}
+	cfg.DstLocation = &dst
+
+	vmCfgs, err := namedBackupConfigs(cfg)
+	if err != nil {
+		return err
+	}
+
+	rclone.Init()
+	defer rclone.Close()
+
+	for _, vmCfg := range vmCfgs {
+		fileName := util.ApplyStrftime(vmCfg.BackupRestoreImage, vmCfg.Now)
+		if *date != "" {
+			dir, err := catalog.Dir(vmCfg.BackupRestoreImage)
+			if err != nil {
+				return err
+			}
+			objects, err := rclone.ListObjects(*vmCfg.DstLocation, dir)
+			if err != nil {
+				return err
+			}
+			if fileName, err = backup.ImageTakenAt(vmCfg, objects, *date); err != nil {
+				return err
+			}
+		}
+		exists, err := rclone.ObjectExists(*vmCfg.DstLocation, fileName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("image %s not found in %s", fileName, vmCfg.DstLocation)
+		}
+		size, err := rclone.GetRemoteSize(*vmCfg.DstLocation, fileName)
+		if err != nil {
+			return err
+		}
+		log.Printf("Image %s found in %s (%d bytes)", fileName, vmCfg.DstLocation, size)
+
+		// Re-check the image against the size and checksums recorded when
+		// it was exported.
+		m, err := manifest.Read(*vmCfg.DstLocation, fileName)
+		if errors.Is(err, manifest.ErrNotFound) {
+			log.Printf("warning: no manifest for %s; its checksum cannot be verified", fileName)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		compared, err := m.Verify(*vmCfg.DstLocation, vmCfg.VerifyDownload)
+		if err != nil {
+			return err
+		}
+		if len(compared) == 0 {
+			log.Printf("warning: no checksum of %s to compare with its manifest; only its size was verified (see --download)", fileName)
+		} else {
+			log.Printf("Image %s matches its manifest (size, %s)", fileName, strings.Join(compared, ", "))
+		}
+	}
+	return nil
+}
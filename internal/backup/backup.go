@@ -2,24 +2,37 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"nchc-vmbr/internal/catalog"
 	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/manifest"
+	"nchc-vmbr/internal/plan"
 	rclone "nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
+	"nchc-vmbr/internal/state"
 	util "nchc-vmbr/internal/util"
 
 	cloudsdk "github.com/Zillaforge/cloud-sdk"
 	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
 	vrmrepos "github.com/Zillaforge/cloud-sdk/models/vrm/repositories"
 	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
+	vps "github.com/Zillaforge/cloud-sdk/modules/vps/core"
+	vpsserversclient "github.com/Zillaforge/cloud-sdk/modules/vps/servers"
 	vrm "github.com/Zillaforge/cloud-sdk/modules/vrm/core"
 )
 
+// DefaultImage is the image name template used when BACKUP_IMAGE is unset.
+const DefaultImage = "backup-%Y-%m-%d.img"
+
 // nowFunc can be overridden by tests for deterministic timestamp generation.
 var nowFunc = time.Now
 
@@ -32,30 +45,55 @@ func LoadConfigFromEnv() (*config.Config, error) {
 	// produces an error that explicitly names which variables are missing.
 	if err := util.RequireEnv(
 		"API_TOKEN", "API_PROTOCOL", "API_HOST", "PROJECT_SYS_CODE",
-		"BACKUP_SRC_VM", "BACKUP_REPO", "BACKUP_CS_BUCKET"); err != nil {
+		"BACKUP_REPO", "BACKUP_CS_BUCKET"); err != nil {
 		return nil, err
 	}
 
 	baseURL := fmt.Sprintf("%s://%s", os.Getenv("API_PROTOCOL"), os.Getenv("API_HOST"))
 	token := os.Getenv("API_TOKEN")
 	projectSysCode := os.Getenv("PROJECT_SYS_CODE")
-	vmName := os.Getenv("BACKUP_SRC_VM")
 	repoName := os.Getenv("BACKUP_REPO")
-	csBucket := os.Getenv("BACKUP_CS_BUCKET")
 
-	// Use Taiwan timezone for tagging; fallback to fixed offset.
-	loc, err := time.LoadLocation("Asia/Taipei")
+	// VMs can be selected by a comma-separated name list (BACKUP_SRC_VM), a
+	// glob on the server name (BACKUP_SRC_VM_PATTERN) and/or a metadata
+	// selector such as "role=web,env=prod" (BACKUP_SRC_VM_SELECTOR).
+	vmNames := util.SplitList(os.Getenv("BACKUP_SRC_VM"))
+	// BACKUP_SRC_VM_ID selects servers directly by ID and takes precedence
+	// over the name list, bypassing name lookup entirely.
+	vmIDs := util.SplitList(os.Getenv("BACKUP_SRC_VM_ID"))
+	if len(vmIDs) > 0 && len(vmNames) > 0 {
+		log.Printf("warning: BACKUP_SRC_VM_ID is set; ignoring BACKUP_SRC_VM=%s", strings.Join(vmNames, ","))
+		vmNames = nil
+	}
+	vmPattern := os.Getenv("BACKUP_SRC_VM_PATTERN")
+	if vmPattern != "" {
+		if _, err := path.Match(vmPattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_SRC_VM_PATTERN %q: %w", vmPattern, err)
+		}
+	}
+	vmSelector, err := parseSelector(os.Getenv("BACKUP_SRC_VM_SELECTOR"))
 	if err != nil {
-		log.Printf("warning: failed to load Asia/Taipei timezone: %v; falling back to fixed UTC+8", err)
-		loc = time.FixedZone("UTC+8", 8*3600)
+		return nil, err
+	}
+	if len(vmNames) == 0 && len(vmIDs) == 0 && vmPattern == "" && len(vmSelector) == 0 {
+		return nil, fmt.Errorf("missing required environment variables: BACKUP_SRC_VM (or BACKUP_SRC_VM_ID, BACKUP_SRC_VM_PATTERN, BACKUP_SRC_VM_SELECTOR)")
 	}
+	singleVM := len(vmNames)+len(vmIDs) == 1 && vmPattern == "" && len(vmSelector) == 0
+	var vmName string
+	if singleVM && len(vmNames) == 1 {
+		vmName = vmNames[0]
+	}
+	csBucket := os.Getenv("BACKUP_CS_BUCKET")
+
+	// Use Taiwan timezone for tagging; fallback to fixed offset.
+	loc := util.TaipeiLocation()
 
 	// Allow customizing the date tag format via environment variable DATE_TAG_FORMAT.
 	// Accept a strftime-style format (e.g. %Y-%m-%d-%H-%M), convert and apply it using util.ApplyStrftime.
 	// If not set, default to %Y-%m-%d-%H-%M to mimic the original layout 2006-01-02-15-04.
 	dateTagFormat := os.Getenv("DATE_TAG_FORMAT")
 	if dateTagFormat == "" {
-		dateTagFormat = "%Y-%m-%d-%H-%M"
+		dateTagFormat = util.DefaultDateTagFormat
 	}
 
 	now := nowFunc().In(loc)
@@ -64,7 +102,15 @@ func LoadConfigFromEnv() (*config.Config, error) {
 	// Default BACKUP_IMAGE is a strftime pattern; use ISO date-like pattern by default.
 	backupImage := os.Getenv("BACKUP_IMAGE")
 	if backupImage == "" {
-		backupImage = "backup-%Y-%m-%d.img"
+		backupImage = DefaultImage
+	}
+
+	// With more than one VM every VM needs its own repository and image.
+	perVM := func(s string) bool {
+		return strings.Contains(s, util.VMPlaceholder) || strings.Contains(s, util.VMIDPlaceholder)
+	}
+	if !singleVM && (!perVM(repoName) || !perVM(backupImage)) {
+		return nil, fmt.Errorf("BACKUP_REPO and BACKUP_IMAGE must contain %s or %s when backing up more than one VM", util.VMPlaceholder, util.VMIDPlaceholder)
 	}
 
 	// Parse BACKUP_TAG_NUM
@@ -75,6 +121,29 @@ func LoadConfigFromEnv() (*config.Config, error) {
 		}
 	}
 
+	// Parse the concurrency limits for multi-VM backups. BACKUP_WORKERS is the
+	// number of VMs processed at once; BACKUP_MAX_EXPORTS and
+	// BACKUP_MAX_TRANSFERS cap concurrent tag exports and S3 copies (0 leaves
+	// a stage limited only by the worker count).
+	workers := 1
+	if v := os.Getenv("BACKUP_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 {
+			workers = n
+		}
+	}
+	maxExports := 0
+	if v := os.Getenv("BACKUP_MAX_EXPORTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxExports = n
+		}
+	}
+	maxTransfers := 0
+	if v := os.Getenv("BACKUP_MAX_TRANSFERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxTransfers = n
+		}
+	}
+
 	// Read BACKUP_TRANSFR_TO_S3 env var — default to "false" if not set.
 	transferFlag := false
 	if v := os.Getenv("BACKUP_TRANSFR_TO_S3"); v != "" {
@@ -87,34 +156,84 @@ func LoadConfigFromEnv() (*config.Config, error) {
 		}
 	}
 
-	var srcCfg rclone.S3Config
-	var dstCfg rclone.S3Config
-	var srcPtr *rclone.S3Config
-	var dstPtr *rclone.S3Config
+	var srcLoc rclone.Location
+	var dstLoc rclone.Location
+	var srcPtr *rclone.Location
+	var dstPtr *rclone.Location
 
-	// Only require and populate S3 configuration when transfer is enabled.
+	// Only require and populate the transfer locations when transfer is
+	// enabled. Each is an S3 bucket unless BACKUP_SRC_TYPE/BACKUP_DST_TYPE
+	// selects another storage backend.
 	if transferFlag {
-		if err := util.RequireEnv(
-			"BACKUP_SRC_S3_ENDPOINT", "BACKUP_SRC_S3_ACCESS_KEY", "BACKUP_SRC_S3_SECRET_KEY", "BACKUP_SRC_S3_BUCKET",
-			"BACKUP_DST_S3_ENDPOINT", "BACKUP_DST_S3_ACCESS_KEY", "BACKUP_DST_S3_SECRET_KEY", "BACKUP_DST_S3_BUCKET",
-		); err != nil {
+		if srcLoc, err = util.LocationFromEnv("BACKUP_SRC"); err != nil {
+			return nil, err
+		}
+		if dstLoc, err = util.LocationFromEnv("BACKUP_DST"); err != nil {
 			return nil, err
 		}
+		srcPtr = &srcLoc
+		dstPtr = &dstLoc
+	}
 
-		srcCfg = rclone.S3Config{
-			Endpoint:  os.Getenv("BACKUP_SRC_S3_ENDPOINT"),
-			AccessKey: os.Getenv("BACKUP_SRC_S3_ACCESS_KEY"),
-			SecretKey: os.Getenv("BACKUP_SRC_S3_SECRET_KEY"),
-			Bucket:    os.Getenv("BACKUP_SRC_S3_BUCKET"),
+	// The VM manifest is written next to the exported image: through the
+	// source S3 when transferring, otherwise through the S3 endpoint of the CS
+	// bucket (BACKUP_CS_S3_ENDPOINT/_ACCESS_KEY/_SECRET_KEY).
+	catalogPtr := srcPtr
+	if !transferFlag && os.Getenv("BACKUP_CS_S3_ENDPOINT") != "" {
+		if err := util.RequireEnv("BACKUP_CS_S3_ACCESS_KEY", "BACKUP_CS_S3_SECRET_KEY"); err != nil {
+			return nil, err
 		}
-		dstCfg = rclone.S3Config{
-			Endpoint:  os.Getenv("BACKUP_DST_S3_ENDPOINT"),
-			AccessKey: os.Getenv("BACKUP_DST_S3_ACCESS_KEY"),
-			SecretKey: os.Getenv("BACKUP_DST_S3_SECRET_KEY"),
-			Bucket:    os.Getenv("BACKUP_DST_S3_BUCKET"),
+		csCfg := rclone.S3Config{
+			Endpoint:  os.Getenv("BACKUP_CS_S3_ENDPOINT"),
+			AccessKey: os.Getenv("BACKUP_CS_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("BACKUP_CS_S3_SECRET_KEY"),
+			Bucket:    csBucket,
 		}
-		srcPtr = &srcCfg
-		dstPtr = &dstCfg
+		if err := util.S3OptionsFromEnv("BACKUP_CS_S3", &csCfg); err != nil {
+			return nil, err
+		}
+		csLoc := csCfg.Location()
+		catalogPtr = &csLoc
+	}
+
+	// BACKUP_PRUNE_MODE selects when old tags are pruned: "after" the new tag is
+	// ready (default) or "before" creating it, for quota-constrained repos.
+	pruneMode, err := util.ParsePruneMode(os.Getenv("BACKUP_PRUNE_MODE"))
+	if err != nil {
+		return nil, fmt.Errorf("BACKUP_PRUNE_MODE: %w", err)
+	}
+
+	// BACKUP_RETENTION is an optional GFS policy such as
+	// "daily=7,weekly=4,monthly=12,yearly=2"; it takes precedence over
+	// BACKUP_TAG_NUM.
+	policy, err := retention.ParsePolicy(os.Getenv("BACKUP_RETENTION"))
+	if err != nil {
+		return nil, fmt.Errorf("BACKUP_RETENTION: %w", err)
+	}
+
+	// BACKUP_PIN_TAGS (versions or tag IDs) and BACKUP_PIN_PATTERNS (globs on
+	// the version) protect tags from pruning, e.g. for a legal hold.
+	pinTags := util.SplitList(os.Getenv("BACKUP_PIN_TAGS"))
+	pinPatterns := util.SplitList(os.Getenv("BACKUP_PIN_PATTERNS"))
+	for _, pat := range pinPatterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_PIN_PATTERNS entry %q: %w", pat, err)
+		}
+	}
+
+	// Pruning only considers tags created by this tool (versioned with
+	// DATE_TAG_FORMAT or marked as managed) unless BACKUP_PRUNE_ALL_TAGS is set.
+	pruneAllTags := util.IsTrue(os.Getenv("BACKUP_PRUNE_ALL_TAGS"))
+
+	// Copies and images are verified against the size and checksums the
+	// storage reports; BACKUP_VERIFY_DOWNLOAD reads them to compute the MD5
+	// when it reports none.
+	verifyDownload := util.IsTrue(os.Getenv("BACKUP_VERIFY_DOWNLOAD"))
+
+	// Run state files used to resume an interrupted run.
+	stateDir := os.Getenv("STATE_DIR")
+	if stateDir == "" {
+		stateDir = state.DefaultDir
 	}
 
 	cfg := &config.Config{
@@ -122,112 +241,702 @@ func LoadConfigFromEnv() (*config.Config, error) {
 		Token:              token,
 		ProjectSysCode:     projectSysCode,
 		VMName:             vmName,
+		VMNames:            vmNames,
+		VMIDs:              vmIDs,
+		VMPattern:          vmPattern,
+		VMSelector:         vmSelector,
 		RepoName:           repoName,
 		CSBucket:           csBucket,
 		OsType:             "linux",
 		DateTag:            dateTag,
+		DateTagFormat:      dateTagFormat,
 		BackupRestoreImage: backupImage,
 		TagNum:             tagNum,
+		PruneMode:          pruneMode,
+		Retention:          policy,
+		PinTags:            pinTags,
+		PinPatterns:        pinPatterns,
+		PruneAllTags:       pruneAllTags,
 		Now:                now,
-		SrcS3Cfg:           srcPtr,
-		DstS3Cfg:           dstPtr,
+		SrcLocation:        srcPtr,
+		DstLocation:        dstPtr,
+		CatalogLocation:    catalogPtr,
 		TransferS3:         transferFlag,
+		VerifyDownload:     verifyDownload,
+		StateDir:           stateDir,
+		Workers:            workers,
+		MaxExports:         maxExports,
+		MaxTransfers:       maxTransfers,
 	}
 
 	return cfg, nil
 }
 
-// Run performs the complete backup flow using the provided configuration.
-func Run(ctx context.Context, cfg *config.Config) error {
-	client, err := cloudsdk.New(cfg.BaseURL, cfg.Token)
+// LoadImageConfigFromEnv loads only the settings locating the backup images
+// of the VMs named in BACKUP_SRC_VM: the image template (BACKUP_IMAGE), the
+// project code it may embed and the current time, plus
+// BACKUP_VERIFY_DOWNLOAD. Commands that work on the images alone, such as
+// verify and transfer, need neither the API settings, BACKUP_REPO nor a VM
+// selection, and add the locations they use themselves.
+func LoadImageConfigFromEnv() *config.Config {
+	backupImage := os.Getenv("BACKUP_IMAGE")
+	if backupImage == "" {
+		backupImage = DefaultImage
+	}
+	vmNames := util.SplitList(os.Getenv("BACKUP_SRC_VM"))
+	var vmName string
+	if len(vmNames) == 1 {
+		vmName = vmNames[0]
+	}
+	return &config.Config{
+		ProjectSysCode:     os.Getenv("PROJECT_SYS_CODE"),
+		VMName:             vmName,
+		VMNames:            vmNames,
+		BackupRestoreImage: backupImage,
+		Now:                nowFunc().In(util.TaipeiLocation()),
+		VerifyDownload:     util.IsTrue(os.Getenv("BACKUP_VERIFY_DOWNLOAD")),
+	}
+}
+
+// LoadTransferConfigFromEnv loads the settings of a standalone transfer of
+// the backup images: those of LoadImageConfigFromEnv and the BACKUP_SRC and
+// BACKUP_DST locations, whatever BACKUP_TRANSFR_TO_S3 says.
+func LoadTransferConfigFromEnv() (*config.Config, error) {
+	src, err := util.LocationFromEnv("BACKUP_SRC")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := util.LocationFromEnv("BACKUP_DST")
+	if err != nil {
+		return nil, err
+	}
+	cfg := LoadImageConfigFromEnv()
+	cfg.SrcLocation = &src
+	cfg.DstLocation = &dst
+	cfg.TransferS3 = true
+	return cfg, nil
+}
+
+// ImageTakenAt returns the newest backup image of cfg among objects, the
+// listing of the directory of the image template, that was taken on the day
+// or at the time at (see catalog.ParseTime), so that images other than
+// today's can be checked again.
+func ImageTakenAt(cfg *config.Config, objects []rclone.Object, at string) (string, error) {
+	q, err := catalog.ParseQuery(at, "", false, cfg.Now.Location())
+	if err != nil {
+		return "", err
+	}
+	img, err := catalog.Select(catalog.Match(objects, cfg.BackupRestoreImage, cfg.Now.Location()), q)
 	if err != nil {
-		return fmt.Errorf("failed to create SDK client: %w", err)
+		return "", err
 	}
+	return img.Name, nil
+}
+
+// parseSelector parses a "key=value,key2=value2" metadata selector.
+func parseSelector(s string) (map[string]string, error) {
+	items := util.SplitList(s)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	selector := make(map[string]string, len(items))
+	for _, item := range items {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid BACKUP_SRC_VM_SELECTOR entry %q (want key=value)", item)
+		}
+		selector[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return selector, nil
+}
+
+// Result is the outcome of backing up one VM in RunAll.
+type Result struct {
+	VMName   string
+	VMID     string
+	RepoName string
+	Image    string
+	Err      error
+	Duration time.Duration
+	// RunID identifies the checkpointed run; pass it to --resume to retry
+	// the stages that did not complete.
+	RunID string
+}
+
+// stageLimits bounds the pipeline stages shared by all VMs of a RunAll call
+// so that parallel backups don't overload VRM exports or the S3 link.
+type stageLimits struct {
+	exports   util.Semaphore
+	transfers util.Semaphore
+}
+
+// ForVM returns a copy of cfg for backing up the VM named vmName with ID vmID,
+// with the {{.VM}}, {{.VMID}}, {{.Project}} and {{.RunID}} placeholders
+// expanded in the repository and image templates. vmID may be empty for
+// commands that only know the name.
+func ForVM(cfg *config.Config, vmName, vmID string) *config.Config {
+	vmCfg := *cfg
+	vars := util.TemplateVars{VM: vmName, VMID: vmID, Project: cfg.ProjectSysCode, RunID: cfg.RunID}
+	vmCfg.VMName = vmName
+	vmCfg.VMID = vmID
+	vmCfg.VMNames = nil
+	vmCfg.VMIDs = nil
+	vmCfg.VMPattern = ""
+	vmCfg.VMSelector = nil
+	vmCfg.RepoName = util.ApplyTemplate(cfg.RepoName, vars)
+	vmCfg.BackupRestoreImage = util.ApplyTemplate(cfg.BackupRestoreImage, vars)
+	return &vmCfg
+}
+
+// SelectServers returns the servers whose name matches the glob pattern and
+// whose metadata contains every key/value pair of selector. An empty pattern
+// or selector does not filter.
+func SelectServers(servers []*vpsservers.Server, pattern string, selector map[string]string) []*vpsservers.Server {
+	var out []*vpsservers.Server
+	for _, s := range servers {
+		if s == nil {
+			continue
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, s.Name); !ok {
+				continue
+			}
+		}
+		matched := true
+		for k, v := range selector {
+			if s.Metadatas[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			out = append(out, s)
+		}
+	}
+	return out
+}
 
-	projClient, err := client.Project(ctx, cfg.ProjectSysCode)
+// RunAll backs up every VM selected by cfg.VMIDs, cfg.VMNames, cfg.VMPattern
+// and cfg.VMSelector. Each VM is snapshotted, exported and, when enabled,
+// transferred independently; a failure is recorded in that VM's Result and
+// does not stop the others. Up to cfg.Workers VMs run concurrently, with
+// cfg.MaxExports and cfg.MaxTransfers capping the export and transfer
+// stages. The returned error is only set when the VMs could not be resolved
+// at all.
+//
+// Every completed stage is checkpointed in a state file under cfg.StateDir.
+// When cfg.RunID is set, that run is resumed: its timestamp is reused and
+// each VM continues at its first incomplete stage with the recorded IDs.
+func RunAll(ctx context.Context, cfg *config.Config) ([]Result, error) {
+	run, err := state.Open(cfg.StateDir, state.KindBackup, cfg.RunID, cfg.Now, cfg.DateTag)
 	if err != nil {
-		return fmt.Errorf("failed to create project client: %w", err)
+		return nil, err
+	}
+	if cfg.RunID != "" {
+		log.Printf("Resuming backup run %s from %s", run.ID, run.Path())
+	} else {
+		log.Printf("Started backup run %s (state: %s)", run.ID, run.Path())
 	}
+	runCfg := *cfg
+	runCfg.RunID = run.ID
+	runCfg.Now = run.Now
+	runCfg.DateTag = run.DateTag
+	cfg = &runCfg
 
-	vpsClient := projClient.VPS()
-	servers, err := vpsClient.Servers().List(ctx, &vpsservers.ServersListRequest{Name: cfg.VMName})
+	projClient, err := util.NewProjectClient(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to list servers: %w", err)
+		return nil, err
+	}
+	results, err := resolveTargets(ctx, projClient.VPS().Servers(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].RunID = run.ID
+	}
+
+	limits := stageLimits{
+		exports:   util.NewSemaphore(cfg.MaxExports),
+		transfers: util.NewSemaphore(cfg.MaxTransfers),
+	}
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Each worker owns the result it is processing, so no locking is needed.
+	jobs := make(chan *Result)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				start := time.Now()
+				vmCfg := ForVM(cfg, r.VMName, r.VMID)
+				log.Printf("[%s] Backing up VM %s", r.VMName, r.VMID)
+				r.Err = backupVM(ctx, projClient, vmCfg, r.VMID, limits, run)
+				if r.Err == nil && vmCfg.SrcLocation != nil && vmCfg.TransferS3 && !run.Get(r.VMID).Done(state.StageTransfer) {
+					r.Err = transfer(ctx, vmCfg, limits.transfers)
+					if r.Err == nil {
+						r.Err = run.Complete(r.VMID, state.StageTransfer)
+					}
+				}
+				r.Duration = time.Since(start)
+			}
+		}()
+	}
+	for i := range results {
+		r := &results[i]
+		vmCfg := ForVM(cfg, r.VMName, r.VMID)
+		r.RepoName = vmCfg.RepoName
+		r.Image = util.ApplyStrftime(vmCfg.BackupRestoreImage, vmCfg.Now)
+		if r.Err == nil {
+			jobs <- r
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return results, nil
+}
+
+// resolveTargets resolves the VMs selected by cfg into one Result per server.
+// Servers matched by several selectors are only returned once; a name that
+// cannot be resolved yields a Result carrying the error.
+func resolveTargets(ctx context.Context, serversClient *vpsserversclient.Client, cfg *config.Config) ([]Result, error) {
+	var results []Result
+	seen := make(map[string]bool)
+	add := func(name, id string, err error) {
+		if id != "" {
+			if seen[id] {
+				return
+			}
+			seen[id] = true
+		}
+		results = append(results, Result{VMName: name, VMID: id, Err: err})
+	}
+
+	for _, id := range cfg.VMIDs {
+		server, err := serversClient.Get(ctx, id)
+		if err != nil {
+			add(id, "", fmt.Errorf("failed to get server %s: %w", id, err))
+			continue
+		}
+		add(server.Name, server.ID, nil)
+	}
+	for _, name := range cfg.VMNames {
+		id, err := lookupServer(ctx, serversClient, name)
+		add(name, id, err)
+	}
+	if cfg.VMPattern != "" || len(cfg.VMSelector) > 0 {
+		all, err := serversClient.List(ctx, &vpsservers.ServersListRequest{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list servers: %w", err)
+		}
+		servers := make([]*vpsservers.Server, 0, len(all))
+		for _, s := range all {
+			if s != nil {
+				servers = append(servers, s.Server)
+			}
+		}
+		for _, s := range SelectServers(servers, cfg.VMPattern, cfg.VMSelector) {
+			add(s.Name, s.ID, nil)
+		}
 	}
-	if len(servers) == 0 {
-		return fmt.Errorf("no server found with name %s", cfg.VMName)
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no server matched the backup selection")
 	}
-	vmID := servers[0].ID
-	log.Printf("Found VM ID: %s", vmID)
+	rejectSharedNames(results, cfg)
+	return results, nil
+}
 
+// rejectSharedNames fails the results of servers that share a name, e.g.
+// selected by BACKUP_SRC_VM_ID, unless the repository and image templates
+// contain {{.VMID}}: {{.VM}} would give them the same repository and image,
+// so they would overwrite each other's tags and objects.
+func rejectSharedNames(results []Result, cfg *config.Config) {
+	if strings.Contains(cfg.RepoName, util.VMIDPlaceholder) && strings.Contains(cfg.BackupRestoreImage, util.VMIDPlaceholder) {
+		return
+	}
+	ids := make(map[string][]string)
+	for _, r := range results {
+		if r.Err == nil {
+			ids[r.VMName] = append(ids[r.VMName], r.VMID)
+		}
+	}
+	for i := range results {
+		r := &results[i]
+		if r.Err == nil && len(ids[r.VMName]) > 1 {
+			r.Err = fmt.Errorf("servers %s are all named %s; add %s to BACKUP_REPO and BACKUP_IMAGE to back them up separately",
+				strings.Join(ids[r.VMName], ", "), r.VMName, util.VMIDPlaceholder)
+		}
+	}
+}
+
+// BuildPlan resolves everything a backup run would touch — VM and repository
+// IDs, the date tag, the CS path, the S3 objects and the tags that would be
+// pruned — without creating, exporting or deleting anything.
+func BuildPlan(ctx context.Context, cfg *config.Config) (*plan.Plan, error) {
+	projClient, err := util.NewProjectClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 	vrmClient := projClient.VRM()
 
-	// Check repository
-	repos, err := vrmClient.Repositories().List(ctx, &vrmrepos.ListRepositoriesOptions{})
+	results, err := resolveTargets(ctx, projClient.VPS().Servers(), cfg)
 	if err != nil {
-		return fmt.Errorf("failed to list repositories: %w", err)
+		return nil, err
 	}
 
-	var repoID string
-	for _, r := range repos {
-		if r == nil {
+	p := &plan.Plan{Kind: state.KindBackup, Project: cfg.ProjectSysCode, Now: cfg.Now, DateTag: cfg.DateTag}
+	for _, r := range results {
+		vmCfg := ForVM(cfg, r.VMName, r.VMID)
+		t := plan.Target{
+			VMName:   r.VMName,
+			VMID:     r.VMID,
+			RepoName: vmCfg.RepoName,
+			Version:  vmCfg.DateTag,
+			CSPath:   util.BuildCSFilepath(vmCfg.CSBucket, vmCfg.BackupRestoreImage, vmCfg.Now),
+		}
+		if r.Err != nil {
+			t.Error = r.Err.Error()
+			p.Targets = append(p.Targets, t)
 			continue
 		}
-		if r.Name == cfg.RepoName {
-			repoID = r.ID
-			break
+		if vmCfg.TransferS3 && vmCfg.SrcLocation != nil && vmCfg.DstLocation != nil {
+			key := util.ApplyStrftime(vmCfg.BackupRestoreImage, vmCfg.Now)
+			t.Transfer = &plan.Transfer{
+				Src: plan.Object{Endpoint: vmCfg.SrcLocation.Endpoint(), Bucket: vmCfg.SrcLocation.Dir(), Key: key},
+				Dst: plan.Object{Endpoint: vmCfg.DstLocation.Endpoint(), Bucket: vmCfg.DstLocation.Dir(), Key: key},
+			}
+		}
+		if t.RepoID, err = util.FindRepositoryID(ctx, vrmClient, vmCfg.RepoName); err != nil {
+			t.Error = err.Error()
+		} else if t.RepoID != "" && util.PruneOptionsFor(vmCfg, vmCfg.TagNum).Enabled() {
+			tags, err := util.ListRepositoryTags(ctx, vrmClient, t.RepoID)
+			if err != nil {
+				t.Error = err.Error()
+			} else {
+				t.PruneTags = plan.Tags(util.PlanPruneTags(vmCfg, tags))
+				t.PruneWhen = vmCfg.PruneMode
+			}
+		}
+		p.Targets = append(p.Targets, t)
+	}
+	return p, nil
+}
+
+// lookupServer returns the ID of the server named exactly name.
+func lookupServer(ctx context.Context, serversClient *vpsserversclient.Client, name string) (string, error) {
+	// The API name filter may return prefix matches, so filter again locally.
+	res, err := serversClient.List(ctx, &vpsservers.ServersListRequest{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("failed to list servers: %w", err)
+	}
+	servers := make([]*vpsservers.Server, 0, len(res))
+	for _, s := range res {
+		if s != nil {
+			servers = append(servers, s.Server)
+		}
+	}
+	return MatchServerName(servers, name)
+}
+
+// MatchServerName returns the ID of the only server in servers whose name is
+// exactly name. It fails when there is no match, and when several servers
+// share the name it fails listing every candidate ID so the operator can pick
+// one with BACKUP_SRC_VM_ID.
+func MatchServerName(servers []*vpsservers.Server, name string) (string, error) {
+	var ids []string
+	for _, s := range servers {
+		if s != nil && s.Name == name {
+			ids = append(ids, s.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no server found with name %s", name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("server name %s is ambiguous, %d servers match (IDs: %s); set BACKUP_SRC_VM_ID to select one", name, len(ids), strings.Join(ids, ", "))
+	}
+}
+
+// Run backs up the VMs selected by cfg like RunAll, but returns a single
+// error joining the failures of all VMs.
+func Run(ctx context.Context, cfg *config.Config) error {
+	results, err := RunAll(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.VMName, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// backupVM snapshots the VM vmID into cfg.RepoName and exports the new tag to
+// the CS bucket. The export stage is bounded by limits.exports. Stages already
+// recorded as done in run are skipped.
+func backupVM(ctx context.Context, projClient *cloudsdk.ProjectClient, cfg *config.Config, vmID string, limits stageLimits, run *state.Run) error {
+	vrmClient := projClient.VRM()
+	progress := run.Get(cfg.VMID)
+
+	tagID := progress.TagID
+	if progress.Done(state.StageSnapshot) {
+		log.Printf("[%s] Resuming with snapshot tag %s", cfg.VMName, tagID)
+	} else {
+		var err error
+		if tagID, err = snapshotVM(ctx, vrmClient, cfg, vmID, run); err != nil {
+			return err
+		}
+	}
+
+	// Wait for tag to become available.
+	if !progress.Done(state.StageTagAvailable) {
+		log.Printf("[%s] Waiting for tag %s to become available (SDK default wait options)...", cfg.VMName, tagID)
+		if err := vrm.WaitForTagAvailable(ctx, vrmClient.Tags(), tagID); err != nil {
+			return fmt.Errorf("tag %s did not become available: %w", tagID, err)
+		}
+		log.Printf("[%s] Tag %s is now available", cfg.VMName, tagID)
+		if err := run.Complete(cfg.VMID, state.StageTagAvailable); err != nil {
+			return err
+		}
+	}
+
+	if progress.Done(state.StageExport) {
+		log.Printf("[%s] Snapshot already exported; skipping export", cfg.VMName)
+	} else {
+		// Export snapshot to CS
+		downloadReq := &vrmtags.DownloadTagRequest{
+			Filepath: util.BuildCSFilepath(cfg.CSBucket, cfg.BackupRestoreImage, cfg.Now),
+		}
+		err := export(ctx, cfg, limits.exports, func(ctx context.Context) error {
+			return vrmClient.Tags().Download(ctx, tagID, downloadReq)
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[%s] Exported snapshot to S3 successfully", cfg.VMName)
+		if err := run.Complete(cfg.VMID, state.StageExport); err != nil {
+			return err
+		}
+	}
+
+	if !progress.Done(state.StageManifest) {
+		if cfg.CatalogLocation == nil {
+			log.Printf("[%s] No S3 access to the CS bucket; skipping the VM manifest (set BACKUP_CS_S3_ENDPOINT)", cfg.VMName)
+		} else {
+			if err := writeManifest(ctx, projClient.VPS(), cfg, vmID, run); err != nil {
+				return err
+			}
+			if err := run.Complete(cfg.VMID, state.StageManifest); err != nil {
+				return err
+			}
 		}
 	}
 
+	return pruneAfterSuccess(ctx, vrmClient, cfg, run)
+}
+
+// waitForObject waits for remote to appear in loc. It can be overridden by
+// tests to simulate the exported image appearing in the CS bucket.
+var waitForObject = func(loc rclone.Location, remote string) error {
+	rclone.Init()
+	defer rclone.Close()
+	return rclone.WaitForObject(loc, remote, objectWaitTimeout, objectPollInterval)
+}
+
+// export starts the export of a tag with download and holds a slot of sem
+// until the exported image has appeared in the CS bucket, since VRM exports
+// asynchronously; this way BACKUP_MAX_EXPORTS bounds the exports VRM runs at
+// once. Without S3 access to the CS bucket (cfg.CatalogLocation) the image
+// cannot be watched and only the export requests are bounded.
+func export(ctx context.Context, cfg *config.Config, sem util.Semaphore, download func(context.Context) error) error {
+	if err := sem.Acquire(ctx); err != nil {
+		return err
+	}
+	defer sem.Release()
+
+	if err := download(ctx); err != nil {
+		return fmt.Errorf("failed to export tag to S3: %w", err)
+	}
+	if cfg.CatalogLocation == nil {
+		return nil
+	}
+
+	fileName := util.ImageName(cfg.BackupRestoreImage, cfg.Now)
+	log.Printf("[%s] Waiting for exported image %s to appear in the CS bucket...", cfg.VMName, fileName)
+	if err := waitForObject(*cfg.CatalogLocation, fileName); err != nil {
+		return fmt.Errorf("exported image not ready: %w", err)
+	}
+	return nil
+}
+
+// writeManifest records the specification of the server vmID, the
+// provenance of the exported image and its size and checksums in a manifest
+// next to the image, so that a restore can validate the image and recreate
+// the VM from it alone.
+func writeManifest(ctx context.Context, vpsClient *vps.Client, cfg *config.Config, vmID string, run *state.Run) error {
+	srv, err := vpsClient.Servers().Get(ctx, vmID)
+	if err != nil {
+		return fmt.Errorf("failed to get server %s: %w", vmID, err)
+	}
+	nics, err := srv.NICs().List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list NICs of server %s: %w", vmID, err)
+	}
+	progress := run.Get(cfg.VMID)
+	m := &manifest.Manifest{
+		FormatVersion: manifest.FormatVersion,
+		ToolVersion:   manifest.ToolVersion(),
+		Image:         util.ImageName(cfg.BackupRestoreImage, cfg.Now),
+		CreatedAt:     cfg.Now,
+		Project:       cfg.ProjectSysCode,
+		RunID:         cfg.RunID,
+		RepoName:      cfg.RepoName,
+		RepoID:        progress.RepoID,
+		TagID:         progress.TagID,
+		DateTag:       cfg.DateTag,
+		Stages:        make(map[string]time.Time, len(progress.Stages)),
+		Server:        manifest.FromServer(srv.Server, nics),
+	}
+	for stage, t := range progress.Stages {
+		m.Stages[string(stage)] = t
+	}
+
+	rclone.Init()
+	defer rclone.Close()
+	// The export completes asynchronously; the image is measured once it
+	// has appeared in the bucket.
+	if err := rclone.WaitForObject(*cfg.CatalogLocation, m.Image, objectWaitTimeout, objectPollInterval); err != nil {
+		return fmt.Errorf("exported image not ready: %w", err)
+	}
+	obj, err := rclone.Stat(*cfg.CatalogLocation, m.Image)
+	if err != nil {
+		return err
+	}
+	m.Size = obj.Size
+	m.Checksums = obj.Hashes
+	if len(m.Checksums) == 0 && cfg.VerifyDownload {
+		sum, err := rclone.Hashsum(*cfg.CatalogLocation, m.Image, "md5", true)
+		if err != nil {
+			return err
+		}
+		m.Checksums = map[string]string{"md5": sum}
+	}
+	if err := manifest.Write(*cfg.CatalogLocation, m); err != nil {
+		return err
+	}
+	log.Printf("[%s] Wrote manifest %s (%d bytes, checksums %v)", cfg.VMName, manifest.Name(m.Image), m.Size, m.Checksums)
+	return nil
+}
+
+// pruneAfterSuccess deletes the oldest tags beyond cfg.TagNum (or those
+// cfg.Retention does not keep) once the new tag is available and exported, so
+// a failed backup never costs an old restore point. The new tag itself is
+// never deleted. It does nothing unless cfg.PruneMode is util.PruneAfter.
+func pruneAfterSuccess(ctx context.Context, vrmClient *vrm.Client, cfg *config.Config, run *state.Run) error {
+	progress := run.Get(cfg.VMID)
+	opts := util.PruneOptionsFor(cfg, cfg.TagNum, progress.TagID)
+	if cfg.PruneMode != util.PruneAfter || !opts.Enabled() || progress.Done(state.StagePrune) {
+		return nil
+	}
+	deleted, err := util.PruneRepository(ctx, vrmClient, progress.RepoID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to prune repository tags: %w", err)
+	}
+	log.Printf("[%s] Pruned %d tags from repository %s", cfg.VMName, len(deleted), cfg.RepoName)
+	return run.Complete(cfg.VMID, state.StagePrune)
+}
+
+// snapshotVM creates the snapshot tag of vmID, records it in run and returns
+// the tag ID.
+func snapshotVM(ctx context.Context, vrmClient *vrm.Client, cfg *config.Config, vmID string, run *state.Run) (string, error) {
+	// Check repository
+	repoID, err := util.FindRepositoryID(ctx, vrmClient, cfg.RepoName)
+	if err != nil {
+		return "", err
+	}
+
 	var snapshotResp *vrmrepos.CreateSnapshotResponse
 	if repoID == "" {
-		log.Println("Repository not found, creating snapshot (new repo)")
+		log.Printf("[%s] Repository not found, creating snapshot (new repo)", cfg.VMName)
 		req := &vrmrepos.CreateSnapshotFromNewRepositoryRequest{Name: cfg.RepoName, OperatingSystem: cfg.OsType, Version: cfg.DateTag}
 		snapshotResp, err = vrmClient.Repositories().Snapshot(ctx, vmID, req)
 		if err != nil {
-			return fmt.Errorf("failed to create snapshot into new repository: %w", err)
+			return "", fmt.Errorf("failed to create snapshot into new repository: %w", err)
 		}
 	} else {
-		log.Println("Repository found, creating snapshot into existing repository")
-		// If there is a tag retention policy defined, prune older tags first.
-		if cfg.TagNum > 0 {
+		log.Printf("[%s] Repository found, creating snapshot into existing repository", cfg.VMName)
+		// In the prune-before mode, free a slot for the new tag first.
+		if cfg.PruneMode == util.PruneBefore {
 			// Prune the repository tags using the VRM client wrapper. The function
 			// will query the repository's tag subresource and delete the oldest tags
 			// if the configured limit is exceeded.
-			if err := util.PruneRepositoryTags(ctx, vrmClient, repoID, cfg.TagNum-1); err != nil {
-				return fmt.Errorf("failed to prune repository tags: %w", err)
+			if _, err := util.PruneRepository(ctx, vrmClient, repoID, util.PruneOptionsFor(cfg, cfg.TagNum-1)); err != nil {
+				return "", fmt.Errorf("failed to prune repository tags: %w", err)
 			}
 		}
 		req := &vrmrepos.CreateSnapshotFromExistingRepositoryRequest{RepositoryID: repoID, Version: cfg.DateTag}
 		snapshotResp, err = vrmClient.Repositories().Snapshot(ctx, vmID, req)
 		if err != nil {
-			return fmt.Errorf("failed to create snapshot into existing repository: %w", err)
+			return "", fmt.Errorf("failed to create snapshot into existing repository: %w", err)
 		}
 	}
 
 	if snapshotResp == nil || snapshotResp.Tag == nil {
-		return fmt.Errorf("snapshot response missing tag info")
+		return "", fmt.Errorf("snapshot response missing tag info")
 	}
 
 	tagID := snapshotResp.Tag.ID
-	log.Printf("Snapshot created, repository ID: %s, tag ID: %s", snapshotResp.Repository.ID, tagID)
+	log.Printf("[%s] Snapshot created, repository ID: %s, tag ID: %s", cfg.VMName, snapshotResp.Repository.ID, tagID)
 
-	// Wait for tag to become available.
-	log.Printf("Waiting for tag %s to become available (SDK default wait options)...", tagID)
-	if err := vrm.WaitForTagAvailable(ctx, vrmClient.Tags(), tagID); err != nil {
-		return fmt.Errorf("tag %s did not become available: %w", tagID, err)
+	if err := run.Update(cfg.VMID, func(vm *state.VM) {
+		vm.VMID = vmID
+		vm.RepoID = snapshotResp.Repository.ID
+		vm.TagID = tagID
+		vm.MarkDone(state.StageSnapshot)
+	}); err != nil {
+		return "", err
+	}
+	return tagID, nil
+}
+
+// How long to wait for the exported image to show up in the CS bucket.
+const (
+	objectWaitTimeout  = 5 * time.Minute
+	objectPollInterval = 5 * time.Second
+)
+
+// Transfer waits for the exported image to appear in the CS bucket and then
+// copies it to the destination S3.
+func Transfer(cfg *config.Config) error {
+	return transfer(context.Background(), cfg, nil)
+}
+
+// transfer is Transfer with the copy bounded by sem.
+func transfer(ctx context.Context, cfg *config.Config, sem util.Semaphore) error {
+	fileName := util.ApplyStrftime(cfg.BackupRestoreImage, cfg.Now)
+	if err := rclone.WaitForObject(*cfg.SrcLocation, fileName, objectWaitTimeout, objectPollInterval); err != nil {
+		return fmt.Errorf("source object not ready: %w", err)
 	}
-	log.Printf("Tag %s is now available", tagID)
 
-	// Export snapshot to CS
-	downloadReq := &vrmtags.DownloadTagRequest{
-		Filepath: util.BuildCSFilepath(cfg.CSBucket, cfg.BackupRestoreImage, cfg.Now),
+	if err := sem.Acquire(ctx); err != nil {
+		return err
 	}
+	defer sem.Release()
 
-	if err := vrmClient.Tags().Download(ctx, tagID, downloadReq); err != nil {
-		return fmt.Errorf("failed to export tag to S3: %w", err)
+	// Transfer the exported image from the CS bucket to the destination S3
+	if err := util.Transfer(cfg); err != nil {
+		return fmt.Errorf("failed to transfer exported image: %w", err)
 	}
 
-	log.Println("Exported snapshot to S3 successfully")
+	log.Printf("[%s] Transferred exported snapshot to destination S3 successfully", cfg.VMName)
 	return nil
 }
@@ -1,11 +1,20 @@
 package backup
 
 import (
+	"context"
+	"errors"
+	config "nchc-vmbr/internal/config"
+	rclone "nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
+	"nchc-vmbr/internal/state"
 	util "nchc-vmbr/internal/util"
 	"os"
 	"strings"
 	"testing"
 	"time"
+
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
 )
 
 func TestLoadConfigFromEnv(t *testing.T) {
@@ -284,8 +293,8 @@ func TestLoadConfigFromEnv_TransferDefaultFalse(t *testing.T) {
 	if cfg.TransferS3 != false {
 		t.Fatalf("expected TransferS3 to be false by default, got %v", cfg.TransferS3)
 	}
-	if cfg.SrcS3Cfg != nil || cfg.DstS3Cfg != nil {
-		t.Fatalf("expected S3 configs to be nil when transfer disabled, got %+v %+v", cfg.SrcS3Cfg, cfg.DstS3Cfg)
+	if cfg.SrcLocation != nil || cfg.DstLocation != nil {
+		t.Fatalf("expected S3 configs to be nil when transfer disabled, got %+v %+v", cfg.SrcLocation, cfg.DstLocation)
 	}
 }
 
@@ -336,11 +345,66 @@ func TestLoadConfigFromEnv_TransferEnabled(t *testing.T) {
 	if cfg.TransferS3 != true {
 		t.Fatalf("expected TransferS3 to be true, got %v", cfg.TransferS3)
 	}
-	if cfg.SrcS3Cfg == nil || cfg.DstS3Cfg == nil {
-		t.Fatalf("expected S3 configs to be initialized when transfer enabled, got %+v %+v", cfg.SrcS3Cfg, cfg.DstS3Cfg)
+	if cfg.SrcLocation == nil || cfg.DstLocation == nil {
+		t.Fatalf("expected S3 configs to be initialized when transfer enabled, got %+v %+v", cfg.SrcLocation, cfg.DstLocation)
 	}
-	if cfg.SrcS3Cfg.Bucket != "src-bucket" || cfg.DstS3Cfg.Bucket != "dst-bucket" {
-		t.Fatalf("unexpected bucket values: %+v %+v", cfg.SrcS3Cfg, cfg.DstS3Cfg)
+	if cfg.SrcLocation.Root != "src-bucket" || cfg.DstLocation.Root != "dst-bucket" {
+		t.Fatalf("unexpected bucket values: %+v %+v", cfg.SrcLocation, cfg.DstLocation)
+	}
+}
+
+func TestLoadTransferConfigFromEnv(t *testing.T) {
+	// Only the locations and the image are needed; no API settings,
+	// BACKUP_REPO or VM selection.
+	os.Setenv("BACKUP_IMAGE", "{{.Project}}/{{.VM}}/backup-%Y-%m-%d.img")
+	defer os.Unsetenv("BACKUP_IMAGE")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+
+	os.Setenv("BACKUP_SRC_S3_ENDPOINT", "https://src.example.com")
+	defer os.Unsetenv("BACKUP_SRC_S3_ENDPOINT")
+	os.Setenv("BACKUP_SRC_S3_ACCESS_KEY", "src-access")
+	defer os.Unsetenv("BACKUP_SRC_S3_ACCESS_KEY")
+	os.Setenv("BACKUP_SRC_S3_SECRET_KEY", "src-secret")
+	defer os.Unsetenv("BACKUP_SRC_S3_SECRET_KEY")
+	os.Setenv("BACKUP_SRC_S3_BUCKET", "src-bucket")
+	defer os.Unsetenv("BACKUP_SRC_S3_BUCKET")
+
+	if _, err := LoadTransferConfigFromEnv(); err == nil {
+		t.Fatalf("expected error without the BACKUP_DST settings")
+	}
+
+	os.Setenv("BACKUP_DST_S3_ENDPOINT", "https://dst.example.com")
+	defer os.Unsetenv("BACKUP_DST_S3_ENDPOINT")
+	os.Setenv("BACKUP_DST_S3_ACCESS_KEY", "dst-access")
+	defer os.Unsetenv("BACKUP_DST_S3_ACCESS_KEY")
+	os.Setenv("BACKUP_DST_S3_SECRET_KEY", "dst-secret")
+	defer os.Unsetenv("BACKUP_DST_S3_SECRET_KEY")
+	os.Setenv("BACKUP_DST_S3_BUCKET", "dst-bucket")
+	defer os.Unsetenv("BACKUP_DST_S3_BUCKET")
+
+	cfg, err := LoadTransferConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !cfg.TransferS3 || cfg.SrcLocation == nil || cfg.DstLocation == nil {
+		t.Fatalf("expected transfer to be configured, got %+v", cfg)
+	}
+	if cfg.SrcLocation.Root != "src-bucket" || cfg.DstLocation.Root != "dst-bucket" {
+		t.Fatalf("unexpected bucket values: %+v %+v", cfg.SrcLocation, cfg.DstLocation)
+	}
+	if len(cfg.VMNames) != 0 {
+		t.Fatalf("expected no VM names, got %v", cfg.VMNames)
+	}
+
+	os.Setenv("BACKUP_SRC_VM", "web-01")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	cfg, err = LoadTransferConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := ForVM(cfg, cfg.VMName, "").BackupRestoreImage; got != "proj-123/web-01/backup-%Y-%m-%d.img" {
+		t.Fatalf("unexpected image template: %s", got)
 	}
 }
 
@@ -372,3 +436,604 @@ func TestTransfer_ReturnsErrorWhenNotConfigured(t *testing.T) {
 		t.Fatalf("expected error when calling Transfer while not configured, got nil")
 	}
 }
+
+func TestLoadConfigFromEnv_MultipleVMsRequireTemplate(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web-01, web-02")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	// Without {{.VM}} in the templates all VMs would share one repo and image.
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error when templates lack {{.VM}} for multiple VMs")
+	}
+
+	os.Setenv("BACKUP_REPO", "{{.VM}}-repo")
+	os.Setenv("BACKUP_IMAGE", "{{.VM}}-%Y-%m-%d.img")
+	defer os.Unsetenv("BACKUP_IMAGE")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cfg.VMNames) != 2 || cfg.VMNames[0] != "web-01" || cfg.VMNames[1] != "web-02" {
+		t.Fatalf("unexpected VMNames: %q", cfg.VMNames)
+	}
+	if cfg.VMName != "" {
+		t.Fatalf("expected VMName to be empty for multiple VMs, got %s", cfg.VMName)
+	}
+}
+
+func TestLoadConfigFromEnv_PatternAndSelector(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_SRC_VM_PATTERN", "web-*")
+	defer os.Unsetenv("BACKUP_SRC_VM_PATTERN")
+	os.Setenv("BACKUP_SRC_VM_SELECTOR", "role=web, env=prod")
+	defer os.Unsetenv("BACKUP_SRC_VM_SELECTOR")
+	os.Setenv("BACKUP_REPO", "{{.VM}}-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_IMAGE", "{{.VM}}-%Y-%m-%d.img")
+	defer os.Unsetenv("BACKUP_IMAGE")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.VMPattern != "web-*" {
+		t.Fatalf("expected VMPattern web-*, got %s", cfg.VMPattern)
+	}
+	if cfg.VMSelector["role"] != "web" || cfg.VMSelector["env"] != "prod" {
+		t.Fatalf("unexpected VMSelector: %v", cfg.VMSelector)
+	}
+
+	os.Setenv("BACKUP_SRC_VM_SELECTOR", "role")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for selector entry without '='")
+	}
+}
+
+func TestForVM(t *testing.T) {
+	base := &config.Config{
+		RepoName:           "{{.VM}}-repo",
+		BackupRestoreImage: "{{.VM}}-backup-%Y-%m-%d.img",
+		VMNames:            []string{"web-01", "web-02"},
+		VMPattern:          "web-*",
+	}
+	got := ForVM(base, "web-01", "server-1")
+	if got.VMName != "web-01" || got.VMID != "server-1" || got.RepoName != "web-01-repo" || got.BackupRestoreImage != "web-01-backup-%Y-%m-%d.img" {
+		t.Fatalf("unexpected per-VM config: %+v", got)
+	}
+	if got.VMNames != nil || got.VMPattern != "" {
+		t.Fatalf("expected selection fields to be cleared, got %+v", got)
+	}
+	if base.RepoName != "{{.VM}}-repo" {
+		t.Fatalf("expected base config to be left unchanged, got %s", base.RepoName)
+	}
+
+	base.ProjectSysCode = "proj-123"
+	base.RunID = "backup-20251123-101800-a1b2c3"
+	base.BackupRestoreImage = "{{.Project}}/{{.VM}}-%Y%m%d-{{.RunID}}.img"
+	if got := ForVM(base, "web-01", "server-1"); got.BackupRestoreImage != "proj-123/web-01-%Y%m%d-backup-20251123-101800-a1b2c3.img" {
+		t.Fatalf("unexpected image template: %s", got.BackupRestoreImage)
+	}
+	base.BackupRestoreImage = "{{.VM}}-{{.VMID}}-%Y%m%d.img"
+	if got := ForVM(base, "web-01", "server-1"); got.BackupRestoreImage != "web-01-server-1-%Y%m%d.img" {
+		t.Fatalf("unexpected image template: %s", got.BackupRestoreImage)
+	}
+}
+
+func TestRejectSharedNames(t *testing.T) {
+	cfg := &config.Config{RepoName: "{{.VM}}-repo", BackupRestoreImage: "{{.VM}}-%Y%m%d.img"}
+	newResults := func() []Result {
+		return []Result{
+			{VMName: "web-01", VMID: "server-1"},
+			{VMName: "web-01", VMID: "server-2"},
+			{VMName: "db-01", VMID: "server-3"},
+			{VMName: "missing", Err: errors.New("not found")},
+		}
+	}
+
+	results := newResults()
+	rejectSharedNames(results, cfg)
+	for _, r := range results[:2] {
+		if r.Err == nil || !strings.Contains(r.Err.Error(), "server-1, server-2") {
+			t.Fatalf("expected %s to be rejected, got %v", r.VMID, r.Err)
+		}
+	}
+	if results[2].Err != nil || results[3].Err.Error() != "not found" {
+		t.Fatalf("expected the other results to be left alone, got %+v", results[2:])
+	}
+	if a, b := ForVM(cfg, "web-01", "server-1"), ForVM(cfg, "web-01", "server-2"); a.RepoName != b.RepoName {
+		t.Fatalf("expected the same repository for the same name")
+	}
+
+	cfg = &config.Config{RepoName: "{{.VM}}-{{.VMID}}", BackupRestoreImage: "{{.VMID}}-%Y%m%d.img"}
+	results = newResults()
+	rejectSharedNames(results, cfg)
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Fatalf("expected VMs told apart by ID to be accepted, got %+v", results)
+	}
+	if a, b := ForVM(cfg, "web-01", "server-1"), ForVM(cfg, "web-01", "server-2"); a.RepoName == b.RepoName || a.BackupRestoreImage == b.BackupRestoreImage {
+		t.Fatalf("expected distinct repositories and images, got %s and %s", a.RepoName, b.RepoName)
+	}
+}
+
+func TestSelectServers(t *testing.T) {
+	servers := []*vpsservers.Server{
+		{ID: "1", Name: "web-01", Metadatas: map[string]string{"env": "prod"}},
+		{ID: "2", Name: "web-02", Metadatas: map[string]string{"env": "dev"}},
+		{ID: "3", Name: "db-01", Metadatas: map[string]string{"env": "prod"}},
+		nil,
+	}
+
+	got := SelectServers(servers, "web-*", nil)
+	if len(got) != 2 || got[0].ID != "1" || got[1].ID != "2" {
+		t.Fatalf("unexpected glob selection: %+v", got)
+	}
+
+	got = SelectServers(servers, "", map[string]string{"env": "prod"})
+	if len(got) != 2 || got[0].ID != "1" || got[1].ID != "3" {
+		t.Fatalf("unexpected selector selection: %+v", got)
+	}
+
+	got = SelectServers(servers, "web-*", map[string]string{"env": "prod"})
+	if len(got) != 1 || got[0].ID != "1" {
+		t.Fatalf("expected pattern and selector to be combined, got %+v", got)
+	}
+}
+
+func TestLoadConfigFromEnv_ConcurrencyLimits(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "test-vm")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.Workers != 1 || cfg.MaxExports != 0 || cfg.MaxTransfers != 0 {
+		t.Fatalf("unexpected default limits: workers=%d exports=%d transfers=%d", cfg.Workers, cfg.MaxExports, cfg.MaxTransfers)
+	}
+
+	os.Setenv("BACKUP_WORKERS", "4")
+	defer os.Unsetenv("BACKUP_WORKERS")
+	os.Setenv("BACKUP_MAX_EXPORTS", "2")
+	defer os.Unsetenv("BACKUP_MAX_EXPORTS")
+	os.Setenv("BACKUP_MAX_TRANSFERS", "1")
+	defer os.Unsetenv("BACKUP_MAX_TRANSFERS")
+
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.Workers != 4 || cfg.MaxExports != 2 || cfg.MaxTransfers != 1 {
+		t.Fatalf("unexpected limits: workers=%d exports=%d transfers=%d", cfg.Workers, cfg.MaxExports, cfg.MaxTransfers)
+	}
+}
+
+func TestMatchServerName(t *testing.T) {
+	servers := []*vpsservers.Server{
+		{ID: "1", Name: "web"},
+		{ID: "2", Name: "web-01"},
+		{ID: "3", Name: "db"},
+		{ID: "4", Name: "db"},
+		nil,
+	}
+
+	// The API filter may return prefix matches; only the exact name counts.
+	id, err := MatchServerName(servers, "web")
+	if err != nil || id != "1" {
+		t.Fatalf("expected exact match 1, got %q (%v)", id, err)
+	}
+
+	if _, err := MatchServerName(servers, "we"); err == nil {
+		t.Fatalf("expected error when no server matches exactly")
+	}
+
+	_, err = MatchServerName(servers, "db")
+	if err == nil {
+		t.Fatalf("expected error for ambiguous name")
+	}
+	if !strings.Contains(err.Error(), "3") || !strings.Contains(err.Error(), "4") {
+		t.Fatalf("expected error to list candidate IDs, got %v", err)
+	}
+}
+
+func TestLoadConfigFromEnv_VMID(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM_ID", "server-uuid")
+	defer os.Unsetenv("BACKUP_SRC_VM_ID")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	// A single ID selects one VM, so templates are not required.
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cfg.VMIDs) != 1 || cfg.VMIDs[0] != "server-uuid" {
+		t.Fatalf("unexpected VMIDs: %q", cfg.VMIDs)
+	}
+	if len(cfg.VMNames) != 0 {
+		t.Fatalf("expected BACKUP_SRC_VM to be ignored when BACKUP_SRC_VM_ID is set, got %q", cfg.VMNames)
+	}
+}
+
+func TestLoadConfigFromEnv_StateDir(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.StateDir != state.DefaultDir {
+		t.Fatalf("expected default state dir %s, got %s", state.DefaultDir, cfg.StateDir)
+	}
+
+	os.Setenv("STATE_DIR", "/var/lib/vmbr")
+	defer os.Unsetenv("STATE_DIR")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.StateDir != "/var/lib/vmbr" {
+		t.Fatalf("expected STATE_DIR to be used, got %s", cfg.StateDir)
+	}
+}
+
+func TestLoadConfigFromEnv_PruneMode(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.PruneMode != util.PruneAfter {
+		t.Fatalf("expected prune-after-success by default, got %s", cfg.PruneMode)
+	}
+
+	os.Setenv("BACKUP_PRUNE_MODE", "before")
+	defer os.Unsetenv("BACKUP_PRUNE_MODE")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.PruneMode != util.PruneBefore {
+		t.Fatalf("expected before, got %s", cfg.PruneMode)
+	}
+
+	os.Setenv("BACKUP_PRUNE_MODE", "sometimes")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for invalid BACKUP_PRUNE_MODE")
+	}
+}
+
+func TestLoadConfigFromEnv_Retention(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+	os.Setenv("BACKUP_RETENTION", "daily=7,weekly=4,monthly=12,yearly=2")
+	defer os.Unsetenv("BACKUP_RETENTION")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := retention.Policy{Daily: 7, Weekly: 4, Monthly: 12, Yearly: 2}
+	if cfg.Retention != want {
+		t.Fatalf("expected %+v, got %+v", want, cfg.Retention)
+	}
+
+	os.Setenv("BACKUP_RETENTION", "hourly=24")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for invalid BACKUP_RETENTION")
+	}
+}
+
+func TestLoadConfigFromEnv_PinnedTags(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+	os.Setenv("BACKUP_PIN_TAGS", "2025-01-01-00-00, golden")
+	defer os.Unsetenv("BACKUP_PIN_TAGS")
+	os.Setenv("BACKUP_PIN_PATTERNS", "hold-*")
+	defer os.Unsetenv("BACKUP_PIN_PATTERNS")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cfg.PinTags) != 2 || cfg.PinTags[1] != "golden" {
+		t.Fatalf("unexpected PinTags: %q", cfg.PinTags)
+	}
+	if len(cfg.PinPatterns) != 1 || cfg.PinPatterns[0] != "hold-*" {
+		t.Fatalf("unexpected PinPatterns: %q", cfg.PinPatterns)
+	}
+
+	os.Setenv("BACKUP_PIN_PATTERNS", "[")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for invalid pin pattern")
+	}
+}
+
+func TestLoadConfigFromEnv_PruneAllTags(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+	os.Setenv("DATE_TAG_FORMAT", "nightly-%Y%m%d")
+	defer os.Unsetenv("DATE_TAG_FORMAT")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.PruneAllTags {
+		t.Fatalf("expected PruneAllTags to be false by default")
+	}
+	if cfg.DateTagFormat != "nightly-%Y%m%d" {
+		t.Fatalf("unexpected DateTagFormat: %s", cfg.DateTagFormat)
+	}
+
+	// Only tags versioned like the run's own tags are pruned by default.
+	cfg.TagNum = 1
+	tags := []*vrmtags.Tag{
+		{ID: "manual", Name: "before-upgrade", CreatedAt: cfg.Now.AddDate(0, 0, -3)},
+		{ID: "n1", Name: "nightly-20251120", CreatedAt: cfg.Now.AddDate(0, 0, -2)},
+		{ID: "n2", Name: "nightly-20251121", CreatedAt: cfg.Now.AddDate(0, 0, -1)},
+	}
+	got := util.SelectPruneTags(tags, util.PruneOptionsFor(cfg, cfg.TagNum))
+	if len(got) != 1 || got[0].ID != "n1" {
+		t.Fatalf("expected only n1 to be pruned, got %+v", got)
+	}
+
+	os.Setenv("BACKUP_PRUNE_ALL_TAGS", "true")
+	defer os.Unsetenv("BACKUP_PRUNE_ALL_TAGS")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !cfg.PruneAllTags {
+		t.Fatalf("expected PruneAllTags to be true")
+	}
+	cfg.TagNum = 1
+	got = util.SelectPruneTags(tags, util.PruneOptionsFor(cfg, cfg.TagNum))
+	if len(got) != 2 || got[0].ID != "manual" {
+		t.Fatalf("expected manual and n1 to be pruned, got %+v", got)
+	}
+}
+
+func TestLoadConfigFromEnv_ManifestBucket(t *testing.T) {
+	os.Unsetenv("BACKUP_TRANSFR_TO_S3")
+	os.Setenv("API_PROTOCOL", "https")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("BACKUP_SRC_VM", "web")
+	defer os.Unsetenv("BACKUP_SRC_VM")
+	os.Setenv("BACKUP_REPO", "snapshot-repo")
+	defer os.Unsetenv("BACKUP_REPO")
+	os.Setenv("BACKUP_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("BACKUP_CS_BUCKET")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.CatalogLocation != nil {
+		t.Fatalf("expected no manifest bucket without S3 configuration, got %+v", cfg.CatalogLocation)
+	}
+	if cfg.VerifyDownload {
+		t.Fatalf("expected VerifyDownload to be false by default")
+	}
+
+	os.Setenv("BACKUP_CS_S3_ENDPOINT", "https://cs.example.com")
+	defer os.Unsetenv("BACKUP_CS_S3_ENDPOINT")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error when the CS S3 credentials are missing")
+	}
+	os.Setenv("BACKUP_CS_S3_ACCESS_KEY", "cs-access")
+	defer os.Unsetenv("BACKUP_CS_S3_ACCESS_KEY")
+	os.Setenv("BACKUP_CS_S3_SECRET_KEY", "cs-secret")
+	defer os.Unsetenv("BACKUP_CS_S3_SECRET_KEY")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.CatalogLocation == nil || cfg.CatalogLocation.Root != "my-bucket" || cfg.CatalogLocation.Endpoint() != "https://cs.example.com" {
+		t.Fatalf("unexpected manifest location: %+v", cfg.CatalogLocation)
+	}
+
+	os.Setenv("BACKUP_VERIFY_DOWNLOAD", "true")
+	defer os.Unsetenv("BACKUP_VERIFY_DOWNLOAD")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !cfg.VerifyDownload {
+		t.Fatalf("expected VerifyDownload to be true")
+	}
+}
+
+func TestExport_HoldsSlotUntilImageAppears(t *testing.T) {
+	appeared := make(chan struct{})
+	waiting := make(chan string, 2)
+	origWait := waitForObject
+	defer func() { waitForObject = origWait }()
+	waitForObject = func(loc rclone.Location, remote string) error {
+		waiting <- remote
+		<-appeared
+		return nil
+	}
+
+	catalogLoc := rclone.LocalLocation("/mnt/cs")
+	now := time.Date(2025, 11, 22, 10, 18, 0, 0, time.UTC)
+	sem := util.NewSemaphore(1)
+	started := make(chan string, 2)
+	errs := make(chan error, 2)
+	exportVM := func(name string) {
+		cfg := &config.Config{VMName: name, BackupRestoreImage: name + "-%Y-%m-%d.img", Now: now, CatalogLocation: &catalogLoc}
+		errs <- export(context.Background(), cfg, sem, func(context.Context) error {
+			started <- name
+			return nil
+		})
+	}
+
+	go exportVM("a")
+	if got := <-started; got != "a" {
+		t.Fatalf("expected export of a to start, got %s", got)
+	}
+	if got := <-waiting; got != "a-2025-11-22.img" {
+		t.Fatalf("expected to wait for a-2025-11-22.img, got %s", got)
+	}
+
+	go exportVM("b")
+	select {
+	case got := <-started:
+		t.Fatalf("export of %s started before the image of a appeared", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(appeared)
+	if got := <-started; got != "b" {
+		t.Fatalf("expected export of b to start, got %s", got)
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+}
+
+func TestImageTakenAt(t *testing.T) {
+	cfg := &config.Config{
+		BackupRestoreImage: "web-01/backup-%Y-%m-%d.img",
+		Now:                time.Date(2025, 11, 22, 0, 30, 0, 0, util.TaipeiLocation()),
+	}
+	objects := []rclone.Object{
+		{Path: "web-01/backup-2025-11-20.img"},
+		{Path: "web-01/backup-2025-11-21.img"},
+		{Path: "web-01/backup-2025-11-21.img.manifest.json"},
+		{Path: "web-01/backup-2025-11-22.img"},
+	}
+
+	// A backup made before midnight is checked after it.
+	got, err := ImageTakenAt(cfg, objects, "2025-11-21")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got != "web-01/backup-2025-11-21.img" {
+		t.Fatalf("expected the image of 2025-11-21, got %s", got)
+	}
+
+	if _, err := ImageTakenAt(cfg, objects, "2025-11-19"); err == nil {
+		t.Fatalf("expected error for a day without a backup")
+	}
+	if _, err := ImageTakenAt(cfg, objects, "yesterday"); err == nil {
+		t.Fatalf("expected error for an invalid date")
+	}
+}
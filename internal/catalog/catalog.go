@@ -0,0 +1,156 @@
+// Package catalog lists the backup images kept in a bucket and selects one by
+// the timestamp encoded in its name, so that a restore can pick an older
+// backup without editing the image template.
+package catalog
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/util"
+)
+
+// Image is a backup image whose name matches the image template.
+type Image struct {
+	Name string
+	Time time.Time
+	Size int64
+}
+
+// List returns the objects of src named by template, a strftime image name
+// such as backup-%Y-%m-%d.img, oldest first. Their time is parsed back out of
+// the name in loc; other objects are ignored.
+func List(src rclone.Location, template string, loc *time.Location) ([]Image, error) {
+	dir, err := Dir(template)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := rclone.ListObjects(src, dir)
+	if err != nil {
+		return nil, err
+	}
+	return Match(objects, template, loc), nil
+}
+
+// Dir returns the directory holding the images named by template, "" for the
+// root.
+func Dir(template string) (string, error) {
+	dir := path.Dir(template)
+	if dir == "." {
+		dir = ""
+	}
+	if strings.Contains(dir, "%") {
+		return "", fmt.Errorf("image template %s: strftime tokens are only supported in the file name", template)
+	}
+	return dir, nil
+}
+
+// Match returns the objects named by template, oldest first.
+func Match(objects []rclone.Object, template string, loc *time.Location) []Image {
+	var images []Image
+	for _, o := range objects {
+		t, err := util.ParseStrftime(template, o.Path, loc)
+		if err != nil {
+			continue
+		}
+		images = append(images, Image{Name: o.Path, Time: t, Size: o.Size})
+	}
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Time.Before(images[j].Time) })
+	return images
+}
+
+// Query selects the newest image taken in [From, To). A zero bound is open,
+// so the zero Query selects the latest image.
+type Query struct {
+	From time.Time
+	To   time.Time
+}
+
+func (q Query) String() string {
+	switch {
+	case q.From.IsZero() && q.To.IsZero():
+		return "latest"
+	case q.From.IsZero():
+		return "before " + q.To.Format(time.RFC3339)
+	case q.To.IsZero():
+		return "since " + q.From.Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("between %s and %s", q.From.Format(time.RFC3339), q.To.Format(time.RFC3339))
+	}
+}
+
+// timeLayouts are the accepted --at and --before values, with the span of
+// time each one denotes.
+var timeLayouts = []struct {
+	layout string
+	span   time.Duration
+}{
+	{"2006-01-02", 24 * time.Hour},
+	{"2006-01-02T15:04", time.Minute},
+	{"2006-01-02 15:04", time.Minute},
+	{"2006-01-02T15:04:05", time.Second},
+	{"2006-01-02 15:04:05", time.Second},
+	{time.RFC3339, time.Second},
+}
+
+// ParseTime parses a date or timestamp such as 2026-10-10, 2026-10-10T02:00
+// or an RFC 3339 time in loc, and returns it with the span it denotes (a
+// day, a minute or a second).
+func ParseTime(s string, loc *time.Location) (time.Time, time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for _, l := range timeLayouts {
+		if t, err := time.ParseInLocation(l.layout, s, loc); err == nil {
+			return t, l.span, nil
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("invalid time %q (want YYYY-MM-DD, YYYY-MM-DDTHH:MM[:SS] or RFC 3339)", s)
+}
+
+// ParseQuery builds the query of exactly one of at (the newest image taken
+// on that day, minute or second), before (the newest image taken strictly
+// earlier) and latest.
+func ParseQuery(at, before string, latest bool, loc *time.Location) (Query, error) {
+	n := 0
+	for _, set := range []bool{at != "", before != "", latest} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return Query{}, fmt.Errorf("exactly one of --at, --before and --latest must be given")
+	}
+	switch {
+	case at != "":
+		t, span, err := ParseTime(at, loc)
+		if err != nil {
+			return Query{}, err
+		}
+		return Query{From: t, To: t.Add(span)}, nil
+	case before != "":
+		t, _, err := ParseTime(before, loc)
+		if err != nil {
+			return Query{}, err
+		}
+		return Query{To: t}, nil
+	}
+	return Query{}, nil
+}
+
+// Select returns the newest of images, sorted oldest first, that q selects.
+func Select(images []Image, q Query) (Image, error) {
+	for i := len(images) - 1; i >= 0; i-- {
+		t := images[i].Time
+		if !q.To.IsZero() && !t.Before(q.To) {
+			continue
+		}
+		if !q.From.IsZero() && t.Before(q.From) {
+			break
+		}
+		return images[i], nil
+	}
+	return Image{}, fmt.Errorf("no backup image %s among %d candidates", q, len(images))
+}
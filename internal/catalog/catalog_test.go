@@ -0,0 +1,111 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"nchc-vmbr/internal/rclone"
+)
+
+var taipei = time.FixedZone("UTC+8", 8*3600)
+
+func testImages() []Image {
+	objects := []rclone.Object{
+		{Path: "backup-2026-10-10-02-00.img", Size: 10},
+		{Path: "backup-2026-10-08-02-00.img", Size: 8},
+		{Path: "backup-2026-10-10-14-00.img", Size: 11},
+		{Path: "notes.txt"},
+		{Path: "backup-2026-10-09-02-00.img", Size: 9},
+	}
+	return Match(objects, "backup-%Y-%m-%d-%H-%M.img", taipei)
+}
+
+func TestMatch(t *testing.T) {
+	images := testImages()
+	if len(images) != 4 {
+		t.Fatalf("expected 4 images, got %+v", images)
+	}
+	if images[0].Name != "backup-2026-10-08-02-00.img" || images[3].Name != "backup-2026-10-10-14-00.img" {
+		t.Fatalf("expected images oldest first, got %+v", images)
+	}
+	want := time.Date(2026, 10, 8, 2, 0, 0, 0, taipei)
+	if !images[0].Time.Equal(want) || images[0].Size != 8 {
+		t.Fatalf("unexpected image: %+v", images[0])
+	}
+}
+
+func TestMatch_SharedBucket(t *testing.T) {
+	// The newest objects belong to another VM and must not be selected.
+	objects := []rclone.Object{
+		{Path: "web-01/backup-2026-10-09.img", ModTime: time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)},
+		{Path: "web-01/backup-2026-10-10.img", ModTime: time.Date(2026, 10, 11, 0, 0, 0, 0, time.UTC)},
+		{Path: "web-01/backup-2026-10-10.img.manifest.json"},
+		{Path: "web-02/backup-2026-10-11.img"},
+		{Path: "web-010/backup-2026-10-12.img"},
+	}
+	images := Match(objects, "web-01/backup-%Y-%m-%d.img", taipei)
+	if len(images) != 2 || images[0].Name != "web-01/backup-2026-10-09.img" || images[1].Name != "web-01/backup-2026-10-10.img" {
+		t.Fatalf("expected the images of web-01 dated by name, got %+v", images)
+	}
+
+	if dir, err := Dir("web-01/backup-%Y-%m-%d.img"); err != nil || dir != "web-01" {
+		t.Fatalf("Dir = %q, %v", dir, err)
+	}
+	if dir, err := Dir("backup-%Y-%m-%d.img"); err != nil || dir != "" {
+		t.Fatalf("Dir = %q, %v", dir, err)
+	}
+	if _, err := Dir("%Y/backup.img"); err == nil {
+		t.Fatalf("expected an error for strftime tokens in the directory")
+	}
+}
+
+func TestParseQueryAndSelect(t *testing.T) {
+	images := testImages()
+	cases := []struct {
+		at, before string
+		latest     bool
+		want       string
+	}{
+		{latest: true, want: "backup-2026-10-10-14-00.img"},
+		{at: "2026-10-10", want: "backup-2026-10-10-14-00.img"},
+		{at: "2026-10-10T02:00", want: "backup-2026-10-10-02-00.img"},
+		{at: "2026-10-09", want: "backup-2026-10-09-02-00.img"},
+		{before: "2026-10-10", want: "backup-2026-10-09-02-00.img"},
+		{before: "2026-10-10 02:00", want: "backup-2026-10-09-02-00.img"},
+		{before: "2026-10-10T06:30:00Z", want: "backup-2026-10-10-14-00.img"},
+	}
+	for _, c := range cases {
+		q, err := ParseQuery(c.at, c.before, c.latest, taipei)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q, %q, %v) failed: %v", c.at, c.before, c.latest, err)
+		}
+		img, err := Select(images, q)
+		if err != nil {
+			t.Fatalf("Select(%s) failed: %v", q, err)
+		}
+		if img.Name != c.want {
+			t.Fatalf("Select(%s): expected %s, got %s", q, c.want, img.Name)
+		}
+	}
+
+	q, _ := ParseQuery("2026-10-11", "", false, taipei)
+	if _, err := Select(images, q); err == nil {
+		t.Fatalf("expected error when no image was taken on the day")
+	}
+	q, _ = ParseQuery("", "2026-10-08", false, taipei)
+	if _, err := Select(images, q); err == nil {
+		t.Fatalf("expected error when no image is older")
+	}
+}
+
+func TestParseQuery_Errors(t *testing.T) {
+	if _, err := ParseQuery("", "", false, taipei); err == nil {
+		t.Fatalf("expected error when no selector is given")
+	}
+	if _, err := ParseQuery("2026-10-10", "", true, taipei); err == nil {
+		t.Fatalf("expected error when several selectors are given")
+	}
+	if _, err := ParseQuery("yesterday", "", false, taipei); err == nil {
+		t.Fatalf("expected error for an invalid time")
+	}
+}
@@ -3,14 +3,24 @@ package config
 import (
 	"time"
 
+	"nchc-vmbr/internal/health"
 	"nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
 )
 
 type VPSSetting struct {
-	FlavorID        string
-	NetworkID       string
-	KeypairID       string
-	SecurityGroupID string
+	FlavorID  string
+	KeypairID string
+	// NICs are created in order; the first one is the primary interface.
+	NICs []NIC
+}
+
+// NIC is a network interface of a restored VM. FixedIP is optional; without
+// it the network assigns an address.
+type NIC struct {
+	NetworkID string
+	SGIDs     []string
+	FixedIP   string
 }
 
 // Config is a shared configuration struct used by different commands.
@@ -26,20 +36,77 @@ type Config struct {
 
 	// Backup/restore image names
 	BackupRestoreImage string
+	// FromTag, when set, is a <repo>:<version> reference to an existing VRM
+	// tag a restore boots from, skipping the transfer and the upload.
+	FromTag string
 
 	// VM-related fields (restore-specific)
 	VPSSetting *VPSSetting
 	VMName     string
+	// VMID is the ID of the server a per-VM backup config is for; it keys
+	// the progress of the VM in the run state, as names may be shared.
+	VMID string
+	// RebuildServer, when set, is the name or ID of an existing server that
+	// a restore replaces instead of creating a new one. The server is
+	// deleted, so ConfirmRebuild must be set as well.
+	RebuildServer  string
+	ConfirmRebuild bool
+	// HealthCheck verifies that the restored VM has booted.
+	HealthCheck health.Options
+
+	// Backup target selection. VMIDs selects servers directly by ID, VMNames
+	// by exact name, VMPattern is a glob matched against server names and
+	// VMSelector matches server metadata. RepoName and BackupRestoreImage may
+	// contain {{.VM}} when more than one VM is selected.
+	VMIDs      []string
+	VMNames    []string
+	VMPattern  string
+	VMSelector map[string]string
 
-	DateTag string
-	OsType  string
+	// DateTag is DateTagFormat (strftime) applied to Now and versions the
+	// tags created by the run.
+	DateTag       string
+	DateTagFormat string
+	OsType        string
 
 	TagNum int
-	Now    time.Time
+	// PruneMode is util.PruneAfter (delete old tags once the new tag is
+	// ready) or util.PruneBefore (free a slot before creating it).
+	PruneMode string
+	// Retention, when set, replaces the keep-newest-TagNum rule with a
+	// grandfather-father-son policy evaluated in the timezone of Now.
+	Retention retention.Policy
+	// PinTags (versions or IDs) and PinPatterns (globs on the version) are
+	// never pruned and do not count against TagNum or Retention.
+	PinTags     []string
+	PinPatterns []string
+	// PruneAllTags lets pruning consider every tag of the repository rather
+	// than only those versioned with DateTagFormat or marked as managed.
+	PruneAllTags bool
+	Now          time.Time
 
-	SrcS3Cfg *rclone.S3Config
-	DstS3Cfg *rclone.S3Config
+	SrcLocation *rclone.Location
+	DstLocation *rclone.Location
+	// CatalogLocation is the location holding the backup images and their VM
+	// manifests, listed to pick an image by date (restore
+	// --at/--before/--latest); nil when none is configured.
+	CatalogLocation *rclone.Location
 
 	// Transfer flags (kept separate for a staged migration)
 	TransferS3 bool
+	// VerifyDownload computes the MD5 of images by reading them when the
+	// storage reports no checksum to compare, e.g. for multipart uploads.
+	VerifyDownload bool
+
+	// Concurrency limits for multi-VM backups. Workers is the number of VMs
+	// processed at once; MaxExports and MaxTransfers cap concurrent tag
+	// exports and rclone copies (0 means limited only by Workers).
+	Workers      int
+	MaxExports   int
+	MaxTransfers int
+
+	// Checkpointing. StateDir holds one state file per run; a non-empty RunID
+	// resumes that run at its first incomplete stage instead of starting anew.
+	StateDir string
+	RunID    string
 }
@@ -0,0 +1,231 @@
+// Package health checks that a restored VM has actually booted: ACTIVE only
+// means the hypervisor started it. The checks wait for the server to report
+// an IP address, then probe a TCP port and an HTTP endpoint and run a
+// command, retrying each until it passes or the timeout elapses.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+)
+
+// IPPlaceholder is replaced by the address of the VM in Options.HTTPURL.
+const IPPlaceholder = "{{.IP}}"
+
+// Defaults used when Options leaves Timeout or Interval unset.
+const (
+	DefaultTimeout  = 10 * time.Minute
+	DefaultInterval = 10 * time.Second
+)
+
+// ErrFailed is returned by Run when a check does not pass in time.
+var ErrFailed = errors.New("health check failed")
+
+// Options selects the checks run on a restored VM. The address is waited
+// for whenever a probe needs it.
+type Options struct {
+	WaitIP bool
+	// TCPPort is probed with a TCP connection, e.g. 22 for SSH.
+	TCPPort int
+	// HTTPURL must answer a GET with a 2xx or 3xx status; IPPlaceholder is
+	// replaced by the address of the VM.
+	HTTPURL string
+	// Command runs with "sh -c" and must exit with status 0. It gets the
+	// VMBR_SERVER_ID and VMBR_SERVER_IP environment variables.
+	Command  string
+	Timeout  time.Duration
+	Interval time.Duration
+	// DeleteOnFailure deletes the created VM when a check fails.
+	DeleteOnFailure bool
+}
+
+// Enabled reports whether any check is configured.
+func (o Options) Enabled() bool {
+	return o.WaitIP || o.TCPPort > 0 || o.HTTPURL != "" || o.Command != ""
+}
+
+func (o Options) needsIP() bool {
+	return o.WaitIP || o.TCPPort > 0 || o.HTTPURL != ""
+}
+
+func (o Options) timeout() time.Duration {
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (o Options) interval() time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+	return DefaultInterval
+}
+
+// String describes the configured checks, e.g.
+// "IP, TCP port 22 within 10m0s".
+func (o Options) String() string {
+	var checks []string
+	if o.needsIP() {
+		checks = append(checks, "IP")
+	}
+	if o.TCPPort > 0 {
+		checks = append(checks, fmt.Sprintf("TCP port %d", o.TCPPort))
+	}
+	if o.HTTPURL != "" {
+		checks = append(checks, "HTTP "+o.HTTPURL)
+	}
+	if o.Command != "" {
+		checks = append(checks, fmt.Sprintf("command %q", o.Command))
+	}
+	s := strings.Join(checks, ", ") + " within " + o.timeout().String()
+	if o.DeleteOnFailure {
+		s += "; the VM is deleted on failure"
+	}
+	return s
+}
+
+// AddressFunc returns the current address of the server, or "" when it has
+// none yet.
+type AddressFunc func(ctx context.Context) (string, error)
+
+// Address returns the address to probe among the NICs of a server: the
+// first floating IP, otherwise the first fixed address.
+func Address(nics []*vpsservers.ServerNIC) string {
+	for _, n := range nics {
+		if n != nil && n.FloatingIP != nil && n.FloatingIP.Address != "" {
+			return n.FloatingIP.Address
+		}
+	}
+	for _, n := range nics {
+		if n != nil && len(n.Addresses) > 0 {
+			return n.Addresses[0]
+		}
+	}
+	return ""
+}
+
+// Run runs the checks of opts on the server serverID, whose address is
+// looked up with addr. It returns an error wrapping ErrFailed with the last
+// failure when a check does not pass within opts.Timeout.
+func Run(ctx context.Context, opts Options, serverID string, addr AddressFunc) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
+	defer cancel()
+
+	var ip string
+	if opts.needsIP() {
+		err := poll(ctx, opts.interval(), "IP address", func(ctx context.Context) error {
+			var err error
+			if ip, err = addr(ctx); err != nil {
+				return err
+			}
+			if ip == "" {
+				return errors.New("server has no IP address yet")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Server %s has IP address %s", serverID, ip)
+	}
+	if opts.TCPPort > 0 {
+		target := net.JoinHostPort(ip, strconv.Itoa(opts.TCPPort))
+		if err := poll(ctx, opts.interval(), "TCP "+target, func(ctx context.Context) error {
+			return probeTCP(ctx, target)
+		}); err != nil {
+			return err
+		}
+		log.Printf("TCP port %s is open", target)
+	}
+	if opts.HTTPURL != "" {
+		url := strings.ReplaceAll(opts.HTTPURL, IPPlaceholder, ip)
+		if err := poll(ctx, opts.interval(), "HTTP "+url, func(ctx context.Context) error {
+			return probeHTTP(ctx, url)
+		}); err != nil {
+			return err
+		}
+		log.Printf("HTTP endpoint %s is healthy", url)
+	}
+	if opts.Command != "" {
+		env := append(os.Environ(), "VMBR_SERVER_ID="+serverID, "VMBR_SERVER_IP="+ip)
+		if err := poll(ctx, opts.interval(), "command", func(ctx context.Context) error {
+			return runCommand(ctx, opts.Command, env)
+		}); err != nil {
+			return err
+		}
+		log.Printf("Health command succeeded")
+	}
+	return nil
+}
+
+// attemptTimeout bounds a single probe so that a hanging connection does
+// not use up the whole timeout.
+const attemptTimeout = 30 * time.Second
+
+// poll calls check every interval until it succeeds or ctx is done, in
+// which case the last failure of check is returned.
+func poll(ctx context.Context, interval time.Duration, what string, check func(context.Context) error) error {
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		err := check(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %v", ErrFailed, what, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+func probeTCP(ctx context.Context, target string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, command string, env []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	vpsfloatingips "github.com/Zillaforge/cloud-sdk/models/vps/floatingips"
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+)
+
+func TestAddress(t *testing.T) {
+	nics := []*vpsservers.ServerNIC{
+		nil,
+		{NetworkID: "net-1", Addresses: []string{"10.0.0.5"}},
+		{NetworkID: "net-2", Addresses: []string{"10.1.0.5"}, FloatingIP: &vpsfloatingips.FloatingIP{Address: "203.0.113.10"}},
+	}
+	if got := Address(nics); got != "203.0.113.10" {
+		t.Fatalf("expected the floating IP, got %q", got)
+	}
+	if got := Address(nics[:2]); got != "10.0.0.5" {
+		t.Fatalf("expected the fixed address, got %q", got)
+	}
+	if got := Address(nil); got != "" {
+		t.Fatalf("expected no address, got %q", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	srvPort := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	// The address only shows up on the second lookup.
+	lookups := 0
+	addr := func(ctx context.Context) (string, error) {
+		lookups++
+		if lookups < 2 {
+			return "", nil
+		}
+		return "127.0.0.1", nil
+	}
+	opts := Options{
+		TCPPort:  port,
+		HTTPURL:  "http://" + IPPlaceholder + ":" + strconv.Itoa(srvPort) + "/healthz",
+		Command:  `test "$VMBR_SERVER_IP" = 127.0.0.1 && test "$VMBR_SERVER_ID" = server-1`,
+		Timeout:  5 * time.Second,
+		Interval: 10 * time.Millisecond,
+	}
+	if err := Run(context.Background(), opts, "server-1", addr); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if lookups != 2 {
+		t.Fatalf("expected the address to be polled, got %d lookups", lookups)
+	}
+
+	failing := []Options{
+		{HTTPURL: "http://" + IPPlaceholder + ":" + strconv.Itoa(srvPort) + "/missing"},
+		{Command: "echo not ready; exit 1"},
+	}
+	for _, o := range failing {
+		o.Timeout = 100 * time.Millisecond
+		o.Interval = 10 * time.Millisecond
+		if err := Run(context.Background(), o, "server-1", addr); !errors.Is(err, ErrFailed) {
+			t.Fatalf("expected ErrFailed for %s, got %v", o, err)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if (Options{}).Enabled() {
+		t.Fatalf("expected no checks by default")
+	}
+	o := Options{TCPPort: 22, DeleteOnFailure: true}
+	if !o.Enabled() || o.String() != "IP, TCP port 22 within 10m0s; the VM is deleted on failure" {
+		t.Fatalf("unexpected options: %s", o)
+	}
+}
@@ -0,0 +1,270 @@
+// Package manifest records the specification of a backed-up VM in a JSON
+// sidecar object stored next to its image, so that a restore can recreate the
+// VM without being told its flavor, keypair and networks.
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+
+	"nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/rclone"
+)
+
+// FormatVersion is the version of the manifest layout written by this
+// package. Manifests with a newer version are rejected.
+const FormatVersion = 1
+
+// Suffix is appended to the image name to name its manifest.
+const Suffix = ".manifest.json"
+
+// ErrNotFound is returned by Read when the image has no manifest.
+var ErrNotFound = errors.New("manifest not found")
+
+// ErrMismatch is returned by Check when an image differs from its manifest.
+var ErrMismatch = errors.New("image does not match its manifest")
+
+// Version is the version of vmbr recorded in the manifests it writes. It is
+// set at build time with -ldflags "-X nchc-vmbr/internal/manifest.Version=...";
+// when unset, ToolVersion falls back to the build information.
+var Version string
+
+// Manifest describes a backup image and where it comes from.
+type Manifest struct {
+	FormatVersion int    `json:"format_version"`
+	ToolVersion   string `json:"tool_version,omitempty"`
+	Image         string `json:"image"`
+	// Size and Checksums, keyed by rclone hash type such as "md5", describe
+	// the exported image; either is missing when the storage does not
+	// report it.
+	Size      int64             `json:"size,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+
+	// Provenance of the image: the backup run, the repository and the tag
+	// it was exported from, and the completion time of each backup stage.
+	Project  string               `json:"project,omitempty"`
+	RunID    string               `json:"run_id,omitempty"`
+	RepoName string               `json:"repo_name,omitempty"`
+	RepoID   string               `json:"repo_id,omitempty"`
+	TagID    string               `json:"tag_id,omitempty"`
+	DateTag  string               `json:"date_tag,omitempty"`
+	Stages   map[string]time.Time `json:"stages,omitempty"`
+
+	Server Server `json:"server"`
+}
+
+// Server is the specification of the backed-up VM.
+type Server struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	FlavorID    string            `json:"flavor_id"`
+	KeypairID   string            `json:"keypair_id,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	NICs        []NIC             `json:"nics"`
+}
+
+// NIC is a network interface of the backed-up VM.
+type NIC struct {
+	NetworkID string   `json:"network_id"`
+	SGIDs     []string `json:"sg_ids,omitempty"`
+	FixedIP   string   `json:"fixed_ip,omitempty"`
+}
+
+// Name returns the object name of the manifest of image.
+func Name(image string) string {
+	return image + Suffix
+}
+
+// FromServer captures the specification of srv and its NICs. Each NIC keeps
+// its first address as the fixed IP.
+func FromServer(srv *vpsservers.Server, nics []*vpsservers.ServerNIC) Server {
+	s := Server{
+		ID:          srv.ID,
+		Name:        srv.Name,
+		Description: srv.Description,
+		FlavorID:    srv.FlavorID,
+		KeypairID:   srv.KeypairID,
+		Metadata:    srv.Metadatas,
+	}
+	for _, n := range nics {
+		if n == nil {
+			continue
+		}
+		nic := NIC{NetworkID: n.NetworkID, SGIDs: n.SGIDs}
+		if len(nic.SGIDs) == 0 {
+			for _, sg := range n.SecurityGroups {
+				if sg != nil {
+					nic.SGIDs = append(nic.SGIDs, sg.ID)
+				}
+			}
+		}
+		if len(n.Addresses) > 0 {
+			nic.FixedIP = n.Addresses[0]
+		}
+		s.NICs = append(s.NICs, nic)
+	}
+	return s
+}
+
+// ConfigNICs returns the NICs of the server as restore settings.
+func (s Server) ConfigNICs() []config.NIC {
+	out := make([]config.NIC, 0, len(s.NICs))
+	for _, n := range s.NICs {
+		out = append(out, config.NIC{NetworkID: n.NetworkID, SGIDs: n.SGIDs, FixedIP: n.FixedIP})
+	}
+	return out
+}
+
+// ToolVersion returns Version, or the module version or VCS revision vmbr
+// was built from.
+func ToolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var rev, dirty string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	return rev + dirty
+}
+
+// Check compares obj, the image as stored, with the size and checksums
+// recorded in m. Hash types known on one side only are skipped. It returns
+// the hash types compared and an error wrapping ErrMismatch when they differ.
+func (m *Manifest) Check(obj rclone.Object) ([]string, error) {
+	if m.Size > 0 && obj.Size >= 0 && obj.Size != m.Size {
+		return nil, fmt.Errorf("%s: size %d, manifest records %d: %w", m.Image, obj.Size, m.Size, ErrMismatch)
+	}
+	var compared []string
+	for _, typ := range slices.Sorted(maps.Keys(m.Checksums)) {
+		want, got := m.Checksums[typ], obj.Hashes[typ]
+		if want == "" || got == "" {
+			continue
+		}
+		if !strings.EqualFold(want, got) {
+			return compared, fmt.Errorf("%s: %s %s, manifest records %s: %w", m.Image, typ, got, want, ErrMismatch)
+		}
+		compared = append(compared, typ)
+	}
+	return compared, nil
+}
+
+// Verify checks the image of m in loc against the recorded size and
+// checksums. With download set, recorded checksums the storage does not
+// report are computed by reading the image. It returns the hash types
+// compared, as Check does.
+func (m *Manifest) Verify(loc rclone.Location, download bool) ([]string, error) {
+	obj, err := rclone.Stat(loc, m.Image)
+	if err != nil {
+		return nil, err
+	}
+	if download {
+		for _, typ := range slices.Sorted(maps.Keys(m.Checksums)) {
+			if obj.Hashes[typ] != "" {
+				continue
+			}
+			sum, err := rclone.Hashsum(loc, m.Image, typ, true)
+			if err != nil {
+				return nil, err
+			}
+			if obj.Hashes == nil {
+				obj.Hashes = make(map[string]string)
+			}
+			obj.Hashes[typ] = sum
+		}
+	}
+	return m.Check(obj)
+}
+
+// Encode returns m as indented JSON.
+func (m *Manifest) Encode() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// Decode parses a manifest written by Encode.
+func Decode(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.FormatVersion < 1 || m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("unsupported manifest format version %d", m.FormatVersion)
+	}
+	return m, nil
+}
+
+// Write stores m next to its image in loc.
+func Write(loc rclone.Location, m *Manifest) error {
+	data, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	if err := rclone.PutObject(loc, Name(m.Image), data); err != nil {
+		return fmt.Errorf("failed to write manifest of %s: %w", m.Image, err)
+	}
+	return nil
+}
+
+// Read loads the manifest of image from loc. It returns an
+// error wrapping ErrNotFound when there is none.
+func Read(loc rclone.Location, image string) (*Manifest, error) {
+	data, err := rclone.GetObject(loc, Name(image))
+	if errors.Is(err, rclone.ErrObjectNotFound) {
+		return nil, fmt.Errorf("%s: %w", Name(image), ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s: %w", image, err)
+	}
+	return Decode(data)
+}
+
+// Copy copies the manifest of image from src to dst. It returns an error wrapping ErrNotFound when there is none.
+func Copy(src, dst rclone.Location, image string) error {
+	err := rclone.CopyObject(src, Name(image), dst, Name(image))
+	if errors.Is(err, rclone.ErrObjectNotFound) {
+		return fmt.Errorf("%s: %w", Name(image), ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy manifest of %s: %w", image, err)
+	}
+	return nil
+}
+
+// IsManifest reports whether the object name is that of a manifest.
+func IsManifest(name string) bool {
+	return strings.HasSuffix(name, Suffix)
+}
@@ -0,0 +1,107 @@
+package manifest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/Zillaforge/cloud-sdk/models/vps/common"
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+
+	"nchc-vmbr/internal/rclone"
+)
+
+func TestFromServer(t *testing.T) {
+	srv := &vpsservers.Server{
+		ID: "server-1", Name: "web-01", FlavorID: "flavor-1", KeypairID: "kp-1",
+		Metadatas: map[string]string{"backup": "daily"},
+	}
+	nics := []*vpsservers.ServerNIC{
+		{NetworkID: "net-1", Addresses: []string{"10.0.0.5", "10.0.0.6"}, SGIDs: []string{"sg-1", "sg-2"}},
+		nil,
+		{NetworkID: "net-2", SecurityGroups: []*common.IDName{{ID: "sg-3"}}},
+	}
+
+	s := FromServer(srv, nics)
+	if s.ID != "server-1" || s.Name != "web-01" || s.FlavorID != "flavor-1" || s.KeypairID != "kp-1" || s.Metadata["backup"] != "daily" {
+		t.Fatalf("unexpected server: %+v", s)
+	}
+	if len(s.NICs) != 2 || s.NICs[0].FixedIP != "10.0.0.5" || len(s.NICs[0].SGIDs) != 2 {
+		t.Fatalf("unexpected NICs: %+v", s.NICs)
+	}
+	if n := s.NICs[1]; n.NetworkID != "net-2" || len(n.SGIDs) != 1 || n.SGIDs[0] != "sg-3" || n.FixedIP != "" {
+		t.Fatalf("expected security groups read from the NIC details, got %+v", n)
+	}
+
+	cn := s.ConfigNICs()
+	if len(cn) != 2 || cn[0].NetworkID != "net-1" || cn[0].FixedIP != "10.0.0.5" || cn[1].SGIDs[0] != "sg-3" {
+		t.Fatalf("unexpected config NICs: %+v", cn)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	m := &Manifest{
+		FormatVersion: FormatVersion,
+		Image:         "backup-2026-10-16.img",
+		Size:          1024,
+		Checksums:     map[string]string{"md5": "abc"},
+		CreatedAt:     time.Date(2026, 10, 16, 2, 0, 0, 0, time.UTC),
+		TagID:         "tag-1",
+		Stages:        map[string]time.Time{"export": time.Date(2026, 10, 16, 2, 5, 0, 0, time.UTC)},
+		Server:        Server{ID: "server-1", Name: "web-01", FlavorID: "flavor-1", NICs: []NIC{{NetworkID: "net-1"}}},
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	got, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if got.Image != m.Image || !got.CreatedAt.Equal(m.CreatedAt) || got.Server.NICs[0].NetworkID != "net-1" ||
+		got.Size != 1024 || got.Checksums["md5"] != "abc" || got.TagID != "tag-1" || len(got.Stages) != 1 {
+		t.Fatalf("manifest not preserved: %+v", got)
+	}
+
+	if Name("dir/backup.img") != "dir/backup.img.manifest.json" {
+		t.Fatalf("unexpected manifest name %s", Name("dir/backup.img"))
+	}
+	for _, bad := range []string{`{`, `{"format_version":0}`, `{"format_version":99}`} {
+		if _, err := Decode([]byte(bad)); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m := &Manifest{Image: "backup.img", Size: 1024, Checksums: map[string]string{"md5": "ABC"}}
+	cases := []struct {
+		obj      rclone.Object
+		ok       bool
+		compared int
+	}{
+		{rclone.Object{Size: 1024, Hashes: map[string]string{"md5": "abc"}}, true, 1},
+		{rclone.Object{Size: 1024}, true, 0},
+		{rclone.Object{Size: 1024, Hashes: map[string]string{"sha1": "def"}}, true, 0},
+		{rclone.Object{Size: 1000, Hashes: map[string]string{"md5": "abc"}}, false, 0},
+		{rclone.Object{Size: 1024, Hashes: map[string]string{"md5": "abd"}}, false, 0},
+	}
+	for _, c := range cases {
+		compared, err := m.Check(c.obj)
+		if c.ok && (err != nil || len(compared) != c.compared) {
+			t.Fatalf("Check(%+v) = %v, %v", c.obj, compared, err)
+		}
+		if !c.ok && !errors.Is(err, ErrMismatch) {
+			t.Fatalf("Check(%+v): expected ErrMismatch, got %v", c.obj, err)
+		}
+	}
+
+	if ToolVersion() == "" {
+		t.Fatalf("expected a tool version")
+	}
+	Version = "v1.2.3"
+	defer func() { Version = "" }()
+	if ToolVersion() != "v1.2.3" {
+		t.Fatalf("expected the version set at build time, got %s", ToolVersion())
+	}
+}
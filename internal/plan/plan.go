@@ -0,0 +1,224 @@
+// Package plan describes what a backup, restore or prune run would do without
+// changing anything, so that --dry-run output can be reviewed or diffed.
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
+
+	"nchc-vmbr/internal/config"
+)
+
+// Plan is the resolved set of actions of one run.
+type Plan struct {
+	Kind    string    `json:"kind"`
+	Project string    `json:"project"`
+	Now     time.Time `json:"now"`
+	DateTag string    `json:"date_tag"`
+	Targets []Target  `json:"targets"`
+}
+
+// Target is what would happen to one VM (backup), one restored VM (restore)
+// or one repository or bucket (prune).
+type Target struct {
+	VMName string `json:"vm_name,omitempty"`
+	VMID   string `json:"vm_id,omitempty"`
+
+	RepoName string `json:"repo_name,omitempty"`
+	// RepoID is empty when the repository does not exist yet and would be
+	// created by the run.
+	RepoID  string `json:"repo_id,omitempty"`
+	Version string `json:"version,omitempty"`
+	CSPath  string `json:"cs_path,omitempty"`
+	// FromTag is the existing tag a restore boots from instead of uploading
+	// an image.
+	FromTag *Tag `json:"from_tag,omitempty"`
+
+	Transfer *Transfer `json:"transfer,omitempty"`
+	Server   *Server   `json:"server,omitempty"`
+
+	// PruneTags are deleted "before" the new tag is created or "after" it
+	// is ready, as given by PruneWhen.
+	PruneTags []Tag  `json:"prune_tags,omitempty"`
+	PruneWhen string `json:"prune_when,omitempty"`
+	// PruneObjects are backup objects that would be deleted.
+	PruneObjects []Object `json:"prune_objects,omitempty"`
+
+	// Error is set when the target could not be resolved.
+	Error string `json:"error,omitempty"`
+}
+
+// Transfer is an rclone copy between two storage locations.
+type Transfer struct {
+	Src Object `json:"src"`
+	Dst Object `json:"dst"`
+}
+
+// Object is an object in an S3 bucket or, on other storage backends, in the
+// directory Bucket. Endpoint is empty on the local filesystem.
+type Object struct {
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+}
+
+func (o Object) String() string {
+	if o.Endpoint == "" {
+		return path.Join(o.Bucket, o.Key)
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(o.Endpoint, "/"), strings.Trim(o.Bucket, "/"), o.Key)
+}
+
+// Tag is a VRM tag that would be deleted or restored from.
+type Tag struct {
+	ID        string    `json:"id"`
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Server is a VM that would be created by a restore. Replaces is the ID of
+// the existing server that would be deleted first when rebuilding it, and
+// Manifest the VM manifest unset settings were taken from.
+type Server struct {
+	Name      string `json:"name"`
+	FlavorID  string `json:"flavor_id"`
+	KeypairID string `json:"keypair_id"`
+	NICs      []NIC  `json:"nics"`
+	Replaces  string `json:"replaces,omitempty"`
+	Manifest  string `json:"manifest,omitempty"`
+	// HealthCheck describes the checks run once the VM is active.
+	HealthCheck string `json:"health_check,omitempty"`
+}
+
+// NIC is a network interface of a VM that would be created.
+type NIC struct {
+	NetworkID        string   `json:"network_id"`
+	SecurityGroupIDs []string `json:"security_group_ids,omitempty"`
+	FixedIP          string   `json:"fixed_ip,omitempty"`
+}
+
+func (n NIC) String() string {
+	s := "network " + n.NetworkID
+	if len(n.SecurityGroupIDs) > 0 {
+		s += ", security groups " + strings.Join(n.SecurityGroupIDs, ", ")
+	}
+	if n.FixedIP != "" {
+		s += ", fixed IP " + n.FixedIP
+	}
+	return s
+}
+
+// NICs converts configured NICs into plan NICs.
+func NICs(nics []config.NIC) []NIC {
+	out := make([]NIC, 0, len(nics))
+	for _, n := range nics {
+		out = append(out, NIC{NetworkID: n.NetworkID, SecurityGroupIDs: n.SGIDs, FixedIP: n.FixedIP})
+	}
+	return out
+}
+
+// Tags converts VRM tags into plan tags.
+func Tags(tags []*vrmtags.Tag) []Tag {
+	out := make([]Tag, 0, len(tags))
+	for _, t := range tags {
+		if t == nil {
+			continue
+		}
+		out = append(out, Tag{ID: t.ID, Version: t.Name, CreatedAt: t.CreatedAt})
+	}
+	return out
+}
+
+// WriteJSON writes p as indented JSON.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// WriteText writes p in a human-readable form.
+func (p *Plan) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan: %s in project %s (DRY RUN, nothing will be changed)\n", p.Kind, p.Project)
+	if p.DateTag != "" {
+		fmt.Fprintf(&b, "  time:     %s\n", p.Now.Format(time.RFC3339))
+		fmt.Fprintf(&b, "  date tag: %s\n", p.DateTag)
+	}
+	for _, t := range p.Targets {
+		b.WriteString("\n")
+		switch {
+		case t.VMName != "" && t.VMID != "":
+			fmt.Fprintf(&b, "VM %s (%s)\n", t.VMName, t.VMID)
+		case t.VMName != "":
+			fmt.Fprintf(&b, "VM %s\n", t.VMName)
+		case t.RepoName != "":
+			fmt.Fprintf(&b, "Repository %s\n", t.RepoName)
+		default:
+			b.WriteString("S3 objects\n")
+		}
+		if t.Error != "" {
+			fmt.Fprintf(&b, "  ERROR: %s\n", t.Error)
+			continue
+		}
+		switch {
+		case t.RepoName == "":
+		case t.RepoID != "":
+			fmt.Fprintf(&b, "  repository: %s (%s)\n", t.RepoName, t.RepoID)
+		default:
+			fmt.Fprintf(&b, "  repository: %s (will be created)\n", t.RepoName)
+		}
+		if t.Version != "" {
+			fmt.Fprintf(&b, "  new tag:    %s\n", t.Version)
+		}
+		if t.CSPath != "" {
+			fmt.Fprintf(&b, "  CS path:    %s\n", t.CSPath)
+		}
+		if t.FromTag != nil {
+			fmt.Fprintf(&b, "  from tag:   %s (%s, created %s); no transfer or upload\n", t.FromTag.Version, t.FromTag.ID, t.FromTag.CreatedAt.Format(time.RFC3339))
+		}
+		if t.Transfer != nil {
+			fmt.Fprintf(&b, "  transfer:   %s -> %s\n", t.Transfer.Src, t.Transfer.Dst)
+		}
+		if t.Server != nil && t.Server.Replaces != "" {
+			fmt.Fprintf(&b, "  rebuild VM: %s (deletes server %s and recreates it from the new tag with its flavor, NICs, volumes and floating IPs; the server ID changes)\n",
+				t.Server.Name, t.Server.Replaces)
+		} else if t.Server != nil {
+			fmt.Fprintf(&b, "  create VM:  %s (flavor %s, keypair %s)\n", t.Server.Name, t.Server.FlavorID, t.Server.KeypairID)
+		}
+		if t.Server != nil {
+			for _, n := range t.Server.NICs {
+				fmt.Fprintf(&b, "  NIC:        %s\n", n)
+			}
+			if t.Server.Manifest != "" {
+				fmt.Fprintf(&b, "  manifest:   %s (defaults for settings not configured)\n", t.Server.Manifest)
+			}
+			if t.Server.HealthCheck != "" {
+				fmt.Fprintf(&b, "  health:     %s\n", t.Server.HealthCheck)
+			}
+		}
+		for _, o := range t.PruneObjects {
+			fmt.Fprintf(&b, "  delete:     %s\n", o)
+		}
+		if len(t.PruneTags) == 0 && len(t.PruneObjects) == 0 {
+			b.WriteString("  prune:      nothing\n")
+		}
+		for _, tag := range t.PruneTags {
+			fmt.Fprintf(&b, "  prune:      %s (%s, created %s)", tag.Version, tag.ID, tag.CreatedAt.Format(time.RFC3339))
+			switch t.PruneWhen {
+			case "before":
+				b.WriteString(" before creating the new tag")
+			case "after":
+				b.WriteString(" after the new tag is ready")
+			}
+			b.WriteString("\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
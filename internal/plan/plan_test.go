@@ -0,0 +1,151 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
+)
+
+func testPlan() *Plan {
+	now := time.Date(2025, 11, 23, 10, 18, 0, 0, time.UTC)
+	return &Plan{
+		Kind:    "backup",
+		Project: "proj-123",
+		Now:     now,
+		DateTag: "2025-11-23-10-18",
+		Targets: []Target{
+			{
+				VMName:   "web-01",
+				VMID:     "server-1",
+				RepoName: "web-01-backups",
+				RepoID:   "repo-1",
+				Version:  "2025-11-23-10-18",
+				CSPath:   "dss-public://bucket/web-01-2025-11-23.img",
+				Transfer: &Transfer{
+					Src: Object{Endpoint: "https://src", Bucket: "bucket", Key: "web-01-2025-11-23.img"},
+					Dst: Object{Endpoint: "https://dst", Bucket: "archive", Key: "web-01-2025-11-23.img"},
+				},
+				PruneTags: Tags([]*vrmtags.Tag{{ID: "tag-0", Name: "2025-11-20-10-18", CreatedAt: now.AddDate(0, 0, -3)}, nil}),
+			},
+			{VMName: "web-02", Error: "no server found with name web-02"},
+		},
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testPlan().WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+
+	var got Plan
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v", err)
+	}
+	if len(got.Targets) != 2 || len(got.Targets[0].PruneTags) != 1 || got.Targets[0].PruneTags[0].ID != "tag-0" {
+		t.Fatalf("unexpected decoded plan: %+v", got)
+	}
+	if got.Targets[0].Transfer.Dst.Bucket != "archive" {
+		t.Fatalf("unexpected transfer: %+v", got.Targets[0].Transfer)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testPlan().WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"DRY RUN",
+		"VM web-01 (server-1)",
+		"repository: web-01-backups (repo-1)",
+		"transfer:   https://src/bucket/web-01-2025-11-23.img -> https://dst/archive/web-01-2025-11-23.img",
+		"prune:      2025-11-20-10-18 (tag-0",
+		"ERROR: no server found with name web-02",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteText_Rebuild(t *testing.T) {
+	p := &Plan{Kind: "restore", Project: "proj-123", Targets: []Target{{
+		VMName:   "restore-dst-vm",
+		RepoName: "rocky",
+		Server: &Server{Name: "web-01", FlavorID: "flavor-1", Replaces: "server-1", NICs: []NIC{
+			{NetworkID: "net-1", SecurityGroupIDs: []string{"sg-1", "sg-2"}, FixedIP: "10.0.0.5"},
+			{NetworkID: "net-2"},
+		}},
+	}}}
+	var buf bytes.Buffer
+	if err := p.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "rebuild VM: web-01 (deletes server server-1") || strings.Contains(out, "create VM:") {
+		t.Fatalf("expected a rebuild line, got:\n%s", out)
+	}
+	if !strings.Contains(out, "NIC:        network net-1, security groups sg-1, sg-2, fixed IP 10.0.0.5\n  NIC:        network net-2\n") {
+		t.Fatalf("expected one line per NIC, got:\n%s", out)
+	}
+}
+
+func TestWriteText_FromTag(t *testing.T) {
+	created := time.Date(2025, 11, 22, 10, 18, 0, 0, time.UTC)
+	p := &Plan{Kind: "restore", Project: "proj-123", Targets: []Target{{
+		VMName:   "restore-dst-vm",
+		RepoName: "web-01-backups",
+		RepoID:   "repo-1",
+		FromTag:  &Tag{ID: "tag-1", Version: "2025-11-22-10-18", CreatedAt: created},
+	}}}
+	var buf bytes.Buffer
+	if err := p.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "from tag:   2025-11-22-10-18 (tag-1, created 2025-11-22T10:18:00Z)") || strings.Contains(out, "new tag:") {
+		t.Fatalf("expected a from tag line and no new tag, got:\n%s", out)
+	}
+}
+
+func TestWriteText_Manifest(t *testing.T) {
+	p := &Plan{Kind: "restore", Project: "proj-123", Targets: []Target{{
+		VMName:   "restore-dst-vm",
+		RepoName: "web-01-backups",
+		Server: &Server{
+			Name: "restore-dst-vm-2025-11-22", FlavorID: "flavor-1", KeypairID: "kp-1",
+			NICs:     []NIC{{NetworkID: "net-1"}},
+			Manifest: "backup-2025-11-22.img.manifest.json",
+		},
+	}}}
+	var buf bytes.Buffer
+	if err := p.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "manifest:   backup-2025-11-22.img.manifest.json") {
+		t.Fatalf("expected a manifest line, got:\n%s", out)
+	}
+}
+
+func TestObjectString(t *testing.T) {
+	cases := []struct {
+		o    Object
+		want string
+	}{
+		{Object{Endpoint: "https://s3.example.com/", Bucket: "archive", Key: "web-01.img"}, "https://s3.example.com/archive/web-01.img"},
+		{Object{Endpoint: "sftp://vmbr@backup.example.com", Bucket: "/srv/backups", Key: "web-01.img"}, "sftp://vmbr@backup.example.com/srv/backups/web-01.img"},
+		{Object{Bucket: "/mnt/nfs/backups", Key: "web-01.img"}, "/mnt/nfs/backups/web-01.img"},
+	}
+	for _, c := range cases {
+		if got := c.o.String(); got != c.want {
+			t.Fatalf("String() = %s, want %s", got, c.want)
+		}
+	}
+}
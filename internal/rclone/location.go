@@ -0,0 +1,351 @@
+package rclone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/obscure"
+)
+
+// Location is a storage location on any rclone backend: the backend type
+// ("s3", "local", "sftp", "swift", ...), its options and the root object
+// paths are relative to, such as a bucket, a container or a directory.
+type Location struct {
+	Type    string
+	Options map[string]string
+	Root    string
+	// CACert is a PEM file of CA certificates to trust, in addition to the
+	// system ones, when connecting to the location.
+	CACert string
+	// Wrapped is the location a wrapping backend such as crypt stores its
+	// objects in; it is passed to the backend as the "remote" option.
+	Wrapped *Location
+}
+
+// Fs returns the rclone "fs" string of l, e.g.
+//
+//	:sftp,host=backup.example.com,user=vmbr:images
+//
+// It holds the credentials of l; see Redacted.
+func (l Location) Fs() string {
+	return l.Backend() + ":" + l.Root
+}
+
+// fsAt returns the rclone "fs" string of the object at remote in l, for RPCs
+// that take a single path.
+func (l Location) fsAt(remote string) string {
+	return l.Backend() + ":" + path.Join(l.Root, remote)
+}
+
+// Backend returns the on-the-fly backend of l without its root, e.g.
+// :s3,access_key_id=abc,endpoint='https://host'. Options are sorted by name
+// and their values encoded with encodeOption.
+func (l Location) Backend() string {
+	opts := l.Options
+	if l.Wrapped != nil {
+		opts = maps.Clone(opts)
+		if opts == nil {
+			opts = make(map[string]string)
+		}
+		opts["remote"] = l.Wrapped.Fs()
+	}
+	var b strings.Builder
+	b.WriteString(":" + l.Type)
+	for _, k := range slices.Sorted(maps.Keys(opts)) {
+		b.WriteString("," + k + "=" + encodeOption(opts[k]))
+	}
+	return b.String()
+}
+
+// encodeOption encodes an option value for an "fs" string so that rclone
+// parses it back unchanged. An unquoted value ends at the first ':' or ',',
+// so values containing them, or starting with a quote, are quoted with '
+// and any ' in them doubled.
+func encodeOption(v string) string {
+	if !strings.ContainsAny(v, ":,'\"") {
+		return v
+	}
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+// CheckOptionName returns an error when name is not a valid rclone backend
+// option name, which may only contain 0-9, A-Z, a-z and _.
+func CheckOptionName(name string) error {
+	if name == "" {
+		return errors.New("empty option name")
+	}
+	for _, c := range name {
+		if c != '_' && (c < '0' || c > '9') && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return fmt.Errorf("invalid option name %q: only 0-9, A-Z, a-z and _ are allowed", name)
+		}
+	}
+	return nil
+}
+
+// Redacted returns the "fs" string of l with the values of the options
+// rclone marks as sensitive, such as keys and passwords, replaced by XXX,
+// including those of the locations it wraps. Use it instead of Fs in logs
+// and errors.
+func (l Location) Redacted() string {
+	return l.redact().Fs()
+}
+
+func (l Location) redact() Location {
+	r := l
+	r.Options = make(map[string]string, len(l.Options))
+	for k, v := range l.Options {
+		if isSensitive(l.Type, k) {
+			v = "XXX"
+		}
+		r.Options[k] = v
+	}
+	if l.Wrapped != nil {
+		w := l.Wrapped.redact()
+		r.Wrapped = &w
+	}
+	return r
+}
+
+// isSensitive reports whether the option name of backend typ holds a
+// credential. All options of unknown backends are treated as sensitive.
+func isSensitive(typ, name string) bool {
+	info, err := fs.Find(typ)
+	if err != nil {
+		return true
+	}
+	opt := info.Options.Get(name)
+	return opt != nil && (opt.Sensitive || opt.IsPassword)
+}
+
+// minSecretLen is the length below which scrub leaves sensitive values,
+// such as a short user name, alone rather than mangle the message.
+const minSecretLen = 4
+
+// scrub replaces the values of the sensitive options of locs in s, the
+// output of a failed RPC, by XXX: rclone echoes the request, including the
+// "fs" strings, in its errors. Values are matched as given, as encoded in
+// the "fs" string at each level of nesting and as escaped in JSON.
+func scrub(s string, locs ...Location) string {
+	var secrets []string
+	for _, l := range locs {
+		for w, depth := &l, 1; w != nil; w, depth = w.Wrapped, depth+1 {
+			for k, v := range w.Options {
+				if len(v) < minSecretLen || !isSensitive(w.Type, k) {
+					continue
+				}
+				for range depth + 1 {
+					secrets = append(secrets, v)
+					if b, err := json.Marshal(v); err == nil {
+						secrets = append(secrets, string(b[1:len(b)-1]))
+					}
+					v = strings.ReplaceAll(v, "'", "''")
+				}
+			}
+		}
+	}
+	// Longest first, so that a value is not partly replaced by a shorter
+	// one it contains.
+	slices.SortFunc(secrets, func(a, b string) int { return len(b) - len(a) })
+	for _, v := range secrets {
+		s = strings.ReplaceAll(s, v, "XXX")
+	}
+	return s
+}
+
+// Endpoint describes the server of l without credentials: the S3 endpoint,
+// sftp://user@host:port, ":<type>:" for other remote backends and "" for
+// the local filesystem. A wrapping backend reports that of the location it
+// wraps.
+func (l Location) Endpoint() string {
+	if l.Wrapped != nil {
+		return l.Wrapped.Endpoint()
+	}
+	switch l.Type {
+	case "s3":
+		return l.Options["endpoint"]
+	case "local":
+		return ""
+	case "sftp":
+		host := l.Options["host"]
+		if port := l.Options["port"]; port != "" {
+			host += ":" + port
+		}
+		if user := l.Options["user"]; user != "" {
+			host = user + "@" + host
+		}
+		return "sftp://" + host
+	}
+	return ":" + l.Type + ":"
+}
+
+// Dir returns the bucket or directory of l on the underlying storage.
+func (l Location) Dir() string {
+	if l.Wrapped != nil {
+		return path.Join(l.Wrapped.Dir(), l.Root)
+	}
+	return l.Root
+}
+
+// String describes l without credentials, e.g. https://host/bucket, followed
+// by the wrapping backends such as "(crypt)".
+func (l Location) String() string {
+	s := l.Dir()
+	if ep := l.Endpoint(); ep != "" {
+		s = strings.TrimSuffix(ep, "/") + "/" + strings.TrimPrefix(s, "/")
+	}
+	for w := &l; w.Wrapped != nil; w = w.Wrapped {
+		s += " (" + w.Type + ")"
+	}
+	return s
+}
+
+// CheckBackend returns an error when vmbr is not built with the rclone
+// backend typ.
+func CheckBackend(typ string) error {
+	if _, err := fs.Find(typ); err != nil {
+		return fmt.Errorf("unsupported storage type %q: %w", typ, err)
+	}
+	return nil
+}
+
+// Location returns the S3 bucket of cfg as a Location.
+func (cfg S3Config) Location() Location {
+	provider := cfg.Provider
+	if provider == "" {
+		provider = "Other"
+	}
+	opts := map[string]string{
+		"provider":          provider,
+		"endpoint":          cfg.Endpoint,
+		"access_key_id":     cfg.AccessKey,
+		"secret_access_key": cfg.SecretKey,
+		"env_auth":          "false",
+	}
+	if cfg.Region != "" {
+		opts["region"] = cfg.Region
+	}
+	if cfg.ForcePathStyle != nil {
+		opts["force_path_style"] = strconv.FormatBool(*cfg.ForcePathStyle)
+	}
+	if cfg.NoCheckBucket {
+		opts["no_check_bucket"] = "true"
+	}
+	if cfg.StorageClass != "" {
+		opts["storage_class"] = cfg.StorageClass
+	}
+	return Location{Type: "s3", Options: opts, Root: cfg.Bucket, CACert: cfg.CACert}
+}
+
+// LocalLocation returns the directory dir of the local filesystem, such as an
+// NFS mount, as a Location.
+func LocalLocation(dir string) Location {
+	return Location{Type: "local", Root: dir}
+}
+
+// SFTPConfig holds the connection settings of an SFTP server. Authentication
+// uses Pass or the private key in KeyFile, falling back to the SSH agent.
+type SFTPConfig struct {
+	Host    string
+	Port    int
+	User    string
+	Pass    string
+	KeyFile string
+	// Path is the directory holding the objects, relative to the home
+	// directory of User unless absolute.
+	Path string
+}
+
+// Location returns the directory of cfg as a Location. The password is
+// obscured as rclone expects.
+func (cfg SFTPConfig) Location() (Location, error) {
+	opts := map[string]string{"host": cfg.Host}
+	if cfg.Port > 0 {
+		opts["port"] = strconv.Itoa(cfg.Port)
+	}
+	if cfg.User != "" {
+		opts["user"] = cfg.User
+	}
+	if cfg.Pass != "" {
+		pass, err := obscure.Obscure(cfg.Pass)
+		if err != nil {
+			return Location{}, fmt.Errorf("failed to obscure SFTP password: %w", err)
+		}
+		opts["pass"] = pass
+	}
+	if cfg.KeyFile != "" {
+		opts["key_file"] = cfg.KeyFile
+	}
+	return Location{Type: "sftp", Options: opts, Root: cfg.Path}, nil
+}
+
+// Filename encryption modes of the crypt backend.
+const (
+	FilenamesOff       = "off"
+	FilenamesStandard  = "standard"
+	FilenamesObfuscate = "obfuscate"
+)
+
+// CryptConfig holds the keys of rclone's crypt backend. Salt is optional but
+// recommended; both are needed to read the objects back.
+type CryptConfig struct {
+	Password string
+	Salt     string
+	// Filenames is FilenamesOff (default), which keeps object names and adds
+	// a ".bin" suffix, FilenamesStandard, which encrypts them, or
+	// FilenamesObfuscate, which only scrambles them.
+	Filenames string
+}
+
+// Encrypt returns a Location storing the objects of l encrypted with the
+// crypt backend. Objects are encrypted when written and decrypted when read
+// through it, so copying from it to an unencrypted location decrypts them.
+// Crypt reports no hashes, so copies are compared by size unless checksums
+// are computed by reading the objects.
+func (l Location) Encrypt(cfg CryptConfig) (Location, error) {
+	if cfg.Password == "" {
+		return Location{}, errors.New("crypt password is empty")
+	}
+	filenames := cfg.Filenames
+	if filenames == "" {
+		filenames = FilenamesOff
+	}
+	switch filenames {
+	case FilenamesOff, FilenamesStandard, FilenamesObfuscate:
+	default:
+		return Location{}, fmt.Errorf("invalid filename encryption %q (want %s, %s or %s)", filenames, FilenamesOff, FilenamesStandard, FilenamesObfuscate)
+	}
+	opts := map[string]string{"filename_encryption": filenames}
+	var err error
+	if opts["password"], err = obscure.Obscure(cfg.Password); err != nil {
+		return Location{}, fmt.Errorf("failed to obscure crypt password: %w", err)
+	}
+	if cfg.Salt != "" {
+		if opts["password2"], err = obscure.Obscure(cfg.Salt); err != nil {
+			return Location{}, fmt.Errorf("failed to obscure crypt salt: %w", err)
+		}
+	}
+	return Location{Type: "crypt", Options: opts, Wrapped: &l}, nil
+}
+
+// DefaultCompressLevel selects the default gzip level of Compress.
+const DefaultCompressLevel = -1
+
+// Compress returns a Location storing the objects of l gzip-compressed with
+// the compress backend, at level -2 (Huffman only) to 9. Each object is
+// stored as <name>.<size>.gz, or <name>.bin when it does not compress, next
+// to a <name>.json metadata object recording the compression and the MD5 of
+// the uncompressed data, and is decompressed when read through it.
+func (l Location) Compress(level int) Location {
+	return Location{
+		Type:    "compress",
+		Options: map[string]string{"mode": "gzip", "level": strconv.Itoa(level)},
+		Wrapped: &l,
+	}
+}
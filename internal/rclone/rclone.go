@@ -2,14 +2,27 @@ package rclone
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/rclone/rclone/backend/s3"    // import s3 backend
-	_ "github.com/rclone/rclone/fs/operations" // import operations
+	_ "github.com/rclone/rclone/backend/compress" // import compress backend for compressed locations
+	_ "github.com/rclone/rclone/backend/crypt"    // import crypt backend for encrypted locations
+	_ "github.com/rclone/rclone/backend/local"    // import local backend for local locations and small object I/O
+	_ "github.com/rclone/rclone/backend/s3"       // import s3 backend
+	_ "github.com/rclone/rclone/backend/sftp"     // import sftp backend
+	_ "github.com/rclone/rclone/backend/swift"    // import swift backend
+	_ "github.com/rclone/rclone/fs/operations"    // import operations
 	"github.com/rclone/rclone/librclone/librclone"
 )
 
@@ -17,59 +30,111 @@ import (
 // to provide deterministic responses.
 var rpc = librclone.RPC
 
-// S3Config holds the minimal credential config for an S3 backend.
+// initialize and finalize wrap the librclone lifecycle; tests may override them.
+var (
+	initialize = librclone.Initialize
+	finalize   = librclone.Finalize
+)
+
+// ErrObjectNotFound is returned when an object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// initRefs counts the outstanding Init calls so that concurrent transfers
+// share one librclone runtime.
+var (
+	initMu   sync.Mutex
+	initRefs int
+)
+
+// S3Config holds the credentials and connection options of an S3 backend.
 type S3Config struct {
 	Endpoint  string
 	AccessKey string
 	SecretKey string
 	Bucket    string
+
+	// Provider is the rclone S3 provider, such as AWS, Ceph or Minio, which
+	// selects provider-specific defaults; "Other" when empty.
+	Provider string
+	Region   string
+	// ForcePathStyle selects path-style (endpoint/bucket) rather than
+	// virtual-hosted-style (bucket.endpoint) access; nil keeps the default of
+	// the provider.
+	ForcePathStyle *bool
+	// CACert is a PEM file of CA certificates to trust, in addition to the
+	// system ones, for endpoints with a private CA.
+	CACert string
+	// NoCheckBucket skips checking that the bucket exists (and creating it),
+	// for credentials without bucket-level permissions.
+	NoCheckBucket bool
+	// StorageClass is the storage class of uploaded objects, e.g.
+	// STANDARD_IA on AWS.
+	StorageClass string
 }
 
-// Init initializes the librclone runtime.
+// Init initializes the librclone runtime. It is safe to call from several
+// goroutines; the runtime is only initialized by the first caller.
 func Init() {
-	librclone.Initialize()
+	initMu.Lock()
+	defer initMu.Unlock()
+	if initRefs == 0 {
+		initialize()
+	}
+	initRefs++
 }
 
-// Close finalizes the librclone runtime.
+// Close finalizes the librclone runtime once every Init has been matched by
+// a Close.
 func Close() {
-	librclone.Finalize()
+	initMu.Lock()
+	defer initMu.Unlock()
+	if initRefs == 0 {
+		return
+	}
+	initRefs--
+	if initRefs == 0 {
+		finalize()
+	}
 }
 
-// BuildS3Fs builds an rclone "fs" configuration string for the s3 backend.
-// Example:
+// BuildS3Fs builds an rclone "fs" configuration string for the s3 backend,
+// without the bucket. Values are quoted as needed, see Location.Backend; the
+// string holds the credentials, so log Location.Redacted instead. Example:
 //
-//	:s3,provider=Other,endpoint='https://host',access_key_id=abc,secret_access_key=xyz,env_auth=false
+//	:s3,access_key_id=abc,endpoint='https://host',env_auth=false,provider=Other,secret_access_key=xyz
 func BuildS3Fs(cfg S3Config) string {
-	// We quote the endpoint to preserve characters like ':' in the RPC encoding
-	return fmt.Sprintf(":s3,provider=Other,endpoint='%s',access_key_id=%s,secret_access_key=%s,env_auth=false", cfg.Endpoint, cfg.AccessKey, cfg.SecretKey)
+	return cfg.Location().Backend()
 }
 
 // CopyFileAsync starts a copy job via rclone's operations/copyfile RPC in async mode,
 // returns the job ID and the source size (if available, -1 when unknown).
-func CopyFileAsync(src S3Config, srcRemote string, dst S3Config, dstRemote string) (int64, int64, error) {
+// src and dst may be on different backends.
+func CopyFileAsync(src Location, srcRemote string, dst Location, dstRemote string) (int64, int64, error) {
 	// Attempt to query remote size up-front so callers can show progress as a percentage.
 	totalSize, _ := GetRemoteSize(src, srcRemote)
-	srcFs := BuildS3Fs(src) + ":" + src.Bucket
-	dstFs := BuildS3Fs(dst) + ":" + dst.Bucket
+	srcFs := src.Fs()
+	dstFs := dst.Fs()
 
 	req := struct {
-		SrcFs     string `json:"srcFs"`
-		SrcRemote string `json:"srcRemote"`
-		DstFs     string `json:"dstFs"`
-		DstRemote string `json:"dstRemote"`
-		Async     bool   `json:"_async"`
+		SrcFs     string     `json:"srcFs"`
+		SrcRemote string     `json:"srcRemote"`
+		DstFs     string     `json:"dstFs"`
+		DstRemote string     `json:"dstRemote"`
+		Async     bool       `json:"_async"`
+		Config    *rpcConfig `json:"_config,omitempty"`
 	}{
 		SrcFs:     srcFs,
 		SrcRemote: srcRemote,
 		DstFs:     dstFs,
 		DstRemote: dstRemote,
 		Async:     true,
+		Config:    configFor(src, dst),
 	}
 
 	b, _ := json.Marshal(req)
 	out, status := rpc("operations/copyfile", string(b))
 	if status != 200 {
-		return 0, -1, fmt.Errorf("RPC call failed (status %d): %s", status, out)
+		return 0, -1, fmt.Errorf("RPC call failed (status %d): %s", status, scrub(out, src, dst))
 	}
 
 	var resp struct {
@@ -83,15 +148,16 @@ func CopyFileAsync(src S3Config, srcRemote string, dst S3Config, dstRemote strin
 
 // GetRemoteSize returns the size of a remote object (if available) using operations/stat.
 // Returns -1 when size can't be determined or an error occurs.
-func GetRemoteSize(src S3Config, remote string) (int64, error) {
+func GetRemoteSize(src Location, remote string) (int64, error) {
 	req := struct {
-		Fs     string `json:"fs"`
-		Remote string `json:"remote"`
-	}{Fs: BuildS3Fs(src) + ":" + src.Bucket, Remote: remote}
+		Fs     string     `json:"fs"`
+		Remote string     `json:"remote"`
+		Config *rpcConfig `json:"_config,omitempty"`
+	}{Fs: src.Fs(), Remote: remote, Config: configFor(src)}
 	b, _ := json.Marshal(req)
 	out, status := rpc("operations/stat", string(b))
 	if status != 200 {
-		return -1, fmt.Errorf("operations/stat failed (status %d): %s", status, out)
+		return -1, fmt.Errorf("operations/stat failed (status %d): %s", status, scrub(out, src))
 	}
 	var parsed map[string]interface{}
 	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
@@ -114,12 +180,19 @@ func GetRemoteSize(src S3Config, remote string) (int64, error) {
 
 // WaitJob polls rclone job status until it finishes. Poll interval is configurable.
 // If totalSize > 0, progress will be printed as percentage complete instead of raw bytes.
-// It returns (success, durationSeconds, error)
-func WaitJob(jobID int64, totalSize int64, pollInterval time.Duration, showProgress bool) (bool, float64, error) {
+// It returns (success, durationSeconds, error). The credentials of locs, the
+// locations the job copies between, are scrubbed from its errors: the job
+// creates their backends and the errors of wrapping ones quote the "fs"
+// string of the location they wrap.
+func WaitJob(jobID int64, totalSize int64, pollInterval time.Duration, showProgress bool, locs ...Location) (bool, float64, error) {
 	statusReq := struct {
 		JobId int64 `json:"jobid"`
 	}{JobId: jobID}
 	statusReqBytes, _ := json.Marshal(statusReq)
+	statsReq := struct {
+		Group string `json:"group"`
+	}{Group: fmt.Sprintf("job/%d", jobID)}
+	statsReqBytes, _ := json.Marshal(statsReq)
 
 	for {
 		time.Sleep(pollInterval)
@@ -127,7 +200,7 @@ func WaitJob(jobID int64, totalSize int64, pollInterval time.Duration, showProgr
 		out, status := rpc("job/status", string(statusReqBytes))
 		if status != 200 {
 			// Keep polling on transient errors
-			log.Printf("warning: job/status returned status %d: %s", status, out)
+			log.Printf("warning: job/status returned status %d: %s", status, scrub(out, locs...))
 			continue
 		}
 
@@ -146,11 +219,13 @@ func WaitJob(jobID int64, totalSize int64, pollInterval time.Duration, showProgr
 			if jobStatus.Success {
 				return true, jobStatus.Duration, nil
 			}
-			return false, jobStatus.Duration, fmt.Errorf("job failed: %s", jobStatus.Error)
+			return false, jobStatus.Duration, fmt.Errorf("job failed: %s", scrub(jobStatus.Error, locs...))
 		}
 
 		if showProgress {
-			statsOut, statsStatus := rpc("core/stats", "{}")
+			// Async jobs account their transfers in the "job/<id>" stats
+			// group, so progress stays per-job when several copies run at once.
+			statsOut, statsStatus := rpc("core/stats", string(statsReqBytes))
 			if statsStatus == 200 {
 				var stats struct {
 					Bytes int64   `json:"bytes"`
@@ -162,9 +237,9 @@ func WaitJob(jobID int64, totalSize int64, pollInterval time.Duration, showProgr
 						if pct > 100.0 {
 							pct = 100.0
 						}
-						log.Printf("copy progress: %.1f%% complete, Speed: %.2f MB/s", pct, stats.Speed/1024/1024)
+						log.Printf("copy job %d progress: %.1f%% complete, Speed: %.2f MB/s", jobID, pct, stats.Speed/1024/1024)
 					} else {
-						log.Printf("copy progress: speed=%.2f MB/s", stats.Speed/1024/1024)
+						log.Printf("copy job %d progress: speed=%.2f MB/s", jobID, stats.Speed/1024/1024)
 					}
 				}
 			}
@@ -173,14 +248,15 @@ func WaitJob(jobID int64, totalSize int64, pollInterval time.Duration, showProgr
 }
 
 // ObjectExists checks whether an object at the given remote path exists
-// in the specified S3 configuration. It returns true when the object
+// in loc. It returns true when the object
 // is present, false when it is not present, or an error if an RPC
 // failure occurs that doesn't clearly indicate absence.
-func ObjectExists(cfg S3Config, remote string) (bool, error) {
+func ObjectExists(loc Location, remote string) (bool, error) {
 	req := struct {
-		Fs     string `json:"fs"`
-		Remote string `json:"remote"`
-	}{Fs: BuildS3Fs(cfg) + ":" + cfg.Bucket, Remote: remote}
+		Fs     string     `json:"fs"`
+		Remote string     `json:"remote"`
+		Config *rpcConfig `json:"_config,omitempty"`
+	}{Fs: loc.Fs(), Remote: remote, Config: configFor(loc)}
 	b, _ := json.Marshal(req)
 	out, status := rpc("operations/stat", string(b))
 	if status == 200 {
@@ -196,10 +272,339 @@ func ObjectExists(cfg S3Config, remote string) (bool, error) {
 	}
 
 	// If the RPC indicates not found, treat as non-existent rather than fatal.
-	low := strings.ToLower(out)
-	if strings.Contains(low, "not found") || strings.Contains(low, "no such file") || strings.Contains(low, "does not exist") {
+	if isNotFound(out) {
 		return false, nil
 	}
 
-	return false, fmt.Errorf("operations/stat failed (status %d): %s", status, out)
+	return false, fmt.Errorf("operations/stat failed (status %d): %s", status, scrub(out, loc))
+}
+
+// WaitForObject polls ObjectExists until the object at remote appears or the
+// timeout elapses. It returns an error on timeout or when the existence check
+// itself fails.
+func WaitForObject(loc Location, remote string, timeout, pollInterval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		exists, err := ObjectExists(loc, remote)
+		if err != nil {
+			return fmt.Errorf("failed to check object existence: %w", err)
+		}
+		if exists {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for object to appear: %s", remote)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Object is an entry returned by ListObjects or Stat. Hashes, keyed by
+// rclone hash type such as "md5", is only filled by Stat.
+type Object struct {
+	Path    string
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Hashes  map[string]string
+}
+
+// ListObjects lists the objects (not directories) directly under dir in
+// loc. An empty dir lists its root.
+func ListObjects(loc Location, dir string) ([]Object, error) {
+	req := struct {
+		Fs     string          `json:"fs"`
+		Remote string          `json:"remote"`
+		Opt    map[string]bool `json:"opt"`
+		Config *rpcConfig      `json:"_config,omitempty"`
+	}{Fs: loc.Fs(), Remote: dir, Opt: map[string]bool{"filesOnly": true}, Config: configFor(loc)}
+	b, _ := json.Marshal(req)
+	out, status := rpc("operations/list", string(b))
+	if status != 200 {
+		return nil, fmt.Errorf("operations/list failed (status %d): %s", status, scrub(out, loc))
+	}
+	var parsed struct {
+		List []struct {
+			Path    string
+			Name    string
+			Size    int64
+			ModTime time.Time
+			IsDir   bool
+		} `json:"list"`
+	}
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse operations/list response: %w", err)
+	}
+	objects := make([]Object, 0, len(parsed.List))
+	for _, it := range parsed.List {
+		if it.IsDir {
+			continue
+		}
+		objects = append(objects, Object{Path: it.Path, Name: it.Name, Size: it.Size, ModTime: it.ModTime})
+	}
+	return objects, nil
+}
+
+// compressedData matches the data objects written by the compress backend:
+// <name>.<size>.gz with the size in 11 base64 characters, or <name>.bin.
+var compressedData = regexp.MustCompile(`^(.+?)(\.[A-Za-z0-9_-]{11}\.gz|\.bin)$`)
+
+// IsCompressed reports whether the objects directly under dir in loc were
+// written through Compress, that is whether a data object of the compress
+// backend sits next to its <name>.json metadata object.
+func IsCompressed(loc Location, dir string) (bool, error) {
+	objects, err := ListObjects(loc, dir)
+	if err != nil {
+		return false, err
+	}
+	names := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		names[o.Name] = true
+	}
+	for _, o := range objects {
+		if m := compressedData.FindStringSubmatch(o.Name); m != nil && names[m[1]+".json"] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteObject deletes the object at remote in loc.
+func DeleteObject(loc Location, remote string) error {
+	req := struct {
+		Fs     string     `json:"fs"`
+		Remote string     `json:"remote"`
+		Config *rpcConfig `json:"_config,omitempty"`
+	}{Fs: loc.Fs(), Remote: remote, Config: configFor(loc)}
+	b, _ := json.Marshal(req)
+	out, status := rpc("operations/deletefile", string(b))
+	if status != 200 {
+		return fmt.Errorf("operations/deletefile failed (status %d): %s", status, scrub(out, loc))
+	}
+	return nil
+}
+
+// Stat returns the object at remote in loc with the hashes the
+// backend provides for it. It returns an error wrapping ErrObjectNotFound
+// when the object does not exist.
+func Stat(loc Location, remote string) (Object, error) {
+	req := struct {
+		Fs     string          `json:"fs"`
+		Remote string          `json:"remote"`
+		Opt    map[string]bool `json:"opt"`
+		Config *rpcConfig      `json:"_config,omitempty"`
+	}{Fs: loc.Fs(), Remote: remote, Opt: map[string]bool{"showHash": true}, Config: configFor(loc)}
+	b, _ := json.Marshal(req)
+	out, status := rpc("operations/stat", string(b))
+	if status != 200 {
+		if isNotFound(out) {
+			return Object{}, fmt.Errorf("%s: %w", remote, ErrObjectNotFound)
+		}
+		return Object{}, fmt.Errorf("operations/stat failed (status %d): %s", status, scrub(out, loc))
+	}
+	var parsed struct {
+		Item *struct {
+			Path    string
+			Name    string
+			Size    int64
+			ModTime time.Time
+			Hashes  map[string]string
+		} `json:"item"`
+	}
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		return Object{}, fmt.Errorf("failed to parse operations/stat response: %w", err)
+	}
+	if parsed.Item == nil {
+		return Object{}, fmt.Errorf("%s: %w", remote, ErrObjectNotFound)
+	}
+	it := parsed.Item
+	return Object{Path: it.Path, Name: it.Name, Size: it.Size, ModTime: it.ModTime, Hashes: it.Hashes}, nil
+}
+
+// Hashsum computes the hash of type hashType ("md5", "sha1", ...) of the
+// object at remote in loc. With download set the object is read
+// and hashed locally, for backends that do not store the hash; otherwise an
+// empty string is returned when the backend has none.
+func Hashsum(loc Location, remote, hashType string, download bool) (string, error) {
+	req := struct {
+		Fs       string     `json:"fs"`
+		HashType string     `json:"hashType"`
+		Download bool       `json:"download"`
+		Config   *rpcConfig `json:"_config,omitempty"`
+	}{Fs: loc.fsAt(remote), HashType: hashType, Download: download, Config: configFor(loc)}
+	b, _ := json.Marshal(req)
+	out, status := rpc("operations/hashsum", string(b))
+	if status != 200 {
+		if isNotFound(out) {
+			return "", fmt.Errorf("%s: %w", remote, ErrObjectNotFound)
+		}
+		return "", fmt.Errorf("operations/hashsum failed (status %d): %s", status, scrub(out, loc))
+	}
+	var parsed struct {
+		Hashsum []string `json:"hashsum"`
+	}
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse operations/hashsum response: %w", err)
+	}
+	// Each line is "<hash>  <name>", as written by md5sum.
+	for _, line := range parsed.Hashsum {
+		sum, name, ok := strings.Cut(line, "  ")
+		if ok && name == path.Base(remote) {
+			return strings.TrimSpace(sum), nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", remote, ErrObjectNotFound)
+}
+
+// ErrMismatch is returned by Verify when a copy differs from its source.
+var ErrMismatch = errors.New("copy does not match its source")
+
+// Verify checks that the object at dstRemote in dst is an exact copy of the
+// one at srcRemote in src: their sizes and every hash type both backends
+// report must match. When they share none and download is set, the MD5 of
+// both is computed by reading them. It returns the hash types compared (none
+// when only the size was) and an error wrapping ErrMismatch on a difference.
+func Verify(src Location, srcRemote string, dst Location, dstRemote string, download bool) ([]string, error) {
+	srcObj, err := Stat(src, srcRemote)
+	if err != nil {
+		return nil, err
+	}
+	dstObj, err := Stat(dst, dstRemote)
+	if err != nil {
+		return nil, err
+	}
+	if srcObj.Size != dstObj.Size {
+		return nil, fmt.Errorf("%s: size %d, source %s has %d: %w", dstRemote, dstObj.Size, srcRemote, srcObj.Size, ErrMismatch)
+	}
+
+	var compared []string
+	for _, typ := range slices.Sorted(maps.Keys(srcObj.Hashes)) {
+		want := srcObj.Hashes[typ]
+		got, ok := dstObj.Hashes[typ]
+		if !ok {
+			continue
+		}
+		if !strings.EqualFold(want, got) {
+			return compared, fmt.Errorf("%s: %s %s, source %s has %s: %w", dstRemote, typ, got, srcRemote, want, ErrMismatch)
+		}
+		compared = append(compared, typ)
+	}
+	if len(compared) > 0 || !download {
+		return compared, nil
+	}
+
+	want, err := Hashsum(src, srcRemote, "md5", true)
+	if err != nil {
+		return nil, err
+	}
+	got, err := Hashsum(dst, dstRemote, "md5", true)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(want, got) {
+		return nil, fmt.Errorf("%s: md5 %s, source %s has %s: %w", dstRemote, got, srcRemote, want, ErrMismatch)
+	}
+	return []string{"md5"}, nil
+}
+
+// CopyObject copies the object at srcRemote in src to dstRemote in dst and
+// waits for the copy. It is meant for small objects; large images are copied
+// with CopyFileAsync.
+func CopyObject(src Location, srcRemote string, dst Location, dstRemote string) error {
+	out, status := copyFile(src.Fs(), srcRemote, dst.Fs(), dstRemote, configFor(src, dst))
+	if status != 200 {
+		if isNotFound(out) {
+			return fmt.Errorf("%s: %w", srcRemote, ErrObjectNotFound)
+		}
+		return fmt.Errorf("operations/copyfile failed (status %d): %s", status, scrub(out, src, dst))
+	}
+	return nil
+}
+
+// rpcConfig overrides global rclone options for a single RPC through its
+// _config parameter, for settings that are not backend options.
+type rpcConfig struct {
+	CaCert []string `json:",omitempty"`
+}
+
+// configFor returns the global options the locations need, or nil when they
+// need none.
+func configFor(locs ...Location) *rpcConfig {
+	var certs []string
+	for _, l := range locs {
+		for w := &l; w != nil; w = w.Wrapped {
+			if w.CACert != "" && !slices.Contains(certs, w.CACert) {
+				certs = append(certs, w.CACert)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+	return &rpcConfig{CaCert: certs}
+}
+
+// isNotFound reports whether an RPC error message says the object is missing.
+func isNotFound(out string) bool {
+	low := strings.ToLower(out)
+	return strings.Contains(low, "not found") || strings.Contains(low, "no such file") || strings.Contains(low, "does not exist")
+}
+
+// copyFile runs a synchronous operations/copyfile RPC.
+func copyFile(srcFs, srcRemote, dstFs, dstRemote string, cfg *rpcConfig) (string, int) {
+	req := struct {
+		SrcFs     string     `json:"srcFs"`
+		SrcRemote string     `json:"srcRemote"`
+		DstFs     string     `json:"dstFs"`
+		DstRemote string     `json:"dstRemote"`
+		Config    *rpcConfig `json:"_config,omitempty"`
+	}{SrcFs: srcFs, SrcRemote: srcRemote, DstFs: dstFs, DstRemote: dstRemote, Config: cfg}
+	b, _ := json.Marshal(req)
+	return rpc("operations/copyfile", string(b))
+}
+
+// PutObject writes data to remote in loc. It is meant for
+// small objects such as manifests, which are staged in a local temporary
+// directory and copied with rclone.
+func PutObject(loc Location, remote string, data []byte) error {
+	dir, err := os.MkdirTemp("", "vmbr-put-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Base(remote)
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", remote, err)
+	}
+	out, status := copyFile(dir, name, loc.Fs(), remote, configFor(loc))
+	if status != 200 {
+		return fmt.Errorf("operations/copyfile failed (status %d): %s", status, scrub(out, loc))
+	}
+	return nil
+}
+
+// GetObject reads the object at remote in loc through a local
+// temporary directory. It returns an error wrapping ErrObjectNotFound when
+// the object does not exist.
+func GetObject(loc Location, remote string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "vmbr-get-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const name = "object"
+	out, status := copyFile(loc.Fs(), remote, dir, name, configFor(loc))
+	if status != 200 {
+		if isNotFound(out) {
+			return nil, fmt.Errorf("%s: %w", remote, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("operations/copyfile failed (status %d): %s", status, scrub(out, loc))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", remote, err)
+	}
+	return data, nil
 }
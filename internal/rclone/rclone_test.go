@@ -1,6 +1,16 @@
 package rclone
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fspath"
+)
 
 func TestBuildS3Fs(t *testing.T) {
 	cfg := S3Config{Endpoint: "s3.example.local:9000", AccessKey: "AKIA", SecretKey: "SECRET"}
@@ -22,6 +32,351 @@ func TestBuildS3Fs(t *testing.T) {
 	}
 }
 
+func TestLocation(t *testing.T) {
+	s3 := S3Config{Endpoint: "https://s3.example.com", AccessKey: "AKIA", SecretKey: "SECRET", Bucket: "archive"}.Location()
+	if got := s3.Fs(); got != ":s3,access_key_id=AKIA,endpoint='https://s3.example.com',env_auth=false,provider=Other,secret_access_key=SECRET:archive" {
+		t.Fatalf("unexpected s3 fs: %s", got)
+	}
+	if got := s3.String(); got != "https://s3.example.com/archive" {
+		t.Fatalf("unexpected s3 description: %s", got)
+	}
+
+	local := LocalLocation("/mnt/nfs/backups")
+	if got := local.Fs(); got != ":local:/mnt/nfs/backups" {
+		t.Fatalf("unexpected local fs: %s", got)
+	}
+	if got := local.fsAt("web-01.img"); got != ":local:/mnt/nfs/backups/web-01.img" {
+		t.Fatalf("unexpected local object fs: %s", got)
+	}
+	if local.Endpoint() != "" || local.String() != "/mnt/nfs/backups" {
+		t.Fatalf("unexpected local description: %q %q", local.Endpoint(), local.String())
+	}
+
+	sftp, err := SFTPConfig{Host: "backup.example.com", Port: 2222, User: "vmbr", Pass: "p@ss", KeyFile: "/keys/id", Path: "images"}.Location()
+	if err != nil {
+		t.Fatalf("SFTPConfig.Location failed: %v", err)
+	}
+	if sftp.Options["pass"] == "" || sftp.Options["pass"] == "p@ss" {
+		t.Fatalf("expected an obscured password, got %q", sftp.Options["pass"])
+	}
+	if pass, err := obscure.Reveal(sftp.Options["pass"]); err != nil || pass != "p@ss" {
+		t.Fatalf("password does not reveal: %q, %v", pass, err)
+	}
+	if got := sftp.Fs(); !contains(got, ":sftp,host=backup.example.com,key_file=/keys/id,pass=") || !contains(got, ",port=2222,user=vmbr:images") {
+		t.Fatalf("unexpected sftp fs: %s", got)
+	}
+	if got := sftp.String(); got != "sftp://vmbr@backup.example.com:2222/images" {
+		t.Fatalf("unexpected sftp description: %s", got)
+	}
+
+	for _, typ := range []string{"s3", "local", "sftp", "swift"} {
+		if err := CheckBackend(typ); err != nil {
+			t.Fatalf("expected backend %s to be built in: %v", typ, err)
+		}
+	}
+	if err := CheckBackend("nosuchbackend"); err == nil {
+		t.Fatalf("expected an error for an unknown backend")
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	s3 := S3Config{Endpoint: "https://s3.example.com", AccessKey: "AKIA", SecretKey: "SECRET", Bucket: "archive"}.Location()
+	loc, err := s3.Encrypt(CryptConfig{Password: "pw", Salt: "salt"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if loc.Options["filename_encryption"] != FilenamesOff {
+		t.Fatalf("expected filenames kept by default, got %+v", loc.Options)
+	}
+	for key, want := range map[string]string{"password": "pw", "password2": "salt"} {
+		if got, err := obscure.Reveal(loc.Options[key]); err != nil || got != want {
+			t.Fatalf("%s does not reveal: %q, %v", key, got, err)
+		}
+	}
+	// The wrapped location is quoted, with its own quotes doubled.
+	fs := loc.Fs()
+	if !contains(fs, ":crypt,") || !contains(fs, ",remote=':s3,access_key_id=AKIA,endpoint=''https://s3.example.com'',") || !contains(fs, ":archive':") {
+		t.Fatalf("unexpected crypt fs: %s", fs)
+	}
+	if got := loc.fsAt("web-01.img"); got != fs+"web-01.img" {
+		t.Fatalf("unexpected crypt object fs: %s", got)
+	}
+	if loc.Endpoint() != "https://s3.example.com" || loc.Dir() != "archive" || loc.String() != "https://s3.example.com/archive (crypt)" {
+		t.Fatalf("unexpected crypt description: %q %q %q", loc.Endpoint(), loc.Dir(), loc.String())
+	}
+
+	if _, err := s3.Encrypt(CryptConfig{}); err == nil {
+		t.Fatalf("expected an error without password")
+	}
+	if _, err := s3.Encrypt(CryptConfig{Password: "pw", Filenames: "scramble"}); err == nil {
+		t.Fatalf("expected an error for an invalid filename encryption")
+	}
+	if loc, err := s3.Encrypt(CryptConfig{Password: "pw", Filenames: FilenamesStandard}); err != nil || loc.Options["filename_encryption"] != "standard" || loc.Options["password2"] != "" {
+		t.Fatalf("unexpected crypt location %+v, %v", loc, err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	loc := LocalLocation("/mnt/nfs").Compress(DefaultCompressLevel)
+	if got := loc.Fs(); got != ":compress,level=-1,mode=gzip,remote=':local:/mnt/nfs':" {
+		t.Fatalf("unexpected compress fs: %s", got)
+	}
+	if loc.String() != "/mnt/nfs (compress)" {
+		t.Fatalf("unexpected compress description: %s", loc.String())
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	var list string
+	rpc = func(ep, body string) (string, int) {
+		if ep != "operations/list" {
+			return "", 500
+		}
+		return `{"list":[` + list + `]}`, 200
+	}
+	cases := []struct {
+		list string
+		want bool
+	}{
+		{`{"Path":"backup.img","Name":"backup.img"},{"Path":"backup.img.manifest.json","Name":"backup.img.manifest.json"}`, false},
+		{`{"Path":"backup.img.AADAAAAAAAA.gz","Name":"backup.img.AADAAAAAAAA.gz"},{"Path":"backup.img.json","Name":"backup.img.json"}`, true},
+		{`{"Path":"backup.img.bin","Name":"backup.img.bin"},{"Path":"backup.img.json","Name":"backup.img.json"}`, true},
+		{`{"Path":"backup.img.bin","Name":"backup.img.bin"}`, false},
+		{``, false},
+	}
+	for _, c := range cases {
+		list = c.list
+		got, err := IsCompressed(LocalLocation("/mnt/nfs"), "")
+		if err != nil || got != c.want {
+			t.Fatalf("IsCompressed(%s) = %v, %v; want %v", c.list, got, err, c.want)
+		}
+	}
+}
+
+func TestCopyFileAsync_Backends(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	src, err := SFTPConfig{Host: "backup.example.com", User: "vmbr", Path: "images"}.Location()
+	if err != nil {
+		t.Fatalf("SFTPConfig.Location failed: %v", err)
+	}
+	dst := LocalLocation("/mnt/nfs")
+	var req struct {
+		SrcFs, SrcRemote, DstFs, DstRemote string
+		Async                              bool `json:"_async"`
+	}
+	rpc = func(ep, body string) (string, int) {
+		switch ep {
+		case "operations/stat":
+			return `{"item":{"Size":42}}`, 200
+		case "operations/copyfile":
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				return err.Error(), 400
+			}
+			return `{"jobid":7}`, 200
+		}
+		return "", 500
+	}
+
+	jobID, size, err := CopyFileAsync(src, "web-01.img", dst, "web-01.img")
+	if err != nil || jobID != 7 || size != 42 {
+		t.Fatalf("CopyFileAsync = %d, %d, %v", jobID, size, err)
+	}
+	if req.SrcFs != ":sftp,host=backup.example.com,user=vmbr:images" || req.DstFs != ":local:/mnt/nfs" || !req.Async {
+		t.Fatalf("unexpected copy request: %+v", req)
+	}
+}
+
+func TestS3Options(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	pathStyle := false
+	loc := S3Config{
+		Endpoint: "https://s3.amazonaws.com", AccessKey: "AKIA", SecretKey: "SECRET", Bucket: "archive",
+		Provider: "AWS", Region: "ap-northeast-1", ForcePathStyle: &pathStyle,
+		CACert: "/etc/vmbr/ca.pem", NoCheckBucket: true, StorageClass: "STANDARD_IA",
+	}.Location()
+	for _, opt := range []string{"provider=AWS", "region=ap-northeast-1", "force_path_style=false", "no_check_bucket=true", "storage_class=STANDARD_IA"} {
+		if !contains(loc.Fs(), ","+opt) {
+			t.Fatalf("expected %s in fs, got %s", opt, loc.Fs())
+		}
+	}
+	if def := (S3Config{Endpoint: "https://s3.example.com"}).Location(); contains(def.Fs(), "force_path_style") || contains(def.Fs(), "region") {
+		t.Fatalf("expected provider defaults to be kept, got %s", def.Fs())
+	}
+
+	var bodies []string
+	rpc = func(ep, body string) (string, int) {
+		bodies = append(bodies, body)
+		return `{"item":{"Size":1}}`, 200
+	}
+	if _, err := Stat(loc, "web-01.img"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	encrypted, err := loc.Encrypt(CryptConfig{Password: "secret"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := Stat(encrypted, "web-01.img"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if _, err := Stat(LocalLocation("/mnt/nfs"), "web-01.img"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	for i, body := range bodies[:2] {
+		if !contains(body, `"_config":{"CaCert":["/etc/vmbr/ca.pem"]}`) {
+			t.Fatalf("expected the CA certificate in request %d, got %s", i, body)
+		}
+	}
+	if contains(bodies[2], "_config") {
+		t.Fatalf("expected no config override without a CA certificate, got %s", bodies[2])
+	}
+}
+
+func TestEncodeOption(t *testing.T) {
+	cfg := S3Config{Endpoint: "https://s3.example.com", AccessKey: "AK,IA", SecretKey: "se'cr:et,provider=AWS", Bucket: "archive"}
+	parsed, err := fspath.Parse(cfg.Location().Fs())
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if parsed.Config["access_key_id"] != cfg.AccessKey || parsed.Config["secret_access_key"] != cfg.SecretKey ||
+		parsed.Config["provider"] != "Other" || parsed.Path != "archive" {
+		t.Fatalf("credentials not preserved: %+v", parsed)
+	}
+
+	for _, name := range []string{"user", "key_file", "S3_2"} {
+		if err := CheckOptionName(name); err != nil {
+			t.Fatalf("CheckOptionName(%q) failed: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "user=x", "key-file", "a,b", "a:b"} {
+		if err := CheckOptionName(name); err == nil {
+			t.Fatalf("expected an error for %q", name)
+		}
+	}
+}
+
+// FuzzEncodeOption checks that option values, also nested in the "remote"
+// option of a wrapping backend, parse back unchanged.
+func FuzzEncodeOption(f *testing.F) {
+	for _, seed := range []string{"", "plain", "a,b", "a:b", "'", "''", `"`, `'quoted'`, `"dq"`, "x=y,z", "it's:a,b", "https://h:9000"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, v string) {
+		inner := Location{Type: "s3", Options: map[string]string{"secret_access_key": v, "endpoint": v}, Root: "archive"}
+		parsed, err := fspath.Parse(inner.Fs())
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", inner.Fs(), err)
+		}
+		if parsed.Config["secret_access_key"] != v || parsed.Config["endpoint"] != v || parsed.Path != "archive" {
+			t.Fatalf("value %q not preserved by %q: %+v", v, inner.Fs(), parsed)
+		}
+
+		outer, err := inner.Encrypt(CryptConfig{Password: "secret"})
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		if parsed, err = fspath.Parse(outer.Fs()); err != nil {
+			t.Fatalf("Parse(%q) failed: %v", outer.Fs(), err)
+		}
+		if parsed.Config["remote"] != inner.Fs() {
+			t.Fatalf("remote %q, want %q", parsed.Config["remote"], inner.Fs())
+		}
+	})
+}
+
+func TestRedacted(t *testing.T) {
+	loc, err := S3Config{Endpoint: "https://s3.example.com", AccessKey: "AKIA1234", SecretKey: "s3cr3t'key", Bucket: "archive"}.Location().Encrypt(CryptConfig{Password: "secret", Salt: "salt"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	got := loc.Redacted()
+	want := ":crypt,filename_encryption=off,password=XXX,password2=XXX,remote=':s3,access_key_id=XXX,endpoint=''https://s3.example.com'',env_auth=false,provider=Other,secret_access_key=XXX:archive':"
+	if got != want {
+		t.Fatalf("Redacted() = %s, want %s", got, want)
+	}
+	if loc.Wrapped.Options["secret_access_key"] != "s3cr3t'key" {
+		t.Fatalf("Redacted modified the location")
+	}
+
+	orig := rpc
+	defer func() { rpc = orig }()
+	rpc = func(ep, body string) (string, int) {
+		return `{"error":"failed to create file system","input":` + body + `,"status":500}`, 500
+	}
+	_, err = Stat(loc, "web-01.img")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, secret := range []string{"AKIA1234", "s3cr3t", loc.Options["password"], loc.Options["password2"]} {
+		if contains(err.Error(), secret) {
+			t.Fatalf("error leaks %q: %v", secret, err)
+		}
+	}
+	if !contains(err.Error(), "https://s3.example.com") {
+		t.Fatalf("expected the endpoint in the error, got %v", err)
+	}
+}
+
+func TestWaitJob_Redacted(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	dst, err := S3Config{Endpoint: "https://s3.example.com", AccessKey: "AKIA1234", SecretKey: "s3cr3t,key", Bucket: "archive"}.Location().Encrypt(CryptConfig{Password: "secret"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	src := LocalLocation("/var/lib/vmbr")
+	// The crypt backend fails to create its wrapped fs and quotes it.
+	jobErr, _ := json.Marshal(map[string]any{
+		"finished": true,
+		"success":  false,
+		"error":    `failed to make remote "` + dst.Wrapped.Fs() + `" to wrap: bucket missing`,
+	})
+	rpc = func(ep, body string) (string, int) {
+		return string(jobErr), 200
+	}
+	ok, _, err := WaitJob(7, 0, time.Millisecond, false, src, dst)
+	if ok || err == nil {
+		t.Fatalf("expected the job to fail, got %v, %v", ok, err)
+	}
+	for _, secret := range []string{"AKIA1234", "s3cr3t", dst.Options["password"]} {
+		if contains(err.Error(), secret) {
+			t.Fatalf("error leaks %q: %v", secret, err)
+		}
+	}
+	if !contains(err.Error(), "bucket missing") {
+		t.Fatalf("expected the job error, got %v", err)
+	}
+}
+
+// FuzzScrub checks that the credentials of a location never appear in the
+// errors of its RPCs, which echo the request.
+func FuzzScrub(f *testing.F) {
+	for _, seed := range []string{"s3cr3t", "with'quote", `with"dq`, `back\\slash`, "a,b:c", "<html>&"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, secret string) {
+		if len(secret) < minSecretLen || contains(secret, "X") {
+			t.Skip()
+		}
+		loc := S3Config{Endpoint: "https://s3.example.com", SecretKey: secret, Bucket: "archive"}.Location()
+		outer, err := loc.Encrypt(CryptConfig{Password: "secret"})
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		b, _ := json.Marshal(map[string]string{"fs": outer.Fs(), "raw": secret})
+		if got := scrub(string(b), outer); contains(got, secret) {
+			t.Fatalf("scrub leaks %q: %s", secret, got)
+		}
+	})
+}
+
 // small helper to avoid importing strings in test for minimal footprint
 func contains(s, sub string) bool {
 	for i := 0; i+len(sub) <= len(s); i++ {
@@ -36,7 +391,7 @@ func TestObjectExists(t *testing.T) {
 	orig := rpc
 	defer func() { rpc = orig }()
 
-	cfg := S3Config{Endpoint: "e", AccessKey: "a", SecretKey: "s", Bucket: "b"}
+	cfg := S3Config{Endpoint: "e", AccessKey: "a", SecretKey: "s", Bucket: "b"}.Location()
 
 	// Case: object exists
 	rpc = func(ep, body string) (string, int) {
@@ -80,3 +435,241 @@ func TestObjectExists(t *testing.T) {
 		t.Fatalf("did not expect object to exist on RPC failure")
 	}
 }
+
+func TestWaitForObject(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	cfg := S3Config{Endpoint: "e", AccessKey: "a", SecretKey: "s", Bucket: "b"}.Location()
+
+	// Case: object appears on the third poll
+	calls := 0
+	rpc = func(ep, body string) (string, int) {
+		calls++
+		if calls < 3 {
+			return "object not found", 404
+		}
+		return `{"item":{"Size":1}}`, 200
+	}
+	if err := WaitForObject(cfg, "img", time.Second, time.Millisecond); err != nil {
+		t.Fatalf("expected object to appear, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 polls, got %d", calls)
+	}
+
+	// Case: object never appears
+	rpc = func(ep, body string) (string, int) {
+		return "object not found", 404
+	}
+	if err := WaitForObject(cfg, "img", 5*time.Millisecond, time.Millisecond); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+}
+
+func TestInitCloseRefCount(t *testing.T) {
+	origInit, origFinal := initialize, finalize
+	defer func() { initialize, finalize = origInit, origFinal }()
+
+	inits, finals := 0, 0
+	initialize = func() { inits++ }
+	finalize = func() { finals++ }
+
+	Init()
+	Init()
+	Close()
+	if inits != 1 || finals != 0 {
+		t.Fatalf("expected runtime to stay initialized while in use, got inits=%d finals=%d", inits, finals)
+	}
+	Close()
+	if finals != 1 {
+		t.Fatalf("expected runtime to be finalized by the last Close, got finals=%d", finals)
+	}
+	// An unmatched Close must not finalize twice.
+	Close()
+	if finals != 1 {
+		t.Fatalf("expected unmatched Close to be ignored, got finals=%d", finals)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	cfg := S3Config{Endpoint: "e", AccessKey: "a", SecretKey: "s", Bucket: "b"}.Location()
+	rpc = func(ep, body string) (string, int) {
+		if ep != "operations/list" {
+			return "", 500
+		}
+		return `{"list":[
+			{"Path":"backup-2025-11-22.img","Name":"backup-2025-11-22.img","Size":10,"ModTime":"2025-11-22T10:00:00Z","IsDir":false},
+			{"Path":"old","Name":"old","Size":-1,"ModTime":"2025-11-01T00:00:00Z","IsDir":true}
+		]}`, 200
+	}
+	objs, err := ListObjects(cfg, "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(objs) != 1 || objs[0].Path != "backup-2025-11-22.img" || objs[0].Size != 10 {
+		t.Fatalf("unexpected objects: %+v", objs)
+	}
+	if !objs[0].ModTime.Equal(time.Date(2025, 11, 22, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected ModTime: %v", objs[0].ModTime)
+	}
+
+	rpc = func(ep, body string) (string, int) { return "boom", 500 }
+	if _, err := ListObjects(cfg, ""); err == nil {
+		t.Fatalf("expected error for RPC failure")
+	}
+	if err := DeleteObject(cfg, "x"); err == nil {
+		t.Fatalf("expected error for RPC failure")
+	}
+}
+
+func TestPutAndGetObject(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	cfg := S3Config{Endpoint: "e", AccessKey: "a", SecretKey: "s", Bucket: "b"}.Location()
+	bucket := make(map[string][]byte)
+	// Emulate operations/copyfile between a local directory and the bucket.
+	rpc = func(ep, body string) (string, int) {
+		if ep != "operations/copyfile" {
+			return "", 500
+		}
+		var req struct {
+			SrcFs, SrcRemote, DstFs, DstRemote string
+		}
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			return err.Error(), 400
+		}
+		if contains(req.DstFs, ":s3,") {
+			data, err := os.ReadFile(filepath.Join(req.SrcFs, req.SrcRemote))
+			if err != nil {
+				return err.Error(), 500
+			}
+			bucket[req.DstRemote] = data
+			return "{}", 200
+		}
+		data, ok := bucket[req.SrcRemote]
+		if !ok {
+			return "object not found", 404
+		}
+		if err := os.WriteFile(filepath.Join(req.DstFs, req.DstRemote), data, 0o600); err != nil {
+			return err.Error(), 500
+		}
+		return "{}", 200
+	}
+
+	if err := PutObject(cfg, "dir/a.json", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("PutObject failed: %v", err)
+	}
+	if string(bucket["dir/a.json"]) != `{"a":1}` {
+		t.Fatalf("unexpected bucket content: %q", bucket["dir/a.json"])
+	}
+	data, err := GetObject(cfg, "dir/a.json")
+	if err != nil {
+		t.Fatalf("GetObject failed: %v", err)
+	}
+	if string(data) != `{"a":1}` {
+		t.Fatalf("unexpected object data: %q", data)
+	}
+	if _, err := GetObject(cfg, "missing.json"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	cfg := S3Config{Endpoint: "e", AccessKey: "a", SecretKey: "s", Bucket: "b"}.Location()
+	rpc = func(ep, body string) (string, int) {
+		if ep != "operations/stat" || !contains(body, `"showHash":true`) {
+			return "unexpected request", 500
+		}
+		if contains(body, `"remote":"missing.img"`) {
+			return `{"item":null}`, 200
+		}
+		return `{"item":{"Path":"backup.img","Name":"backup.img","Size":1024,"Hashes":{"md5":"abc"}}}`, 200
+	}
+
+	obj, err := Stat(cfg, "backup.img")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if obj.Size != 1024 || obj.Hashes["md5"] != "abc" {
+		t.Fatalf("unexpected object: %+v", obj)
+	}
+	if _, err := Stat(cfg, "missing.img"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	orig := rpc
+	defer func() { rpc = orig }()
+
+	src := S3Config{Endpoint: "src", AccessKey: "a", SecretKey: "s", Bucket: "cs"}.Location()
+	dst := S3Config{Endpoint: "dst", AccessKey: "a", SecretKey: "s", Bucket: "archive"}.Location()
+	// Objects by bucket as returned by operations/stat, and the MD5 computed
+	// by operations/hashsum when downloading.
+	items := map[string]string{}
+	sums := map[string]string{}
+	rpc = func(ep, body string) (string, int) {
+		var req struct {
+			Fs       string
+			Download bool
+		}
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			return err.Error(), 400
+		}
+		bucket := "cs"
+		if contains(req.Fs, ":archive") {
+			bucket = "archive"
+		}
+		switch ep {
+		case "operations/stat":
+			return `{"item":` + items[bucket] + `}`, 200
+		case "operations/hashsum":
+			if !req.Download {
+				return "expected a download", 400
+			}
+			return `{"hashType":"md5","hashsum":["` + sums[bucket] + `  backup.img"]}`, 200
+		}
+		return "", 500
+	}
+
+	items["cs"] = `{"Size":1024,"Hashes":{"md5":"abc"}}`
+	items["archive"] = `{"Size":1024,"Hashes":{"md5":"ABC"}}`
+	compared, err := Verify(src, "backup.img", dst, "backup.img", false)
+	if err != nil || len(compared) != 1 || compared[0] != "md5" {
+		t.Fatalf("expected the copy verified by md5, got %v, %v", compared, err)
+	}
+
+	items["archive"] = `{"Size":1024,"Hashes":{"md5":"abd"}}`
+	if _, err := Verify(src, "backup.img", dst, "backup.img", false); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch for a different md5, got %v", err)
+	}
+	items["archive"] = `{"Size":1000,"Hashes":{"md5":"abc"}}`
+	if _, err := Verify(src, "backup.img", dst, "backup.img", false); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch for a different size, got %v", err)
+	}
+
+	// Without a common hash only the size is compared, unless downloading.
+	items["cs"] = `{"Size":1024}`
+	items["archive"] = `{"Size":1024}`
+	compared, err = Verify(src, "backup.img", dst, "backup.img", false)
+	if err != nil || len(compared) != 0 {
+		t.Fatalf("expected a size-only check, got %v, %v", compared, err)
+	}
+	sums["cs"], sums["archive"] = "abc", "abc"
+	compared, err = Verify(src, "backup.img", dst, "backup.img", true)
+	if err != nil || len(compared) != 1 {
+		t.Fatalf("expected the copy verified by download, got %v, %v", compared, err)
+	}
+	sums["archive"] = "abd"
+	if _, err := Verify(src, "backup.img", dst, "backup.img", true); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch for a different downloaded md5, got %v", err)
+	}
+}
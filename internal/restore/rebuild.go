@@ -0,0 +1,423 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+
+	cloudsdk "github.com/Zillaforge/cloud-sdk"
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+	vps "github.com/Zillaforge/cloud-sdk/modules/vps/core"
+	vpsserversclient "github.com/Zillaforge/cloud-sdk/modules/vps/servers"
+
+	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/plan"
+	"nchc-vmbr/internal/state"
+	"nchc-vmbr/internal/util"
+)
+
+// ErrRebuildNotConfirmed is returned when a restore would rebuild an existing
+// server without the explicit confirmation.
+var ErrRebuildNotConfirmed = errors.New("rebuilding deletes the existing server and recreates it with a new ID; pass --confirm-rebuild to proceed")
+
+// rebuild replaces the server cfg.RebuildServer with one booted from the tag
+// tagID. The VPS API cannot replace the image of a server in place (its server
+// actions are limited to power, resize and password operations), so it
+// deletes the server and creates a new one from the tag with the same name,
+// flavor, keypair, NICs (fixed IPs and security groups included) and data
+// volumes, then moves the floating IPs over. The new server gets a new ID.
+// The create request is checked against the API before the server is
+// deleted, so a flavor, keypair, network or security group that no longer
+// exists fails the rebuild while the server is still there.
+//
+// The configuration of the old server is recorded in the run state before
+// anything is changed, so an interrupted rebuild, including one whose create
+// failed after the old server was deleted, can be resumed with --resume.
+func rebuild(ctx context.Context, vpsClient *vps.Client, cfg *config.Config, run *state.Run, tagID string) error {
+	key := cfg.VMName
+	progress := run.Get(key)
+
+	spec := progress.Replaced
+	if spec == nil {
+		srv, err := findServer(ctx, vpsClient.Servers(), cfg.RebuildServer)
+		if err != nil {
+			return err
+		}
+		nics, err := srv.NICs().List(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list NICs of server %s: %w", srv.ID, err)
+		}
+		vols, err := srv.Volumes().List(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list volumes of server %s: %w", srv.ID, err)
+		}
+		spec = captureServer(srv.Server, nics, vols)
+		if err := run.Update(key, func(vm *state.VM) { vm.Replaced = spec }); err != nil {
+			return err
+		}
+		log.Printf("Recorded configuration of server %s (%s) in %s", spec.Name, spec.ID, run.Path())
+	}
+
+	if !progress.Done(state.StageServerDelete) {
+		// Nothing is deleted unless the replacement can be created.
+		if err := checkCreateRequest(ctx, vpsClient, createRequest(spec, tagID)); err != nil {
+			return fmt.Errorf("server %s cannot be rebuilt, it was left untouched: %w", spec.ID, err)
+		}
+		if err := deleteServer(ctx, vpsClient, spec); err != nil {
+			return err
+		}
+		if err := run.Complete(key, state.StageServerDelete); err != nil {
+			return err
+		}
+	}
+
+	serverID := progress.ServerID
+	if progress.Done(state.StageServerCreate) {
+		log.Printf("Resuming with created server %s", serverID)
+	} else {
+		created, err := vpsClient.Servers().Create(ctx, createRequest(spec, tagID))
+		if err != nil {
+			return fmt.Errorf("failed to recreate server %s, server %s is already deleted; its configuration is recorded in %s, run again with --resume %s to recreate it: %w", spec.Name, spec.ID, run.Path(), run.ID, err)
+		}
+		serverID = created.ID
+		if err := run.Update(key, func(vm *state.VM) {
+			vm.ServerID = serverID
+			vm.MarkDone(state.StageServerCreate)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if !progress.Done(state.StageServerActive) {
+		log.Printf("Waiting for server %s to become active...", serverID)
+		if err := vps.WaitForServerActive(ctx, vpsClient.Servers(), serverID); err != nil {
+			return fmt.Errorf("server %s did not become active: %w", serverID, err)
+		}
+		if err := run.Complete(key, state.StageServerActive); err != nil {
+			return err
+		}
+	}
+
+	if !progress.Done(state.StageReattach) {
+		if err := reattach(ctx, vpsClient, spec, serverID); err != nil {
+			return err
+		}
+		if err := run.Complete(key, state.StageReattach); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Server %s rebuilt from tag %s; its ID changed from %s to %s", spec.Name, tagID, spec.ID, serverID)
+	return nil
+}
+
+// planRebuild describes the server that would replace cfg.RebuildServer.
+func planRebuild(ctx context.Context, vpsClient *vps.Client, cfg *config.Config) (*plan.Server, error) {
+	srv, err := findServer(ctx, vpsClient.Servers(), cfg.RebuildServer)
+	if err != nil {
+		return nil, err
+	}
+	nics, err := srv.NICs().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NICs of server %s: %w", srv.ID, err)
+	}
+	spec := captureServer(srv.Server, nics, nil)
+	// The tag is only known once uploaded; any image ID passes the check.
+	if err := checkCreateRequest(ctx, vpsClient, createRequest(spec, util.PlanPruneTag)); err != nil {
+		return nil, fmt.Errorf("server %s cannot be rebuilt: %w", spec.ID, err)
+	}
+	ps := &plan.Server{
+		Name:      spec.Name,
+		FlavorID:  spec.FlavorID,
+		KeypairID: spec.KeypairID,
+		Replaces:  spec.ID,
+	}
+	for _, n := range spec.NICs {
+		ps.NICs = append(ps.NICs, plan.NIC{NetworkID: n.NetworkID, SecurityGroupIDs: n.SGIDs, FixedIP: n.FixedIP})
+	}
+	return ps, nil
+}
+
+// findServer returns the server whose ID or exact name is ref.
+func findServer(ctx context.Context, serversClient *vpsserversclient.Client, ref string) (*vpsserversclient.ServerResource, error) {
+	if srv, err := serversClient.Get(ctx, ref); err == nil {
+		return srv, nil
+	}
+	// The API name filter may return prefix matches, so filter again locally.
+	res, err := serversClient.List(ctx, &vpsservers.ServersListRequest{Name: ref})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
+	}
+	var matches []*vpsserversclient.ServerResource
+	for _, s := range res {
+		if s != nil && s.Server != nil && s.Name == ref {
+			matches = append(matches, s)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no server found with name or ID %s", ref)
+	case 1:
+		// List results may omit details, so fetch the server itself.
+		return serversClient.Get(ctx, matches[0].ID)
+	default:
+		ids := make([]string, len(matches))
+		for i, s := range matches {
+			ids[i] = s.ID
+		}
+		return nil, fmt.Errorf("server name %s is ambiguous, %d servers match (IDs: %s); set RESTORE_REBUILD_VM to one of the IDs", ref, len(ids), strings.Join(ids, ", "))
+	}
+}
+
+// captureServer records what a rebuild must carry over from srv: its NICs
+// with their first fixed IP, security groups and floating IP, and its data
+// volumes. The system volume is replaced by the tag.
+func captureServer(srv *vpsservers.Server, nics []*vpsservers.ServerNIC, vols []*vpsservers.ServerVolume) *state.Server {
+	spec := &state.Server{
+		ID:          srv.ID,
+		Name:        srv.Name,
+		Description: srv.Description,
+		FlavorID:    srv.FlavorID,
+		KeypairID:   srv.KeypairID,
+	}
+	for _, n := range nics {
+		if n == nil {
+			continue
+		}
+		nic := state.NIC{NetworkID: n.NetworkID, SGIDs: n.SGIDs}
+		if len(nic.SGIDs) == 0 {
+			for _, sg := range n.SecurityGroups {
+				if sg != nil {
+					nic.SGIDs = append(nic.SGIDs, sg.ID)
+				}
+			}
+		}
+		if len(n.Addresses) > 0 {
+			nic.FixedIP = n.Addresses[0]
+		}
+		if n.FloatingIP != nil {
+			nic.FloatingIPID = n.FloatingIP.ID
+		}
+		spec.NICs = append(spec.NICs, nic)
+	}
+	for _, v := range vols {
+		if v != nil && !v.System {
+			spec.VolumeIDs = append(spec.VolumeIDs, v.VolumeID)
+		}
+	}
+	return spec
+}
+
+// createRequest returns the request creating the replacement of spec from
+// the tag tagID. Data volumes are attached once the server is active.
+func createRequest(spec *state.Server, tagID string) *vpsservers.ServerCreateRequest {
+	req := &vpsservers.ServerCreateRequest{
+		Name:        spec.Name,
+		Description: spec.Description,
+		FlavorID:    spec.FlavorID,
+		ImageID:     tagID,
+		KeypairID:   spec.KeypairID,
+	}
+	for _, n := range spec.NICs {
+		req.NICs = append(req.NICs, vpsservers.ServerNICCreateRequest{
+			NetworkID: n.NetworkID,
+			SGIDs:     n.SGIDs,
+			FixedIP:   n.FixedIP,
+		})
+	}
+	return req
+}
+
+// checkCreateRequest checks that the flavor, keypair, networks and security
+// groups req refers to exist and that its fixed IPs lie in their networks.
+func checkCreateRequest(ctx context.Context, vpsClient *vps.Client, req *vpsservers.ServerCreateRequest) error {
+	if _, err := vpsClient.Flavors().Get(ctx, req.FlavorID); err != nil {
+		return fmt.Errorf("flavor %s: %w", req.FlavorID, err)
+	}
+	if req.KeypairID != "" {
+		if _, err := vpsClient.Keypairs().Get(ctx, req.KeypairID); err != nil {
+			return fmt.Errorf("keypair %s: %w", req.KeypairID, err)
+		}
+	}
+	cidrs := make(map[string]string)
+	for _, n := range req.NICs {
+		if _, ok := cidrs[n.NetworkID]; !ok && n.NetworkID != "" {
+			net, err := vpsClient.Networks().Get(ctx, n.NetworkID)
+			if err != nil {
+				return fmt.Errorf("network %s: %w", n.NetworkID, err)
+			}
+			cidrs[n.NetworkID] = net.CIDR
+		}
+		for _, sg := range n.SGIDs {
+			if _, err := vpsClient.SecurityGroups().Get(ctx, sg); err != nil {
+				return fmt.Errorf("security group %s: %w", sg, err)
+			}
+		}
+	}
+	return validateCreateRequest(req, cidrs)
+}
+
+// validateCreateRequest checks that req names a server, flavor and image and
+// has NICs, each on a network, and that every fixed IP is an address in the
+// CIDR of its network as given by cidrs, when known.
+func validateCreateRequest(req *vpsservers.ServerCreateRequest, cidrs map[string]string) error {
+	switch {
+	case req.Name == "":
+		return errors.New("missing server name")
+	case req.FlavorID == "":
+		return errors.New("missing flavor")
+	case req.ImageID == "":
+		return errors.New("missing image")
+	case len(req.NICs) == 0:
+		return errors.New("no NICs")
+	}
+	for i, n := range req.NICs {
+		if n.NetworkID == "" {
+			return fmt.Errorf("NIC %d has no network", i+1)
+		}
+		if n.FixedIP == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(n.FixedIP)
+		if err != nil {
+			return fmt.Errorf("NIC %d: invalid fixed IP %q", i+1, n.FixedIP)
+		}
+		if cidr := cidrs[n.NetworkID]; cidr != "" {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err == nil && !prefix.Contains(ip) {
+				return fmt.Errorf("NIC %d: fixed IP %s is not in %s of network %s", i+1, ip, cidr, n.NetworkID)
+			}
+		}
+	}
+	return nil
+}
+
+// fipAssignment is a floating IP to associate with a NIC.
+type fipAssignment struct {
+	nicID string
+	fipID string
+}
+
+// floatingIPAssignments pairs the floating IPs of the recorded NICs with the
+// NICs of the new server on the same network, in order. NICs that already
+// hold their floating IP are skipped.
+func floatingIPAssignments(recorded []state.NIC, nics []*vpsservers.ServerNIC) []fipAssignment {
+	used := make(map[int]bool)
+	var out []fipAssignment
+	for _, r := range recorded {
+		for i, n := range nics {
+			if used[i] || n == nil || n.NetworkID != r.NetworkID {
+				continue
+			}
+			used[i] = true
+			if r.FloatingIPID != "" && (n.FloatingIP == nil || n.FloatingIP.ID != r.FloatingIPID) {
+				out = append(out, fipAssignment{nicID: n.ID, fipID: r.FloatingIPID})
+			}
+			break
+		}
+	}
+	return out
+}
+
+// deleteServer releases the floating IPs and data volumes of spec and deletes
+// the server. A server that is already gone is not an error.
+func deleteServer(ctx context.Context, vpsClient *vps.Client, spec *state.Server) error {
+	srv, err := vpsClient.Servers().Get(ctx, spec.ID)
+	if isNotFound(err) {
+		log.Printf("Server %s is already deleted", spec.ID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get server %s: %w", spec.ID, err)
+	}
+
+	for _, n := range spec.NICs {
+		if n.FloatingIPID == "" {
+			continue
+		}
+		if err := vpsClient.FloatingIPs().Disassociate(ctx, n.FloatingIPID); err != nil {
+			log.Printf("Warning: failed to disassociate floating IP %s: %v", n.FloatingIPID, err)
+		}
+	}
+
+	attached, err := srv.Volumes().List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list volumes of server %s: %w", spec.ID, err)
+	}
+	for _, v := range attached {
+		if v == nil || v.System || !slices.Contains(spec.VolumeIDs, v.VolumeID) {
+			continue
+		}
+		log.Printf("Detaching volume %s from server %s", v.VolumeID, spec.ID)
+		if err := srv.Volumes().Detach(ctx, v.VolumeID); err != nil {
+			return fmt.Errorf("failed to detach volume %s: %w", v.VolumeID, err)
+		}
+		if err := vps.WaitForVolumeAvailable(ctx, vpsClient.Volumes(), v.VolumeID); err != nil {
+			return fmt.Errorf("volume %s did not become available: %w", v.VolumeID, err)
+		}
+	}
+
+	log.Printf("Deleting server %s (%s)", spec.Name, spec.ID)
+	if err := vpsClient.Servers().Delete(ctx, spec.ID); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete server %s: %w", spec.ID, err)
+	}
+	if err := vps.WaitForServerDeleted(ctx, vpsClient.Servers(), spec.ID); err != nil {
+		return fmt.Errorf("server %s was not deleted: %w", spec.ID, err)
+	}
+	return nil
+}
+
+// reattach attaches the data volumes of spec to the server serverID and
+// associates the floating IPs with its NICs.
+func reattach(ctx context.Context, vpsClient *vps.Client, spec *state.Server, serverID string) error {
+	srv, err := vpsClient.Servers().Get(ctx, serverID)
+	if err != nil {
+		return fmt.Errorf("failed to get server %s: %w", serverID, err)
+	}
+
+	attached, err := srv.Volumes().List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list volumes of server %s: %w", serverID, err)
+	}
+	var have []string
+	for _, v := range attached {
+		if v != nil {
+			have = append(have, v.VolumeID)
+		}
+	}
+	for _, id := range spec.VolumeIDs {
+		if slices.Contains(have, id) {
+			continue
+		}
+		log.Printf("Attaching volume %s to server %s", id, serverID)
+		if err := srv.Volumes().Attach(ctx, id); err != nil {
+			return fmt.Errorf("failed to attach volume %s: %w", id, err)
+		}
+		if err := vps.WaitForVolumeInUse(ctx, vpsClient.Volumes(), id); err != nil {
+			return fmt.Errorf("volume %s was not attached: %w", id, err)
+		}
+	}
+
+	nics, err := srv.NICs().List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list NICs of server %s: %w", serverID, err)
+	}
+	for _, a := range floatingIPAssignments(spec.NICs, nics) {
+		log.Printf("Associating floating IP %s with NIC %s", a.fipID, a.nicID)
+		req := &vpsservers.ServerNICAssociateFloatingIPRequest{FIPID: a.fipID}
+		if _, err := srv.NICs().AssociateFloatingIP(ctx, a.nicID, req); err != nil {
+			return fmt.Errorf("failed to associate floating IP %s: %w", a.fipID, err)
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether err is an API 404.
+func isNotFound(err error) bool {
+	var sdkErr *cloudsdk.SDKError
+	return errors.As(err, &sdkErr) && sdkErr.StatusCode == 404
+}
@@ -0,0 +1,109 @@
+package restore
+
+import (
+	"testing"
+
+	common "github.com/Zillaforge/cloud-sdk/models/vps/common"
+	"github.com/Zillaforge/cloud-sdk/models/vps/floatingips"
+	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
+
+	"nchc-vmbr/internal/state"
+)
+
+func TestCaptureServerAndCreateRequest(t *testing.T) {
+	srv := &vpsservers.Server{ID: "server-1", Name: "web-01", Description: "web", FlavorID: "flavor-1", KeypairID: "kp-1"}
+	nics := []*vpsservers.ServerNIC{
+		{ID: "nic-1", NetworkID: "net-1", Addresses: []string{"10.0.0.5"}, SGIDs: []string{"sg-1", "sg-2"}, FloatingIP: &floatingips.FloatingIP{ID: "fip-1"}},
+		{ID: "nic-2", NetworkID: "net-2", SecurityGroups: []*common.IDName{{ID: "sg-3"}}},
+	}
+	vols := []*vpsservers.ServerVolume{
+		{System: true, VolumeID: "root-1"},
+		{VolumeID: "data-1"},
+	}
+
+	spec := captureServer(srv, nics, vols)
+	if spec.ID != "server-1" || spec.Name != "web-01" || spec.FlavorID != "flavor-1" || spec.KeypairID != "kp-1" {
+		t.Fatalf("unexpected server spec: %+v", spec)
+	}
+	if len(spec.NICs) != 2 {
+		t.Fatalf("expected 2 NICs, got %+v", spec.NICs)
+	}
+	if n := spec.NICs[0]; n.NetworkID != "net-1" || n.FixedIP != "10.0.0.5" || n.FloatingIPID != "fip-1" || len(n.SGIDs) != 2 {
+		t.Fatalf("unexpected first NIC: %+v", n)
+	}
+	if n := spec.NICs[1]; len(n.SGIDs) != 1 || n.SGIDs[0] != "sg-3" || n.FixedIP != "" {
+		t.Fatalf("expected security groups to be read from the NIC details, got %+v", n)
+	}
+	if len(spec.VolumeIDs) != 1 || spec.VolumeIDs[0] != "data-1" {
+		t.Fatalf("expected only the data volume to be carried over, got %v", spec.VolumeIDs)
+	}
+
+	req := createRequest(spec, "tag-1")
+	if req.Name != "web-01" || req.ImageID != "tag-1" || req.FlavorID != "flavor-1" || req.KeypairID != "kp-1" {
+		t.Fatalf("unexpected create request: %+v", req)
+	}
+	if len(req.NICs) != 2 || req.NICs[0].FixedIP != "10.0.0.5" || req.NICs[0].SGIDs[1] != "sg-2" || req.NICs[1].NetworkID != "net-2" {
+		t.Fatalf("unexpected NICs in create request: %+v", req.NICs)
+	}
+}
+
+func TestFloatingIPAssignments(t *testing.T) {
+	recorded := []state.NIC{
+		{NetworkID: "net-1", FloatingIPID: "fip-1"},
+		{NetworkID: "net-1"},
+		{NetworkID: "net-1", FloatingIPID: "fip-3"},
+		{NetworkID: "net-2", FloatingIPID: "fip-2"},
+	}
+	nics := []*vpsservers.ServerNIC{
+		{ID: "nic-a", NetworkID: "net-2", FloatingIP: &floatingips.FloatingIP{ID: "fip-2"}},
+		{ID: "nic-b", NetworkID: "net-1"},
+		{ID: "nic-c", NetworkID: "net-1"},
+		{ID: "nic-d", NetworkID: "net-1"},
+	}
+
+	got := floatingIPAssignments(recorded, nics)
+	want := []fipAssignment{{nicID: "nic-b", fipID: "fip-1"}, {nicID: "nic-d", fipID: "fip-3"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestValidateCreateRequest(t *testing.T) {
+	valid := func() *vpsservers.ServerCreateRequest {
+		return &vpsservers.ServerCreateRequest{
+			Name:     "web-01",
+			FlavorID: "flavor-1",
+			ImageID:  "tag-1",
+			NICs: []vpsservers.ServerNICCreateRequest{
+				{NetworkID: "net-1", FixedIP: "10.0.0.5"},
+				{NetworkID: "net-2"},
+			},
+		}
+	}
+	cidrs := map[string]string{"net-1": "10.0.0.0/24", "net-2": "192.168.0.0/24"}
+
+	if err := validateCreateRequest(valid(), cidrs); err != nil {
+		t.Fatalf("expected valid request, got %v", err)
+	}
+
+	cases := map[string]func(*vpsservers.ServerCreateRequest){
+		"no flavor":        func(r *vpsservers.ServerCreateRequest) { r.FlavorID = "" },
+		"no image":         func(r *vpsservers.ServerCreateRequest) { r.ImageID = "" },
+		"no NICs":          func(r *vpsservers.ServerCreateRequest) { r.NICs = nil },
+		"no network":       func(r *vpsservers.ServerCreateRequest) { r.NICs[1].NetworkID = "" },
+		"invalid IP":       func(r *vpsservers.ServerCreateRequest) { r.NICs[0].FixedIP = "10.0.0" },
+		"IP out of subnet": func(r *vpsservers.ServerCreateRequest) { r.NICs[0].FixedIP = "10.0.1.5" },
+	}
+	for name, mutate := range cases {
+		req := valid()
+		mutate(req)
+		if err := validateCreateRequest(req, cidrs); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
@@ -2,18 +2,26 @@ package restore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
-	cloudsdk "github.com/Zillaforge/cloud-sdk"
+	vrmcommon "github.com/Zillaforge/cloud-sdk/models/vrm/common"
 	vrmrepos "github.com/Zillaforge/cloud-sdk/models/vrm/repositories"
 
+	"nchc-vmbr/internal/catalog"
 	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/health"
+	"nchc-vmbr/internal/manifest"
+	"nchc-vmbr/internal/plan"
 	"nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
+	"nchc-vmbr/internal/state"
 	util "nchc-vmbr/internal/util"
 
 	vpsservers "github.com/Zillaforge/cloud-sdk/models/vps/servers"
@@ -27,14 +35,19 @@ var nowFunc = time.Now
 
 // LoadConfigFromEnv loads configuration from environment variables
 func LoadConfigFromEnv() (*config.Config, error) {
-	if err := util.RequireEnv(
-		"API_TOKEN", "API_PROTOCOL", "API_HOST", "PROJECT_SYS_CODE",
-		"RESTORE_REPO", "RESTORE_CS_BUCKET", "RESTORE_IMAGE",
-		"RESTORE_FLAVOR_ID", "RESTORE_NETWORK_ID",
-		"RESTORE_KEYPAIR_ID", "RESTORE_SECURITYGROUP_ID",
-	); err != nil {
+	if err := util.RequireEnv("API_TOKEN", "API_PROTOCOL", "API_HOST", "PROJECT_SYS_CODE"); err != nil {
 		return nil, err
 	}
+	// RESTORE_FROM_TAG boots from an existing <repo>:<version> tag; nothing is
+	// uploaded, so the repository, bucket and image are only needed otherwise.
+	fromTag := strings.TrimSpace(os.Getenv("RESTORE_FROM_TAG"))
+	if fromTag == "" {
+		if err := util.RequireEnv("RESTORE_REPO", "RESTORE_CS_BUCKET", "RESTORE_IMAGE"); err != nil {
+			return nil, err
+		}
+	}
+	rebuildServer := strings.TrimSpace(os.Getenv("RESTORE_REBUILD_VM"))
+	nicsEnv := os.Getenv("RESTORE_NICS")
 
 	baseURL := fmt.Sprintf("%s://%s", os.Getenv("API_PROTOCOL"), os.Getenv("API_HOST"))
 	token := os.Getenv("API_TOKEN")
@@ -48,20 +61,26 @@ func LoadConfigFromEnv() (*config.Config, error) {
 	sgID := os.Getenv("RESTORE_SECURITYGROUP_ID")
 	keypairID := os.Getenv("RESTORE_KEYPAIR_ID")
 
+	// RESTORE_NICS lists every NIC of the created VM, e.g.
+	// "network=net-1,sg=sg-1,sg=sg-2,ip=10.0.0.5;network=net-2,sg=sg-3".
+	nics, err := util.ParseNICs(nicsEnv)
+	if err != nil {
+		return nil, fmt.Errorf("RESTORE_NICS: %w", err)
+	}
+	if len(nics) == 0 && networkID != "" {
+		nics = []config.NIC{{NetworkID: networkID, SGIDs: util.SplitList(sgID)}}
+	}
+
 	vmNamePrefix := os.Getenv("RESTORE_DST_VM")
 	if vmNamePrefix == "" {
 		vmNamePrefix = "restore-dst-vm"
 	}
 
-	loc, err := time.LoadLocation("Asia/Taipei")
-	if err != nil {
-		log.Printf("warning: failed to load Asia/Taipei timezone: %v; falling back to fixed UTC+8", err)
-		loc = time.FixedZone("UTC+8", 8*3600)
-	}
-	// restore flow does not need a DateTagFormat; DateTag is computed directly
+	loc := util.TaipeiLocation()
+	// DATE_TAG_FORMAT versions the uploaded tag and identifies the tags pruning may delete
 	dateTagFormat := os.Getenv("DATE_TAG_FORMAT")
 	if dateTagFormat == "" {
-		dateTagFormat = "%Y-%m-%d-%H-%M"
+		dateTagFormat = util.DefaultDateTagFormat
 	}
 
 	// compute current time and date tag after timezone loc is available
@@ -71,6 +90,17 @@ func LoadConfigFromEnv() (*config.Config, error) {
 	if restoreImage == "" {
 		restoreImage = "backup-%Y-%m-%d.img"
 	}
+	// RESTORE_REPO and RESTORE_IMAGE may embed the project code.
+	vars := util.TemplateVars{Project: projectSysCode}
+	repoName = util.ApplyTemplate(repoName, vars)
+	restoreImage = util.ApplyTemplate(restoreImage, vars)
+	if fromTag != "" {
+		repo, _, err := util.ParseTagRef(fromTag)
+		if err != nil {
+			return nil, fmt.Errorf("RESTORE_FROM_TAG: %w", err)
+		}
+		repoName = repo
+	}
 
 	// Parse RESTORE_TAG_NUM (max number of tags to keep)
 	tagNum := 2
@@ -91,34 +121,107 @@ func LoadConfigFromEnv() (*config.Config, error) {
 		}
 	}
 
-	var srcCfg rclone.S3Config
-	var dstCfg rclone.S3Config
-	var srcPtr *rclone.S3Config
-	var dstPtr *rclone.S3Config
+	var srcLoc rclone.Location
+	var dstLoc rclone.Location
+	var srcPtr *rclone.Location
+	var dstPtr *rclone.Location
 
 	if transferFlag {
-		// require restore S3 envs when transfer-from-s3 is enabled
-		if err := util.RequireEnv(
-			"RESTORE_SRC_S3_ENDPOINT", "RESTORE_SRC_S3_ACCESS_KEY", "RESTORE_SRC_S3_SECRET_KEY", "RESTORE_SRC_S3_BUCKET",
-			"RESTORE_DST_S3_ENDPOINT", "RESTORE_DST_S3_ACCESS_KEY", "RESTORE_DST_S3_SECRET_KEY", "RESTORE_DST_S3_BUCKET",
-		); err != nil {
+		// require the restore locations when transfer-from-s3 is enabled;
+		// RESTORE_SRC_TYPE/RESTORE_DST_TYPE select backends other than S3
+		var err error
+		if srcLoc, err = util.LocationFromEnv("RESTORE_SRC"); err != nil {
 			return nil, err
 		}
+		if dstLoc, err = util.LocationFromEnv("RESTORE_DST"); err != nil {
+			return nil, err
+		}
+		srcPtr = &srcLoc
+		dstPtr = &dstLoc
+	}
 
-		srcCfg = rclone.S3Config{
-			Endpoint:  os.Getenv("RESTORE_SRC_S3_ENDPOINT"),
-			AccessKey: os.Getenv("RESTORE_SRC_S3_ACCESS_KEY"),
-			SecretKey: os.Getenv("RESTORE_SRC_S3_SECRET_KEY"),
-			Bucket:    os.Getenv("RESTORE_SRC_S3_BUCKET"),
+	// Point-in-time restores list the backup images in the source S3 when
+	// transferring, otherwise in the CS bucket through its S3 endpoint
+	// (RESTORE_CS_S3_ENDPOINT/_ACCESS_KEY/_SECRET_KEY).
+	catalogPtr := srcPtr
+	if !transferFlag && os.Getenv("RESTORE_CS_S3_ENDPOINT") != "" {
+		if err := util.RequireEnv("RESTORE_CS_S3_ACCESS_KEY", "RESTORE_CS_S3_SECRET_KEY"); err != nil {
+			return nil, err
+		}
+		csCfg := rclone.S3Config{
+			Endpoint:  os.Getenv("RESTORE_CS_S3_ENDPOINT"),
+			AccessKey: os.Getenv("RESTORE_CS_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("RESTORE_CS_S3_SECRET_KEY"),
+			Bucket:    csBucket,
+		}
+		if err := util.S3OptionsFromEnv("RESTORE_CS_S3", &csCfg); err != nil {
+			return nil, err
+		}
+		csLoc := csCfg.Location()
+		catalogPtr = &csLoc
+	}
+
+	// RESTORE_REBUILD_VM replaces an existing server, whose flavor, keypair,
+	// NICs and security groups are reused. Otherwise they default to the VM
+	// manifest next to the backup image, which can only be read through S3;
+	// without S3 access (or when restoring from a tag) they must be given,
+	// the NICs either as RESTORE_NICS or as a single network and security group.
+	if rebuildServer == "" {
+		var required []string
+		if fromTag != "" || catalogPtr == nil {
+			required = append(required, "RESTORE_FLAVOR_ID", "RESTORE_KEYPAIR_ID")
 		}
-		dstCfg = rclone.S3Config{
-			Endpoint:  os.Getenv("RESTORE_DST_S3_ENDPOINT"),
-			AccessKey: os.Getenv("RESTORE_DST_S3_ACCESS_KEY"),
-			SecretKey: os.Getenv("RESTORE_DST_S3_SECRET_KEY"),
-			Bucket:    os.Getenv("RESTORE_DST_S3_BUCKET"),
+		if strings.TrimSpace(nicsEnv) == "" && (fromTag != "" || catalogPtr == nil || networkID != "" || sgID != "") {
+			required = append(required, "RESTORE_NETWORK_ID", "RESTORE_SECURITYGROUP_ID")
+		}
+		if err := util.RequireEnv(required...); err != nil {
+			return nil, err
+		}
+	}
+
+	healthCheck, err := healthOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// RESTORE_PRUNE_MODE selects when old tags are pruned: "after" the new tag is
+	// ready (default) or "before" creating it, for quota-constrained repos.
+	pruneMode, err := util.ParsePruneMode(os.Getenv("RESTORE_PRUNE_MODE"))
+	if err != nil {
+		return nil, fmt.Errorf("RESTORE_PRUNE_MODE: %w", err)
+	}
+
+	// RESTORE_RETENTION is an optional GFS policy such as
+	// "daily=7,weekly=4,monthly=12,yearly=2"; it takes precedence over
+	// RESTORE_TAG_NUM.
+	policy, err := retention.ParsePolicy(os.Getenv("RESTORE_RETENTION"))
+	if err != nil {
+		return nil, fmt.Errorf("RESTORE_RETENTION: %w", err)
+	}
+
+	// RESTORE_PIN_TAGS (versions or tag IDs) and RESTORE_PIN_PATTERNS (globs on
+	// the version) protect tags from pruning, e.g. for a legal hold.
+	pinTags := util.SplitList(os.Getenv("RESTORE_PIN_TAGS"))
+	pinPatterns := util.SplitList(os.Getenv("RESTORE_PIN_PATTERNS"))
+	for _, pat := range pinPatterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("invalid RESTORE_PIN_PATTERNS entry %q: %w", pat, err)
 		}
-		srcPtr = &srcCfg
-		dstPtr = &dstCfg
+	}
+
+	// Pruning only considers tags created by this tool (versioned with
+	// DATE_TAG_FORMAT or marked as managed) unless RESTORE_PRUNE_ALL_TAGS is set.
+	pruneAllTags := util.IsTrue(os.Getenv("RESTORE_PRUNE_ALL_TAGS"))
+
+	// Copies and images are verified against the size and checksums the
+	// storage reports; RESTORE_VERIFY_DOWNLOAD reads them to compute the MD5
+	// when it reports none.
+	verifyDownload := util.IsTrue(os.Getenv("RESTORE_VERIFY_DOWNLOAD"))
+
+	// Run state files used to resume an interrupted run.
+	stateDir := os.Getenv("STATE_DIR")
+	if stateDir == "" {
+		stateDir = state.DefaultDir
 	}
 
 	cfg := &config.Config{
@@ -128,60 +231,428 @@ func LoadConfigFromEnv() (*config.Config, error) {
 		RepoName:           repoName,
 		CSBucket:           csBucket,
 		BackupRestoreImage: restoreImage,
+		FromTag:            fromTag,
 		VPSSetting: &config.VPSSetting{
-			FlavorID:        flavorID,
-			NetworkID:       networkID,
-			KeypairID:       keypairID,
-			SecurityGroupID: sgID,
+			FlavorID:  flavorID,
+			KeypairID: keypairID,
+			NICs:      nics,
 		},
-		VMName:     vmNamePrefix,
-		DateTag:    dateTag,
-		OsType:     "linux",
-		TagNum:     tagNum,
-		Now:        now,
-		SrcS3Cfg:   srcPtr,
-		DstS3Cfg:   dstPtr,
-		TransferS3: transferFlag,
+		VMName:          vmNamePrefix,
+		RebuildServer:   rebuildServer,
+		HealthCheck:     healthCheck,
+		DateTag:         dateTag,
+		DateTagFormat:   dateTagFormat,
+		OsType:          "linux",
+		TagNum:          tagNum,
+		PruneMode:       pruneMode,
+		Retention:       policy,
+		PinTags:         pinTags,
+		PinPatterns:     pinPatterns,
+		PruneAllTags:    pruneAllTags,
+		Now:             now,
+		SrcLocation:     srcPtr,
+		DstLocation:     dstPtr,
+		CatalogLocation: catalogPtr,
+		TransferS3:      transferFlag,
+		VerifyDownload:  verifyDownload,
+		StateDir:        stateDir,
 	}
 	return cfg, nil
 }
 
-// Run executes the restore workflow.
+// LoadTransferConfigFromEnv loads only the settings of a standalone transfer
+// of a backup image into the CS bucket: the image template (RESTORE_IMAGE),
+// the project code it may embed, the current time and the RESTORE_SRC and
+// RESTORE_DST locations, whatever RESTORE_TRANSFR_FROM_S3 says. Unlike
+// LoadConfigFromEnv it needs neither the API nor the VPS settings.
+func LoadTransferConfigFromEnv() (*config.Config, error) {
+	src, err := util.LocationFromEnv("RESTORE_SRC")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := util.LocationFromEnv("RESTORE_DST")
+	if err != nil {
+		return nil, err
+	}
+	projectSysCode := os.Getenv("PROJECT_SYS_CODE")
+	restoreImage := os.Getenv("RESTORE_IMAGE")
+	if restoreImage == "" {
+		restoreImage = "backup-%Y-%m-%d.img"
+	}
+	restoreImage = util.ApplyTemplate(restoreImage, util.TemplateVars{Project: projectSysCode})
+	return &config.Config{
+		ProjectSysCode:     projectSysCode,
+		BackupRestoreImage: restoreImage,
+		Now:                nowFunc().In(util.TaipeiLocation()),
+		SrcLocation:        &src,
+		DstLocation:        &dst,
+		CatalogLocation:    &src,
+		TransferS3:         true,
+		VerifyDownload:     util.IsTrue(os.Getenv("RESTORE_VERIFY_DOWNLOAD")),
+	}, nil
+}
+
+// healthOptionsFromEnv reads the post-restore checks: the restored VM must
+// report an IP (RESTORE_HEALTH_WAIT_IP), accept connections on
+// RESTORE_HEALTH_TCP_PORT, answer RESTORE_HEALTH_HTTP_URL and pass
+// RESTORE_HEALTH_COMMAND within RESTORE_HEALTH_TIMEOUT (a Go duration such
+// as "10m"). RESTORE_HEALTH_DELETE_ON_FAILURE deletes it otherwise.
+func healthOptionsFromEnv() (health.Options, error) {
+	opts := health.Options{
+		WaitIP:          util.IsTrue(os.Getenv("RESTORE_HEALTH_WAIT_IP")),
+		HTTPURL:         strings.TrimSpace(os.Getenv("RESTORE_HEALTH_HTTP_URL")),
+		Command:         strings.TrimSpace(os.Getenv("RESTORE_HEALTH_COMMAND")),
+		DeleteOnFailure: util.IsTrue(os.Getenv("RESTORE_HEALTH_DELETE_ON_FAILURE")),
+	}
+	if v := strings.TrimSpace(os.Getenv("RESTORE_HEALTH_TCP_PORT")); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil || port < 1 || port > 65535 {
+			return opts, fmt.Errorf("RESTORE_HEALTH_TCP_PORT: invalid port %q", v)
+		}
+		opts.TCPPort = port
+	}
+	if v := strings.TrimSpace(os.Getenv("RESTORE_HEALTH_TIMEOUT")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("RESTORE_HEALTH_TIMEOUT: invalid duration %q", v)
+		}
+		opts.Timeout = d
+	}
+	return opts, nil
+}
+
+// Run executes the restore workflow: the optional transfer from the source
+// S3, the upload into VRM (or the lookup of cfg.FromTag) and the creation of
+// the VM, or the rebuild of cfg.RebuildServer when set, followed by the
+// optional health checks of cfg.HealthCheck. Every completed stage is
+// checkpointed in a state file under cfg.StateDir; when cfg.RunID is set
+// that run is resumed at its first incomplete stage.
 func Run(ctx context.Context, cfg *config.Config) error {
-	client, err := cloudsdk.New(cfg.BaseURL, cfg.Token)
+	if cfg.RebuildServer != "" && !cfg.ConfirmRebuild {
+		return ErrRebuildNotConfirmed
+	}
+	run, err := state.Open(cfg.StateDir, state.KindRestore, cfg.RunID, cfg.Now, cfg.DateTag)
 	if err != nil {
-		return fmt.Errorf("failed to create SDK client: %w", err)
+		return err
+	}
+	if cfg.RunID != "" {
+		log.Printf("Resuming restore run %s from %s", run.ID, run.Path())
+	} else {
+		log.Printf("Started restore run %s (state: %s); resume with --resume %s", run.ID, run.Path(), run.ID)
+	}
+	runCfg := *cfg
+	runCfg.RunID = run.ID
+	runCfg.Now = run.Now
+	runCfg.DateTag = run.DateTag
+	cfg = &runCfg
+
+	key := cfg.VMName
+	progress := run.Get(key)
+
+	// A resumed run restores the image or tag it started with, even if a
+	// newer backup has been selected from the catalog since.
+	switch {
+	case progress.FromTag != "":
+		cfg.FromTag = progress.FromTag
+	case progress.Image != "":
+		cfg.BackupRestoreImage = progress.Image
+	default:
+		if err := run.Update(key, func(vm *state.VM) {
+			if cfg.FromTag != "" {
+				vm.FromTag = cfg.FromTag
+			} else {
+				vm.Image = cfg.BackupRestoreImage
+			}
+		}); err != nil {
+			return err
+		}
 	}
 
-	projClient, err := client.Project(ctx, cfg.ProjectSysCode)
+	// The manifest of the backup image validates the image before it is
+	// uploaded and provides the VPS settings left unset; a rebuild takes
+	// them from the server it replaces instead.
+	var m *manifest.Manifest
+	if cfg.FromTag == "" && !progress.Done(state.StageServerCreate) {
+		if m, err = readManifest(cfg); err != nil {
+			return err
+		}
+		if cfg.RebuildServer == "" && progress.Replaced == nil {
+			applyManifest(cfg, m)
+			if err := checkVPSSetting(cfg); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.FromTag == "" && cfg.DstLocation != nil && cfg.TransferS3 && !progress.Done(state.StageTransfer) {
+		if err := Transfer(cfg); err != nil {
+			return err
+		}
+		if err := run.Complete(key, state.StageTransfer); err != nil {
+			return err
+		}
+	}
+
+	projClient, err := util.NewProjectClient(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create project client: %w", err)
+		return err
 	}
 
 	vpsClient := projClient.VPS()
 	vrmClient := projClient.VRM()
 
-	// Check repository presence
-	repos, err := vrmClient.Repositories().List(ctx, &vrmrepos.ListRepositoriesOptions{})
+	tagID := progress.TagID
+	switch {
+	case cfg.FromTag != "":
+		if tagID, err = existingTag(ctx, vrmClient, cfg, run); err != nil {
+			return err
+		}
+	case progress.Done(state.StageUpload):
+		log.Printf("Resuming with uploaded tag %s", tagID)
+	default:
+		if m != nil {
+			if err := validateImage(cfg, m); err != nil {
+				return err
+			}
+		}
+		if tagID, err = upload(ctx, vrmClient, cfg, run); err != nil {
+			return err
+		}
+	}
+
+	// Wait for tag to become active
+	if cfg.FromTag == "" && !progress.Done(state.StageTagActive) {
+		log.Printf("Waiting for tag %s to become active...", tagID)
+		if err := vrm.WaitForTagActive(ctx, vrmClient.Tags(), tagID); err != nil {
+			return fmt.Errorf("tag %s did not become available: %w", tagID, err)
+		}
+		log.Printf("Tag %s is active", tagID)
+		if err := run.Complete(key, state.StageTagActive); err != nil {
+			return err
+		}
+	}
+
+	// In the prune-after-success mode old tags are only deleted once the
+	// uploaded tag is active; the new tag itself is never deleted. Nothing is
+	// pruned when restoring from an existing tag, as no tag is added.
+	opts := util.PruneOptionsFor(cfg, cfg.TagNum, tagID)
+	if cfg.FromTag == "" && cfg.PruneMode == util.PruneAfter && opts.Enabled() && !progress.Done(state.StagePrune) {
+		if _, err := util.PruneRepository(ctx, vrmClient, run.Get(key).RepoID, opts); err != nil {
+			return fmt.Errorf("failed to prune repository tags: %w", err)
+		}
+		if err := run.Complete(key, state.StagePrune); err != nil {
+			return err
+		}
+	}
+
+	// A resumed rebuild carries on even if RESTORE_REBUILD_VM is unset now.
+	if cfg.RebuildServer != "" || progress.Replaced != nil {
+		if err := rebuild(ctx, vpsClient, cfg, run, tagID); err != nil {
+			return err
+		}
+		return checkHealth(ctx, vpsClient, cfg, run, run.Get(key).ServerID, true)
+	}
+
+	vmName := fmt.Sprintf("%s-%s", cfg.VMName, cfg.DateTag)
+
+	serverID := progress.ServerID
+	if progress.Done(state.StageServerCreate) {
+		log.Printf("Resuming with created server %s", serverID)
+	} else {
+		// Create VM from tag
+		createReq := &vpsservers.ServerCreateRequest{
+			Name:      vmName,
+			ImageID:   tagID,
+			FlavorID:  cfg.VPSSetting.FlavorID,
+			KeypairID: cfg.VPSSetting.KeypairID,
+			NICs:      nicRequests(cfg.VPSSetting.NICs),
+		}
+
+		created, err := vpsClient.Servers().Create(ctx, createReq)
+		if err != nil {
+			return fmt.Errorf("failed to create server: %w", err)
+		}
+		serverID = created.ID
+		if err := run.Update(key, func(vm *state.VM) {
+			vm.ServerID = serverID
+			vm.MarkDone(state.StageServerCreate)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Wait for the server to become active using SDK waiter.
+	if !progress.Done(state.StageServerActive) {
+		log.Printf("Waiting for server %s to become active...", serverID)
+		if err := vps.WaitForServerActive(ctx, vpsClient.Servers(), serverID); err != nil {
+			return fmt.Errorf("server %s did not become active: %w", serverID, err)
+		}
+		if err := run.Complete(key, state.StageServerActive); err != nil {
+			return err
+		}
+	}
+
+	if err := checkHealth(ctx, vpsClient, cfg, run, serverID, false); err != nil {
+		return err
+	}
+
+	log.Printf("VM %s created successfully", vmName)
+	return nil
+}
+
+// checkHealth runs the checks of cfg.HealthCheck on the restored server
+// serverID. When they fail and cfg.HealthCheck.DeleteOnFailure is set, a
+// created server is deleted and dropped from the run state, so that a
+// resumed run creates a new one; a rebuilt server is kept, as the server it
+// replaced is already gone.
+func checkHealth(ctx context.Context, vpsClient *vps.Client, cfg *config.Config, run *state.Run, serverID string, rebuilt bool) error {
+	key := cfg.VMName
+	if !cfg.HealthCheck.Enabled() || run.Get(key).Done(state.StageHealthCheck) {
+		return nil
+	}
+	log.Printf("Checking server %s: %s", serverID, cfg.HealthCheck)
+	addr := func(ctx context.Context) (string, error) {
+		srv, err := vpsClient.Servers().Get(ctx, serverID)
+		if err != nil {
+			return "", err
+		}
+		nics, err := srv.NICs().List(ctx)
+		if err != nil {
+			return "", err
+		}
+		return health.Address(nics), nil
+	}
+	err := health.Run(ctx, cfg.HealthCheck, serverID, addr)
+	if err == nil {
+		return run.Complete(key, state.StageHealthCheck)
+	}
+	err = fmt.Errorf("server %s: %w", serverID, err)
+	if !cfg.HealthCheck.DeleteOnFailure {
+		return err
+	}
+	if rebuilt {
+		log.Printf("Keeping rebuilt server %s despite the failed health check", serverID)
+		return err
+	}
+
+	log.Printf("Deleting server %s after the failed health check", serverID)
+	if derr := vpsClient.Servers().Delete(ctx, serverID); derr != nil && !isNotFound(derr) {
+		return fmt.Errorf("%w; deleting it failed as well: %v", err, derr)
+	}
+	if uerr := run.Update(key, func(vm *state.VM) {
+		vm.ServerID = ""
+		delete(vm.Stages, state.StageServerCreate)
+		delete(vm.Stages, state.StageServerActive)
+	}); uerr != nil {
+		return uerr
+	}
+	return err
+}
+
+// BuildPlan resolves everything a restore run would touch — the repository,
+// the new tag version, the CS path, the S3 objects, the tags that would be
+// pruned (or the existing tag restored from) and the VM that would be created
+// or rebuilt — without changing anything.
+func BuildPlan(ctx context.Context, cfg *config.Config) (*plan.Plan, error) {
+	projClient, err := util.NewProjectClient(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to list repositories: %w", err)
+		return nil, err
+	}
+	vrmClient := projClient.VRM()
+
+	// VPS settings left unset default to the manifest of the backup image.
+	specCfg := *cfg
+	var manifestName string
+	var specErr error
+	if cfg.FromTag == "" && cfg.RebuildServer == "" {
+		var m *manifest.Manifest
+		if m, specErr = readManifest(&specCfg); specErr == nil {
+			applyManifest(&specCfg, m)
+			specErr = checkVPSSetting(&specCfg)
+		}
+		if m != nil {
+			manifestName = manifest.Name(m.Image)
+		}
 	}
 
-	var repoID string
-	for _, r := range repos {
-		if r == nil {
-			continue
+	t := plan.Target{
+		VMName:   cfg.VMName,
+		RepoName: cfg.RepoName,
+		Server: &plan.Server{
+			Name:      fmt.Sprintf("%s-%s", cfg.VMName, cfg.DateTag),
+			FlavorID:  specCfg.VPSSetting.FlavorID,
+			KeypairID: specCfg.VPSSetting.KeypairID,
+			NICs:      plan.NICs(specCfg.VPSSetting.NICs),
+			Manifest:  manifestName,
+		},
+	}
+	if specErr != nil {
+		t.Error = specErr.Error()
+	}
+	if cfg.RebuildServer != "" {
+		if t.Server, err = planRebuild(ctx, projClient.VPS(), cfg); err != nil {
+			t.Error = err.Error()
+		}
+	}
+	if t.Server != nil && cfg.HealthCheck.Enabled() {
+		t.Server.HealthCheck = cfg.HealthCheck.String()
+	}
+	if cfg.FromTag != "" {
+		// Nothing is transferred, uploaded or pruned.
+		tag, repoID, err := util.FindTag(ctx, vrmClient, cfg.FromTag)
+		switch {
+		case err != nil:
+			t.Error = err.Error()
+		case tag.Status != vrmcommon.TagStatusActive:
+			t.Error = fmt.Sprintf("tag %s (%s) is %s, not active", cfg.FromTag, tag.ID, tag.Status)
+		default:
+			t.RepoID = repoID
+			t.FromTag = &plan.Tag{ID: tag.ID, Version: tag.Name, CreatedAt: tag.CreatedAt}
+		}
+	} else {
+		t.Version = cfg.DateTag
+		t.CSPath = util.BuildCSFilepath(cfg.CSBucket, cfg.BackupRestoreImage, cfg.Now)
+		if cfg.TransferS3 && cfg.SrcLocation != nil && cfg.DstLocation != nil {
+			key := util.ImageName(cfg.BackupRestoreImage, cfg.Now)
+			t.Transfer = &plan.Transfer{
+				Src: plan.Object{Endpoint: cfg.SrcLocation.Endpoint(), Bucket: cfg.SrcLocation.Dir(), Key: key},
+				Dst: plan.Object{Endpoint: cfg.DstLocation.Endpoint(), Bucket: cfg.DstLocation.Dir(), Key: key},
+			}
 		}
-		if r.Name == cfg.RepoName {
-			repoID = r.ID
-			break
+		if t.RepoID, err = util.FindRepositoryID(ctx, vrmClient, cfg.RepoName); err != nil {
+			t.Error = err.Error()
+		} else if t.RepoID != "" && util.PruneOptionsFor(cfg, cfg.TagNum).Enabled() {
+			tags, err := util.ListRepositoryTags(ctx, vrmClient, t.RepoID)
+			if err != nil {
+				t.Error = err.Error()
+			} else {
+				t.PruneTags = plan.Tags(util.PlanPruneTags(cfg, tags))
+				t.PruneWhen = cfg.PruneMode
+			}
 		}
 	}
 
+	return &plan.Plan{
+		Kind:    state.KindRestore,
+		Project: cfg.ProjectSysCode,
+		Now:     cfg.Now,
+		DateTag: cfg.DateTag,
+		Targets: []plan.Target{t},
+	}, nil
+}
+
+// upload uploads the image from the CS bucket into cfg.RepoName, records the
+// new tag in run and returns its ID.
+func upload(ctx context.Context, vrmClient *vrm.Client, cfg *config.Config, run *state.Run) (string, error) {
+	// Check repository presence
+	repoID, err := util.FindRepositoryID(ctx, vrmClient, cfg.RepoName)
+	if err != nil {
+		return "", err
+	}
+
 	// Upload image to repository (create repo or add tag)
 	var uploadResp *vrmrepos.UploadImageResponse
 	imagePath := util.BuildCSFilepath(cfg.CSBucket, cfg.BackupRestoreImage, cfg.Now)
-
 	if repoID == "" {
 		log.Printf("Repository %s not found; creating and uploading image", cfg.RepoName)
 		req := &vrmrepos.UploadToNewRepositoryRequest{
@@ -197,15 +668,15 @@ func Run(ctx context.Context, cfg *config.Config) error {
 
 		uploadResp, err = vrmClient.Repositories().Upload(ctx, req)
 		if err != nil {
-			return fmt.Errorf("failed to upload image to create repository: %w", err)
+			return "", fmt.Errorf("failed to upload image to create repository: %w", err)
 		}
 		repoID = uploadResp.Repository.ID
 	} else {
 		log.Printf("Repository %s found; creating new tag version %s", cfg.RepoName, cfg.DateTag)
-		// Prune repo tags if configured (reserve one slot for the uploaded tag)
-		if cfg.TagNum > 0 {
-			if err := util.PruneRepositoryTags(ctx, vrmClient, repoID, cfg.TagNum-1); err != nil {
-				return fmt.Errorf("failed to prune repository tags: %w", err)
+		// In the prune-before mode, reserve one slot for the uploaded tag.
+		if cfg.PruneMode == util.PruneBefore {
+			if _, err := util.PruneRepository(ctx, vrmClient, repoID, util.PruneOptionsFor(cfg, cfg.TagNum-1)); err != nil {
+				return "", fmt.Errorf("failed to prune repository tags: %w", err)
 			}
 		}
 		req := &vrmrepos.UploadToExistingRepositoryRequest{
@@ -218,51 +689,261 @@ func Run(ctx context.Context, cfg *config.Config) error {
 		}
 		uploadResp, err = vrmClient.Repositories().Upload(ctx, req)
 		if err != nil {
-			return fmt.Errorf("failed to upload image into existing repository: %w", err)
+			return "", fmt.Errorf("failed to upload image into existing repository: %w", err)
 		}
 	}
 
 	if uploadResp == nil || uploadResp.Tag == nil {
-		return fmt.Errorf("upload returned missing tag info")
+		return "", fmt.Errorf("upload returned missing tag info")
 	}
 	tagID := uploadResp.Tag.ID
 	log.Printf("Uploaded image, repoID=%s tagID=%s", repoID, tagID)
 
-	// Wait for tag to become active
-	log.Printf("Waiting for tag %s to become active...", tagID)
-	if err := vrm.WaitForTagActive(ctx, vrmClient.Tags(), tagID); err != nil {
-		return fmt.Errorf("tag %s did not become available: %w", tagID, err)
+	if err := run.Update(cfg.VMName, func(vm *state.VM) {
+		vm.RepoID = repoID
+		vm.TagID = tagID
+		vm.MarkDone(state.StageUpload)
+	}); err != nil {
+		return "", err
 	}
-	log.Printf("Tag %s is active", tagID)
+	return tagID, nil
+}
 
-	vmName := fmt.Sprintf("%s-%s", cfg.VMName, cfg.DateTag)
+// nicRequests converts the configured NICs into server create requests.
+func nicRequests(nics []config.NIC) []vpsservers.ServerNICCreateRequest {
+	out := make([]vpsservers.ServerNICCreateRequest, 0, len(nics))
+	for _, n := range nics {
+		out = append(out, vpsservers.ServerNICCreateRequest{
+			NetworkID: n.NetworkID,
+			SGIDs:     n.SGIDs,
+			FixedIP:   n.FixedIP,
+		})
+	}
+	return out
+}
 
-	// Create VM from tag
-	createReq := &vpsservers.ServerCreateRequest{
-		Name:      vmName,
-		ImageID:   tagID,
-		FlavorID:  cfg.VPSSetting.FlavorID,
-		KeypairID: cfg.VPSSetting.KeypairID,
-		NICs: []vpsservers.ServerNICCreateRequest{
-			{
-				NetworkID: cfg.VPSSetting.NetworkID,
-				SGIDs:     []string{cfg.VPSSetting.SecurityGroupID},
-			},
-		},
+// readManifest reads the manifest written next to the backup image. It
+// returns nil when there is none or no S3 access to the bucket holding it.
+func readManifest(cfg *config.Config) (*manifest.Manifest, error) {
+	if cfg.CatalogLocation == nil {
+		return nil, nil
+	}
+	image := util.ImageName(cfg.BackupRestoreImage, cfg.Now)
+
+	rclone.Init()
+	defer rclone.Close()
+	m, err := manifest.Read(*cfg.CatalogLocation, image)
+	if errors.Is(err, manifest.ErrNotFound) {
+		log.Printf("No manifest for %s; the image is not validated and the configured VPS settings are used", image)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	if m.Image != image {
+		return nil, fmt.Errorf("manifest %s describes image %s, not %s", manifest.Name(image), m.Image, image)
+	}
+	log.Printf("Read manifest %s: server %s (%s), tag %s of repository %s, run %s",
+		manifest.Name(image), m.Server.Name, m.Server.ID, m.DateTag, m.RepoName, m.RunID)
+	return m, nil
+}
 
-	created, err := vpsClient.Servers().Create(ctx, createReq)
+// applyManifest fills the VPS settings cfg leaves unset from m, when not
+// nil. Configured NICs replace the recorded ones as a whole.
+func applyManifest(cfg *config.Config, m *manifest.Manifest) {
+	if m == nil {
+		return
+	}
+	vs := config.VPSSetting{}
+	if cfg.VPSSetting != nil {
+		vs = *cfg.VPSSetting
+	}
+	if vs.FlavorID == "" {
+		vs.FlavorID = m.Server.FlavorID
+	}
+	if vs.KeypairID == "" {
+		vs.KeypairID = m.Server.KeypairID
+	}
+	if len(vs.NICs) == 0 {
+		// The recorded fixed IPs are usually still held by the source VM,
+		// so only the networks and security groups are reused.
+		vs.NICs = m.Server.ConfigNICs()
+		for i := range vs.NICs {
+			vs.NICs[i].FixedIP = ""
+		}
+	}
+	cfg.VPSSetting = &vs
+}
+
+// validateImage checks the image about to be uploaded against the size and
+// checksums recorded in m. The image is read from the CS bucket, where the
+// transfer has put it when there is one.
+func validateImage(cfg *config.Config, m *manifest.Manifest) error {
+	bucket := cfg.CatalogLocation
+	if cfg.TransferS3 && cfg.DstLocation != nil {
+		bucket = cfg.DstLocation
+	}
+	rclone.Init()
+	defer rclone.Close()
+	compared, err := m.Verify(*bucket, cfg.VerifyDownload)
 	if err != nil {
-		return fmt.Errorf("failed to create server: %w", err)
+		return fmt.Errorf("image %s failed validation: %w", m.Image, err)
 	}
+	if len(compared) == 0 {
+		log.Printf("warning: no checksum of %s to compare with its manifest; only its size was checked", m.Image)
+	} else {
+		log.Printf("Image %s matches its manifest (size, %s)", m.Image, strings.Join(compared, ", "))
+	}
+	return nil
+}
 
-	// Wait for the server to become active using SDK waiter.
-	serverID := created.ID
-	log.Printf("Waiting for server %s to become active...", serverID)
-	if err := vps.WaitForServerActive(ctx, vpsClient.Servers(), serverID); err != nil {
-		return fmt.Errorf("server %s did not become active: %w", serverID, err)
+// checkVPSSetting returns an error naming the VPS settings that are neither
+// configured nor recorded in a manifest.
+func checkVPSSetting(cfg *config.Config) error {
+	var missing []string
+	vs := cfg.VPSSetting
+	if vs == nil {
+		vs = &config.VPSSetting{}
+	}
+	if vs.FlavorID == "" {
+		missing = append(missing, "RESTORE_FLAVOR_ID")
+	}
+	if vs.KeypairID == "" {
+		missing = append(missing, "RESTORE_KEYPAIR_ID")
+	}
+	if len(vs.NICs) == 0 {
+		missing = append(missing, "RESTORE_NICS (or RESTORE_NETWORK_ID and RESTORE_SECURITYGROUP_ID)")
 	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no VM manifest provides the VPS settings; set %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
 
-	log.Printf("VM %s created successfully", vmName)
+// existingTag looks up the tag cfg.FromTag, checks that it is active and
+// records it in run in place of an upload. It returns the tag ID.
+func existingTag(ctx context.Context, vrmClient *vrm.Client, cfg *config.Config, run *state.Run) (string, error) {
+	tag, repoID, err := util.FindTag(ctx, vrmClient, cfg.FromTag)
+	if err != nil {
+		return "", err
+	}
+	if tag.Status != vrmcommon.TagStatusActive {
+		return "", fmt.Errorf("tag %s (%s) is %s, not active", cfg.FromTag, tag.ID, tag.Status)
+	}
+	log.Printf("Restoring from existing tag %s (%s); skipping transfer and upload", cfg.FromTag, tag.ID)
+
+	if err := run.Update(cfg.VMName, func(vm *state.VM) {
+		vm.RepoID = repoID
+		vm.TagID = tag.ID
+		vm.MarkDone(state.StageTagActive)
+	}); err != nil {
+		return "", err
+	}
+	return tag.ID, nil
+}
+
+// SelectImage lists the backup images named by the cfg.BackupRestoreImage
+// template in cfg.CatalogLocation, picks the one q selects by the time encoded
+// in its name and points cfg.BackupRestoreImage at it. Compressed backups in
+// the transfer source are listed by the names they are restored under; call
+// DetectCompression afterwards to restore the selected image.
+func SelectImage(cfg *config.Config, q catalog.Query) (catalog.Image, error) {
+	if cfg.CatalogLocation == nil {
+		return catalog.Image{}, fmt.Errorf("no bucket to list backups from; set RESTORE_TRANSFR_FROM_S3=true or RESTORE_CS_S3_ENDPOINT")
+	}
+
+	rclone.Init()
+	defer rclone.Close()
+
+	src := *cfg.CatalogLocation
+	if cfg.TransferS3 && cfg.CatalogLocation == cfg.SrcLocation {
+		dir, err := catalog.Dir(cfg.BackupRestoreImage)
+		if err != nil {
+			return catalog.Image{}, err
+		}
+		if src, _, err = decompressed(src, dir); err != nil {
+			return catalog.Image{}, err
+		}
+	}
+
+	images, err := catalog.List(src, cfg.BackupRestoreImage, cfg.Now.Location())
+	if err != nil {
+		return catalog.Image{}, fmt.Errorf("failed to list backup images: %w", err)
+	}
+	img, err := catalog.Select(images, q)
+	if err != nil {
+		return catalog.Image{}, err
+	}
+	cfg.BackupRestoreImage = img.Name
+	return img, nil
+}
+
+// DetectCompression switches cfg.SrcLocation, and cfg.CatalogLocation when it
+// is the same, to a decompressing view of the source when the backups in the
+// directory of the image to restore were compressed (BACKUP_DST_COMPRESS), so
+// that restores need not be told. With --at, --before or --latest it must run
+// after SelectImage, once the image is known. A source configured as
+// compressed is kept.
+func DetectCompression(cfg *config.Config) error {
+	if cfg.FromTag != "" || !cfg.TransferS3 || cfg.SrcLocation == nil {
+		return nil
+	}
+	dir := path.Dir(util.ImageName(cfg.BackupRestoreImage, cfg.Now))
+	if dir == "." {
+		dir = ""
+	}
+
+	rclone.Init()
+	defer rclone.Close()
+
+	loc, compressed, err := decompressed(*cfg.SrcLocation, dir)
+	if err != nil || !compressed {
+		return err
+	}
+	if cfg.CatalogLocation == cfg.SrcLocation {
+		cfg.CatalogLocation = &loc
+	}
+	cfg.SrcLocation = &loc
+	log.Printf("Backups in %s are compressed; they are decompressed while transferred", loc)
+	return nil
+}
+
+// decompressed returns the decompressing view of src when the objects
+// directly under dir were written compressed, and src otherwise. A location
+// that already is such a view is returned as is.
+func decompressed(src rclone.Location, dir string) (rclone.Location, bool, error) {
+	if src.Type == "compress" {
+		return src, false, nil
+	}
+	compressed, err := rclone.IsCompressed(src, dir)
+	if err != nil {
+		return src, false, fmt.Errorf("failed to detect compressed backups: %w", err)
+	}
+	if !compressed {
+		return src, false, nil
+	}
+	return src.Compress(rclone.DefaultCompressLevel), true, nil
+}
+
+// How long to wait for the transferred image to show up in the CS bucket.
+const (
+	objectWaitTimeout  = 5 * time.Minute
+	objectPollInterval = 5 * time.Second
+)
+
+// Transfer copies the image from the source S3 into the CS bucket and waits
+// until it is visible there.
+func Transfer(cfg *config.Config) error {
+	// Transfer the exported image from the source S3 to the CS bucket
+	if err := util.Transfer(cfg); err != nil {
+		return fmt.Errorf("failed to transfer exported image: %w", err)
+	}
+
+	fileName := util.ImageName(cfg.BackupRestoreImage, cfg.Now)
+	if err := rclone.WaitForObject(*cfg.DstLocation, fileName, objectWaitTimeout, objectPollInterval); err != nil {
+		return fmt.Errorf("destination object not ready: %w", err)
+	}
+
+	log.Println("Transferred exported snapshot to destination S3 successfully")
 	return nil
 }
@@ -1,10 +1,14 @@
 package restore
 
 import (
+	"context"
+	"errors"
 	"os"
 	"testing"
 	"time"
 
+	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/retention"
 	util "nchc-vmbr/internal/util"
 )
 
@@ -216,6 +220,22 @@ func TestLoadConfigFromEnv_TagNumParsing(t *testing.T) {
 	if cfg.TagNum != 7 {
 		t.Fatalf("expected TagNum to be 7, got %d", cfg.TagNum)
 	}
+	if !cfg.Retention.IsZero() {
+		t.Fatalf("expected no retention policy by default, got %+v", cfg.Retention)
+	}
+
+	os.Setenv("RESTORE_RETENTION", "daily=7,monthly=3")
+	defer os.Unsetenv("RESTORE_RETENTION")
+	if cfg, err = LoadConfigFromEnv(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if want := (retention.Policy{Daily: 7, Monthly: 3}); cfg.Retention != want {
+		t.Fatalf("expected %+v, got %+v", want, cfg.Retention)
+	}
+	os.Setenv("RESTORE_RETENTION", "hourly=24")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for invalid RESTORE_RETENTION")
+	}
 }
 
 func TestLoadConfigFromEnv_TransferDefaultFalse(t *testing.T) {
@@ -253,8 +273,8 @@ func TestLoadConfigFromEnv_TransferDefaultFalse(t *testing.T) {
 	if cfg.TransferS3 != false {
 		t.Fatalf("expected TransferS3 to be false by default, got %v", cfg.TransferS3)
 	}
-	if cfg.SrcS3Cfg != nil || cfg.DstS3Cfg != nil {
-		t.Fatalf("expected S3 configs to be nil when transfer disabled, got %+v %+v", cfg.SrcS3Cfg, cfg.DstS3Cfg)
+	if cfg.SrcLocation != nil || cfg.DstLocation != nil {
+		t.Fatalf("expected S3 configs to be nil when transfer disabled, got %+v %+v", cfg.SrcLocation, cfg.DstLocation)
 	}
 }
 
@@ -313,11 +333,107 @@ func TestLoadConfigFromEnv_TransferEnabled(t *testing.T) {
 	if cfg.TransferS3 != true {
 		t.Fatalf("expected TransferS3 to be true, got %v", cfg.TransferS3)
 	}
-	if cfg.SrcS3Cfg == nil || cfg.DstS3Cfg == nil {
-		t.Fatalf("expected S3 configs to be initialized when transfer enabled, got %+v %+v", cfg.SrcS3Cfg, cfg.DstS3Cfg)
+	if cfg.SrcLocation == nil || cfg.DstLocation == nil {
+		t.Fatalf("expected S3 configs to be initialized when transfer enabled, got %+v %+v", cfg.SrcLocation, cfg.DstLocation)
+	}
+	if cfg.SrcLocation.Root != "src-bucket" || cfg.DstLocation.Root != "dst-bucket" {
+		t.Fatalf("unexpected bucket values: %+v %+v", cfg.SrcLocation, cfg.DstLocation)
+	}
+}
+
+func TestLoadTransferConfigFromEnv(t *testing.T) {
+	// Only the locations and the image are needed; no API or VPS settings.
+	os.Setenv("RESTORE_IMAGE", "{{.Project}}/backup-%Y-%m-%d.img")
+	defer os.Unsetenv("RESTORE_IMAGE")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+
+	os.Setenv("RESTORE_SRC_S3_ENDPOINT", "https://src.example.com")
+	defer os.Unsetenv("RESTORE_SRC_S3_ENDPOINT")
+	os.Setenv("RESTORE_SRC_S3_ACCESS_KEY", "src-access")
+	defer os.Unsetenv("RESTORE_SRC_S3_ACCESS_KEY")
+	os.Setenv("RESTORE_SRC_S3_SECRET_KEY", "src-secret")
+	defer os.Unsetenv("RESTORE_SRC_S3_SECRET_KEY")
+	os.Setenv("RESTORE_SRC_S3_BUCKET", "src-bucket")
+	defer os.Unsetenv("RESTORE_SRC_S3_BUCKET")
+	os.Setenv("RESTORE_DST_S3_ENDPOINT", "https://dst.example.com")
+	defer os.Unsetenv("RESTORE_DST_S3_ENDPOINT")
+	os.Setenv("RESTORE_DST_S3_ACCESS_KEY", "dst-access")
+	defer os.Unsetenv("RESTORE_DST_S3_ACCESS_KEY")
+	os.Setenv("RESTORE_DST_S3_SECRET_KEY", "dst-secret")
+	defer os.Unsetenv("RESTORE_DST_S3_SECRET_KEY")
+	os.Setenv("RESTORE_DST_S3_BUCKET", "dst-bucket")
+	defer os.Unsetenv("RESTORE_DST_S3_BUCKET")
+
+	cfg, err := LoadTransferConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !cfg.TransferS3 || cfg.SrcLocation == nil || cfg.DstLocation == nil {
+		t.Fatalf("expected transfer to be configured, got %+v", cfg)
+	}
+	if cfg.SrcLocation.Root != "src-bucket" || cfg.DstLocation.Root != "dst-bucket" {
+		t.Fatalf("unexpected bucket values: %+v %+v", cfg.SrcLocation, cfg.DstLocation)
 	}
-	if cfg.SrcS3Cfg.Bucket != "src-bucket" || cfg.DstS3Cfg.Bucket != "dst-bucket" {
-		t.Fatalf("unexpected bucket values: %+v %+v", cfg.SrcS3Cfg, cfg.DstS3Cfg)
+	if cfg.CatalogLocation != cfg.SrcLocation {
+		t.Fatalf("expected backups to be listed in the source, got %+v", cfg.CatalogLocation)
+	}
+	if cfg.BackupRestoreImage != "proj-123/backup-%Y-%m-%d.img" {
+		t.Fatalf("unexpected image template: %s", cfg.BackupRestoreImage)
+	}
+}
+
+func TestLoadConfigFromEnv_CatalogS3(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "http")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("RESTORE_REPO", "rocky")
+	defer os.Unsetenv("RESTORE_REPO")
+	os.Setenv("RESTORE_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("RESTORE_CS_BUCKET")
+	os.Setenv("RESTORE_IMAGE", "backup-%Y-%m-%d.img")
+	defer os.Unsetenv("RESTORE_IMAGE")
+	os.Setenv("RESTORE_FLAVOR_ID", "flavor-1")
+	defer os.Unsetenv("RESTORE_FLAVOR_ID")
+	os.Setenv("RESTORE_NETWORK_ID", "net-1")
+	defer os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Setenv("RESTORE_KEYPAIR_ID", "kp-1")
+	defer os.Unsetenv("RESTORE_KEYPAIR_ID")
+	os.Setenv("RESTORE_SECURITYGROUP_ID", "sg-1")
+	defer os.Unsetenv("RESTORE_SECURITYGROUP_ID")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.CatalogLocation != nil {
+		t.Fatalf("expected no catalog without S3 configuration, got %+v", cfg.CatalogLocation)
+	}
+
+	// Without a transfer the CS bucket is listed through its S3 endpoint.
+	os.Setenv("RESTORE_CS_S3_ENDPOINT", "https://cs.example.com")
+	defer os.Unsetenv("RESTORE_CS_S3_ENDPOINT")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error when the CS S3 credentials are missing")
+	}
+	os.Setenv("RESTORE_CS_S3_ACCESS_KEY", "ak")
+	defer os.Unsetenv("RESTORE_CS_S3_ACCESS_KEY")
+	os.Setenv("RESTORE_CS_S3_SECRET_KEY", "sk")
+	defer os.Unsetenv("RESTORE_CS_S3_SECRET_KEY")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.CatalogLocation == nil || cfg.CatalogLocation.Root != "my-bucket" || cfg.CatalogLocation.Endpoint() != "https://cs.example.com" {
+		t.Fatalf("unexpected catalog location: %+v", cfg.CatalogLocation)
+	}
+	if cfg.DstLocation != nil {
+		t.Fatalf("expected no destination S3 config without a transfer")
 	}
 }
 
@@ -357,3 +473,258 @@ func TestTransfer_ReturnsErrorWhenNotConfigured(t *testing.T) {
 		t.Fatalf("expected error when calling Transfer while not configured, got nil")
 	}
 }
+
+func TestLoadConfigFromEnv_Rebuild(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "http")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("RESTORE_REPO", "rocky")
+	defer os.Unsetenv("RESTORE_REPO")
+	os.Setenv("RESTORE_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("RESTORE_CS_BUCKET")
+	os.Setenv("RESTORE_IMAGE", "backup.img")
+	defer os.Unsetenv("RESTORE_IMAGE")
+	// The flavor, network, keypair and security group of the rebuilt
+	// server are reused, so they are not required.
+	os.Unsetenv("RESTORE_FLAVOR_ID")
+	os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Unsetenv("RESTORE_KEYPAIR_ID")
+	os.Unsetenv("RESTORE_SECURITYGROUP_ID")
+	os.Setenv("RESTORE_REBUILD_VM", "web-01")
+	defer os.Unsetenv("RESTORE_REBUILD_VM")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.RebuildServer != "web-01" {
+		t.Fatalf("expected RebuildServer web-01, got %q", cfg.RebuildServer)
+	}
+	if cfg.ConfirmRebuild {
+		t.Fatalf("expected the rebuild not to be confirmed by the environment")
+	}
+
+	// Without the confirmation nothing is touched, not even the state dir.
+	cfg.StateDir = t.TempDir()
+	if err := Run(context.Background(), cfg); !errors.Is(err, ErrRebuildNotConfirmed) {
+		t.Fatalf("expected ErrRebuildNotConfirmed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(cfg.StateDir); len(entries) != 0 {
+		t.Fatalf("expected no state file, got %d entries", len(entries))
+	}
+}
+
+func TestLoadConfigFromEnv_FromTag(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "http")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	// Nothing is uploaded, so the repository, bucket and image are optional.
+	os.Unsetenv("RESTORE_REPO")
+	os.Unsetenv("RESTORE_CS_BUCKET")
+	os.Unsetenv("RESTORE_IMAGE")
+	os.Setenv("RESTORE_FLAVOR_ID", "flavor-1")
+	defer os.Unsetenv("RESTORE_FLAVOR_ID")
+	os.Setenv("RESTORE_NETWORK_ID", "net-1")
+	defer os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Setenv("RESTORE_KEYPAIR_ID", "kp-1")
+	defer os.Unsetenv("RESTORE_KEYPAIR_ID")
+	os.Setenv("RESTORE_SECURITYGROUP_ID", "sg-1")
+	defer os.Unsetenv("RESTORE_SECURITYGROUP_ID")
+	os.Setenv("RESTORE_FROM_TAG", "web-01-backups:2025-11-22-10-18")
+	defer os.Unsetenv("RESTORE_FROM_TAG")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.FromTag != "web-01-backups:2025-11-22-10-18" || cfg.RepoName != "web-01-backups" {
+		t.Fatalf("unexpected FromTag %q / RepoName %q", cfg.FromTag, cfg.RepoName)
+	}
+
+	os.Setenv("RESTORE_FROM_TAG", "web-01-backups")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for a reference without a version")
+	}
+}
+
+func TestLoadConfigFromEnv_NICs(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "http")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("RESTORE_REPO", "rocky")
+	defer os.Unsetenv("RESTORE_REPO")
+	os.Setenv("RESTORE_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("RESTORE_CS_BUCKET")
+	os.Setenv("RESTORE_IMAGE", "backup.img")
+	defer os.Unsetenv("RESTORE_IMAGE")
+	os.Setenv("RESTORE_FLAVOR_ID", "flavor-1")
+	defer os.Unsetenv("RESTORE_FLAVOR_ID")
+	os.Setenv("RESTORE_KEYPAIR_ID", "kp-1")
+	defer os.Unsetenv("RESTORE_KEYPAIR_ID")
+	// RESTORE_NICS replaces RESTORE_NETWORK_ID and RESTORE_SECURITYGROUP_ID.
+	os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Unsetenv("RESTORE_SECURITYGROUP_ID")
+	os.Setenv("RESTORE_NICS", "network=net-1,sg=sg-1,sg=sg-2;network=net-2,sg=sg-3,ip=192.168.10.20")
+	defer os.Unsetenv("RESTORE_NICS")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	nics := cfg.VPSSetting.NICs
+	if len(nics) != 2 || nics[0].NetworkID != "net-1" || len(nics[0].SGIDs) != 2 || nics[1].FixedIP != "192.168.10.20" {
+		t.Fatalf("unexpected NICs: %+v", nics)
+	}
+	reqs := nicRequests(nics)
+	if len(reqs) != 2 || reqs[1].NetworkID != "net-2" || reqs[1].SGIDs[0] != "sg-3" || reqs[1].FixedIP != "192.168.10.20" {
+		t.Fatalf("unexpected NIC requests: %+v", reqs)
+	}
+
+	// Without RESTORE_NICS the single network and security group are used.
+	os.Unsetenv("RESTORE_NICS")
+	os.Setenv("RESTORE_NETWORK_ID", "net-1")
+	defer os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Setenv("RESTORE_SECURITYGROUP_ID", "sg-1")
+	defer os.Unsetenv("RESTORE_SECURITYGROUP_ID")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	nics = cfg.VPSSetting.NICs
+	if len(nics) != 1 || nics[0].NetworkID != "net-1" || len(nics[0].SGIDs) != 1 || nics[0].SGIDs[0] != "sg-1" {
+		t.Fatalf("unexpected single NIC: %+v", nics)
+	}
+
+	os.Setenv("RESTORE_NICS", "sg=sg-1")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for a NIC without a network")
+	}
+}
+
+func TestLoadConfigFromEnv_ManifestDefaults(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "http")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("RESTORE_REPO", "rocky")
+	defer os.Unsetenv("RESTORE_REPO")
+	os.Setenv("RESTORE_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("RESTORE_CS_BUCKET")
+	os.Setenv("RESTORE_IMAGE", "backup.img")
+	defer os.Unsetenv("RESTORE_IMAGE")
+	os.Setenv("RESTORE_CS_S3_ENDPOINT", "https://cs.example.com")
+	defer os.Unsetenv("RESTORE_CS_S3_ENDPOINT")
+	os.Setenv("RESTORE_CS_S3_ACCESS_KEY", "ak")
+	defer os.Unsetenv("RESTORE_CS_S3_ACCESS_KEY")
+	os.Setenv("RESTORE_CS_S3_SECRET_KEY", "sk")
+	defer os.Unsetenv("RESTORE_CS_S3_SECRET_KEY")
+
+	// With S3 access to the CS bucket the VPS settings may come from the
+	// manifest, so none of them is required up front.
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := checkVPSSetting(cfg); err == nil {
+		t.Fatalf("expected error when neither the environment nor a manifest provides the VPS settings")
+	}
+	cfg.VPSSetting.FlavorID = "flavor-1"
+	cfg.VPSSetting.KeypairID = "kp-1"
+	cfg.VPSSetting.NICs = []config.NIC{{NetworkID: "net-1"}}
+	if err := checkVPSSetting(cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// A network without its security groups is still rejected.
+	os.Setenv("RESTORE_NETWORK_ID", "net-1")
+	defer os.Unsetenv("RESTORE_NETWORK_ID")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error when RESTORE_SECURITYGROUP_ID is missing")
+	}
+
+	// Restoring from a tag has no manifest to read.
+	os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Setenv("RESTORE_FROM_TAG", "rocky:v1")
+	defer os.Unsetenv("RESTORE_FROM_TAG")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error when restoring from a tag without VPS settings")
+	}
+}
+
+func TestLoadConfigFromEnv_HealthCheck(t *testing.T) {
+	os.Setenv("API_PROTOCOL", "http")
+	defer os.Unsetenv("API_PROTOCOL")
+	os.Setenv("API_HOST", "api.example.com")
+	defer os.Unsetenv("API_HOST")
+	os.Setenv("API_TOKEN", "test-token")
+	defer os.Unsetenv("API_TOKEN")
+	os.Setenv("PROJECT_SYS_CODE", "proj-123")
+	defer os.Unsetenv("PROJECT_SYS_CODE")
+	os.Setenv("RESTORE_REPO", "rocky")
+	defer os.Unsetenv("RESTORE_REPO")
+	os.Setenv("RESTORE_CS_BUCKET", "my-bucket")
+	defer os.Unsetenv("RESTORE_CS_BUCKET")
+	os.Setenv("RESTORE_IMAGE", "backup.img")
+	defer os.Unsetenv("RESTORE_IMAGE")
+	os.Setenv("RESTORE_FLAVOR_ID", "flavor-1")
+	defer os.Unsetenv("RESTORE_FLAVOR_ID")
+	os.Setenv("RESTORE_NETWORK_ID", "net-1")
+	defer os.Unsetenv("RESTORE_NETWORK_ID")
+	os.Setenv("RESTORE_KEYPAIR_ID", "kp-1")
+	defer os.Unsetenv("RESTORE_KEYPAIR_ID")
+	os.Setenv("RESTORE_SECURITYGROUP_ID", "sg-1")
+	defer os.Unsetenv("RESTORE_SECURITYGROUP_ID")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.HealthCheck.Enabled() {
+		t.Fatalf("expected no health checks by default, got %+v", cfg.HealthCheck)
+	}
+
+	os.Setenv("RESTORE_HEALTH_TCP_PORT", "22")
+	defer os.Unsetenv("RESTORE_HEALTH_TCP_PORT")
+	os.Setenv("RESTORE_HEALTH_HTTP_URL", "http://{{.IP}}:8080/healthz")
+	defer os.Unsetenv("RESTORE_HEALTH_HTTP_URL")
+	os.Setenv("RESTORE_HEALTH_TIMEOUT", "5m")
+	defer os.Unsetenv("RESTORE_HEALTH_TIMEOUT")
+	os.Setenv("RESTORE_HEALTH_DELETE_ON_FAILURE", "true")
+	defer os.Unsetenv("RESTORE_HEALTH_DELETE_ON_FAILURE")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	hc := cfg.HealthCheck
+	if hc.TCPPort != 22 || hc.HTTPURL != "http://{{.IP}}:8080/healthz" || hc.Timeout != 5*time.Minute || !hc.DeleteOnFailure {
+		t.Fatalf("unexpected health checks: %+v", hc)
+	}
+
+	for env, bad := range map[string]string{"RESTORE_HEALTH_TCP_PORT": "70000", "RESTORE_HEALTH_TIMEOUT": "soon"} {
+		good := os.Getenv(env)
+		os.Setenv(env, bad)
+		if _, err := LoadConfigFromEnv(); err == nil {
+			t.Fatalf("expected error for %s=%s", env, bad)
+		}
+		os.Setenv(env, good)
+	}
+}
@@ -0,0 +1,178 @@
+// Package retention implements a grandfather-father-son retention policy:
+// keep the newest backup of each of the last N days, weeks, months and years.
+// It works on plain (ID, time) items so that the same policy can prune VRM
+// tags and S3 backup objects.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
+
+	"nchc-vmbr/internal/rclone"
+)
+
+// Policy is the number of backups kept per period. Last keeps the newest
+// backups regardless of their age; the other rules keep the newest backup of
+// each of the most recent days, ISO weeks, months and years that have one.
+// A backup kept by any rule is kept.
+type Policy struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// IsZero reports whether p keeps nothing, i.e. no policy is configured.
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+func (p Policy) String() string {
+	var parts []string
+	for _, r := range p.rules() {
+		if r.n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", r.name, r.n))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParsePolicy parses a policy such as "daily=7,weekly=4,monthly=12,yearly=2".
+// An empty string yields the zero Policy.
+func ParsePolicy(s string) (Policy, error) {
+	var p Policy
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return Policy{}, fmt.Errorf("invalid retention rule %q (want period=count)", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return Policy{}, fmt.Errorf("invalid count in retention rule %q", item)
+		}
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "last":
+			p.Last = n
+		case "daily":
+			p.Daily = n
+		case "weekly":
+			p.Weekly = n
+		case "monthly":
+			p.Monthly = n
+		case "yearly":
+			p.Yearly = n
+		default:
+			return Policy{}, fmt.Errorf("unknown retention period %q (want last, daily, weekly, monthly or yearly)", k)
+		}
+	}
+	return p, nil
+}
+
+// Item is a backup subject to the policy.
+type Item struct {
+	ID   string
+	Name string
+	Time time.Time
+}
+
+// Decision is the verdict for one item. Reasons lists the rules that keep it.
+type Decision struct {
+	Item    Item
+	Keep    bool
+	Reasons []string
+}
+
+type rule struct {
+	name string
+	n    int
+	key  func(t time.Time) string
+}
+
+func (p Policy) rules() []rule {
+	return []rule{
+		{"last", p.Last, nil},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// Apply classifies items into the policy's periods, using their time in loc,
+// and returns one decision per item ordered newest first.
+func Apply(p Policy, items []Item, loc *time.Location) []Decision {
+	if loc == nil {
+		loc = time.Local
+	}
+	decisions := make([]Decision, len(items))
+	for i, it := range items {
+		decisions[i] = Decision{Item: it}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool { return decisions[i].Item.Time.After(decisions[j].Item.Time) })
+
+	for _, r := range p.rules() {
+		kept, lastKey := 0, ""
+		for i := range decisions {
+			if kept >= r.n {
+				break
+			}
+			if r.key != nil {
+				key := r.key(decisions[i].Item.Time.In(loc))
+				if key == lastKey {
+					continue
+				}
+				lastKey = key
+			}
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, r.name)
+			kept++
+		}
+	}
+	return decisions
+}
+
+// Select returns the items p deletes, oldest first.
+func Select(p Policy, items []Item, loc *time.Location) []Item {
+	var del []Item
+	decisions := Apply(p, items, loc)
+	for i := len(decisions) - 1; i >= 0; i-- {
+		if !decisions[i].Keep {
+			del = append(del, decisions[i].Item)
+		}
+	}
+	return del
+}
+
+// FromTags converts VRM tags into items keyed by tag ID.
+func FromTags(tags []*vrmtags.Tag) []Item {
+	items := make([]Item, 0, len(tags))
+	for _, t := range tags {
+		if t == nil || t.ID == "" {
+			continue
+		}
+		items = append(items, Item{ID: t.ID, Name: t.Name, Time: t.CreatedAt})
+	}
+	return items
+}
+
+// FromObjects converts stored objects into items keyed by object path.
+func FromObjects(objects []rclone.Object) []Item {
+	items := make([]Item, 0, len(objects))
+	for _, o := range objects {
+		items = append(items, Item{ID: o.Path, Name: o.Name, Time: o.ModTime})
+	}
+	return items
+}
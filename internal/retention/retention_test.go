@@ -0,0 +1,152 @@
+package retention
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
+
+	"nchc-vmbr/internal/rclone"
+)
+
+var taipei = time.FixedZone("UTC+8", 8*3600)
+
+// dailyTags returns one tag per day at 02:00 local time, newest on end.
+func dailyTags(end time.Time, days int) []*vrmtags.Tag {
+	var tags []*vrmtags.Tag
+	for i := days - 1; i >= 0; i-- {
+		t := end.AddDate(0, 0, -i)
+		tags = append(tags, &vrmtags.Tag{ID: t.Format("2006-01-02"), Name: t.Format("2006-01-02-15-04"), CreatedAt: t.UTC()})
+	}
+	return tags
+}
+
+func keptIDs(decisions []Decision) map[string]bool {
+	kept := make(map[string]bool)
+	for _, d := range decisions {
+		if d.Keep {
+			kept[d.Item.ID] = true
+		}
+	}
+	return kept
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("daily=7, weekly=4,monthly=12,yearly=2")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := Policy{Daily: 7, Weekly: 4, Monthly: 12, Yearly: 2}
+	if p != want {
+		t.Fatalf("expected %+v, got %+v", want, p)
+	}
+	if p.String() != "daily=7,weekly=4,monthly=12,yearly=2" {
+		t.Fatalf("unexpected String(): %s", p.String())
+	}
+
+	if p, err := ParsePolicy(""); err != nil || !p.IsZero() {
+		t.Fatalf("expected zero policy for empty string, got %+v (%v)", p, err)
+	}
+	for _, bad := range []string{"daily", "daily=x", "daily=-1", "hourly=3"} {
+		if _, err := ParsePolicy(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestApply_GFS(t *testing.T) {
+	// Two years of daily backups ending Sunday 2025-11-23.
+	end := time.Date(2025, 11, 23, 2, 0, 0, 0, taipei)
+	items := FromTags(dailyTags(end, 730))
+	p := Policy{Daily: 7, Weekly: 4, Monthly: 12, Yearly: 2}
+
+	decisions := Apply(p, items, taipei)
+	if len(decisions) != 730 {
+		t.Fatalf("expected one decision per item, got %d", len(decisions))
+	}
+	if decisions[0].Item.ID != "2025-11-23" {
+		t.Fatalf("expected decisions newest first, got %s", decisions[0].Item.ID)
+	}
+	kept := keptIDs(decisions)
+
+	// The 7 most recent days.
+	for i := 0; i < 7; i++ {
+		id := end.AddDate(0, 0, -i).Format("2006-01-02")
+		if !kept[id] {
+			t.Fatalf("expected daily backup %s to be kept", id)
+		}
+	}
+	// The newest backup of each of the 4 most recent ISO weeks (Sundays).
+	for _, id := range []string{"2025-11-16", "2025-11-09", "2025-11-02"} {
+		if !kept[id] {
+			t.Fatalf("expected weekly backup %s to be kept", id)
+		}
+	}
+	// The last day of each of the 12 most recent months.
+	for _, id := range []string{"2025-10-31", "2025-01-31", "2024-12-31"} {
+		if !kept[id] {
+			t.Fatalf("expected monthly backup %s to be kept", id)
+		}
+	}
+	if kept["2024-11-30"] {
+		t.Fatalf("did not expect the 13th month to be kept")
+	}
+	// Yearly: 2025 (newest overall) and 2024-12-31; the oldest 2023 backups go.
+	if kept["2023-12-31"] || kept["2023-11-25"] {
+		t.Fatalf("did not expect 2023 backups to be kept")
+	}
+
+	// 7 daily + 3 more weeks + 11 earlier months (the 12th month is November,
+	// already kept) + 0 extra years = 21 backups.
+	if len(kept) != 21 {
+		t.Fatalf("expected 21 backups to be kept, got %d", len(kept))
+	}
+
+	del := Select(p, items, taipei)
+	if len(del) != 730-21 {
+		t.Fatalf("expected %d deletions, got %d", 730-21, len(del))
+	}
+	if del[0].ID != "2023-11-25" {
+		t.Fatalf("expected deletions oldest first, got %s", del[0].ID)
+	}
+}
+
+func TestApply_Timezone(t *testing.T) {
+	// 2025-11-22T17:00Z and 2025-11-22T15:00Z are different days in UTC+8
+	// (Nov 23 01:00 and Nov 22 23:00) but the same day in UTC.
+	items := []Item{
+		{ID: "late", Time: time.Date(2025, 11, 22, 17, 0, 0, 0, time.UTC)},
+		{ID: "early", Time: time.Date(2025, 11, 22, 15, 0, 0, 0, time.UTC)},
+	}
+	p := Policy{Daily: 2}
+	if got := len(keptIDs(Apply(p, items, taipei))); got != 2 {
+		t.Fatalf("expected both backups kept in UTC+8, got %d", got)
+	}
+	if got := len(keptIDs(Apply(p, items, time.UTC))); got != 1 {
+		t.Fatalf("expected one backup kept in UTC, got %d", got)
+	}
+}
+
+func TestApply_LastAndReasons(t *testing.T) {
+	end := time.Date(2025, 11, 23, 2, 0, 0, 0, taipei)
+	var items []Item
+	for i := 0; i < 5; i++ {
+		items = append(items, Item{ID: fmt.Sprint(i), Time: end.Add(-time.Duration(i) * time.Hour)})
+	}
+	decisions := Apply(Policy{Last: 2, Daily: 1}, items, taipei)
+	if len(keptIDs(decisions)) != 2 {
+		t.Fatalf("expected 2 backups kept, got %+v", decisions)
+	}
+	if r := decisions[0].Reasons; len(r) != 2 || r[0] != "last" || r[1] != "daily" {
+		t.Fatalf("unexpected reasons for newest backup: %v", r)
+	}
+}
+
+func TestFromObjects(t *testing.T) {
+	mod := time.Date(2025, 11, 22, 10, 0, 0, 0, time.UTC)
+	items := FromObjects([]rclone.Object{{Path: "dir/a.img", Name: "a.img", ModTime: mod}})
+	if len(items) != 1 || items[0].ID != "dir/a.img" || !items[0].Time.Equal(mod) {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+}
@@ -0,0 +1,244 @@
+// Package state checkpoints backup and restore runs in a local JSON file so
+// that an interrupted run can be resumed at its first incomplete stage.
+package state
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultDir is where run state files are kept when STATE_DIR is not set.
+const DefaultDir = ".vmbr-state"
+
+// Run kinds.
+const (
+	KindBackup  = "backup"
+	KindRestore = "restore"
+)
+
+// Stage is one checkpointed step of a backup or restore pipeline.
+type Stage string
+
+// Backup stages, in pipeline order.
+const (
+	StageSnapshot     Stage = "snapshot"
+	StageTagAvailable Stage = "tag-available"
+	StageExport       Stage = "export"
+	// StageManifest is the VM manifest written next to the exported image.
+	StageManifest Stage = "manifest"
+	StageTransfer Stage = "transfer"
+	// StagePrune is the deletion of old tags once the new tag is ready; it
+	// only runs in the prune-after-success mode, for restores as well.
+	StagePrune Stage = "prune"
+)
+
+// Restore stages, in pipeline order. The restore pipeline starts with
+// StageTransfer as well.
+const (
+	StageUpload       Stage = "upload"
+	StageTagActive    Stage = "tag-active"
+	StageServerCreate Stage = "server-create"
+	StageServerActive Stage = "server-active"
+	// StageHealthCheck is the optional check that the VM has booted; it runs
+	// last, after StageReattach when rebuilding.
+	StageHealthCheck Stage = "health-check"
+)
+
+// Rebuild stages: a restore that rebuilds an existing server deletes it
+// before StageServerCreate and reattaches its data volumes and floating IPs
+// to the new server after StageServerActive.
+const (
+	StageServerDelete Stage = "server-delete"
+	StageReattach     Stage = "reattach"
+)
+
+// VM is the recorded progress of one VM within a run. Backups record the
+// source server, restores the created server and the restored image; both
+// record the VRM tag. A restore from an existing tag records its reference
+// instead of an image, and a rebuilding restore the server it replaces.
+type VM struct {
+	VMID     string              `json:"vm_id,omitempty"`
+	RepoID   string              `json:"repo_id,omitempty"`
+	TagID    string              `json:"tag_id,omitempty"`
+	ServerID string              `json:"server_id,omitempty"`
+	Image    string              `json:"image,omitempty"`
+	FromTag  string              `json:"from_tag,omitempty"`
+	Replaced *Server             `json:"replaced,omitempty"`
+	Stages   map[Stage]time.Time `json:"stages,omitempty"`
+}
+
+// Server is the configuration of a server replaced by a restore. It is
+// recorded before the server is deleted so that a resumed run can still
+// recreate it.
+type Server struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	FlavorID    string   `json:"flavor_id"`
+	KeypairID   string   `json:"keypair_id,omitempty"`
+	NICs        []NIC    `json:"nics"`
+	VolumeIDs   []string `json:"volume_ids,omitempty"`
+}
+
+// NIC is a network interface of a replaced server.
+type NIC struct {
+	NetworkID    string   `json:"network_id"`
+	SGIDs        []string `json:"sg_ids,omitempty"`
+	FixedIP      string   `json:"fixed_ip,omitempty"`
+	FloatingIPID string   `json:"floating_ip_id,omitempty"`
+}
+
+// Done reports whether stage has completed.
+func (v VM) Done(stage Stage) bool {
+	_, ok := v.Stages[stage]
+	return ok
+}
+
+// Run is the state of one backup or restore run. Now and DateTag are kept so
+// that a resumed run derives the same image names and tag versions as the
+// original one. A Run is safe for concurrent use.
+type Run struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Now     time.Time `json:"now"`
+	DateTag string    `json:"date_tag"`
+	// VMs holds the progress of each VM, keyed by server ID for backups,
+	// as names may be shared, and by the name of the VM created for restores.
+	VMs map[string]*VM `json:"vms"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// Open starts a new run in dir, or resumes the run id when id is not empty.
+// now and dateTag are only used for a new run.
+func Open(dir, kind, id string, now time.Time, dateTag string) (*Run, error) {
+	if id == "" {
+		return New(dir, kind, now, dateTag)
+	}
+	r, err := Load(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Kind != kind {
+		return nil, fmt.Errorf("run %s is a %s run, not %s", id, r.Kind, kind)
+	}
+	return r, nil
+}
+
+// New creates a run with a fresh ID and writes its state file to dir.
+func New(dir, kind string, now time.Time, dateTag string) (*Run, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate run ID: %w", err)
+	}
+	id := fmt.Sprintf("%s-%s-%s", kind, now.Format("20060102-150405"), hex.EncodeToString(suffix))
+	r := &Run{
+		ID:      id,
+		Kind:    kind,
+		Now:     now,
+		DateTag: dateTag,
+		VMs:     make(map[string]*VM),
+		path:    filepath.Join(dir, id+".json"),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load reads the state of run id from dir.
+func Load(dir, id string) (*Run, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid run ID %q", id)
+	}
+	p := filepath.Join(dir, id+".json")
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state of run %s: %w", id, err)
+	}
+	r := &Run{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", p, err)
+	}
+	if r.VMs == nil {
+		r.VMs = make(map[string]*VM)
+	}
+	r.path = p
+	return r, nil
+}
+
+// Path returns the location of the run's state file.
+func (r *Run) Path() string {
+	return r.path
+}
+
+// Get returns a copy of the recorded progress of the VM keyed by key.
+func (r *Run) Get(key string) VM {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vm, ok := r.VMs[key]
+	if !ok {
+		return VM{}
+	}
+	out := *vm
+	out.Stages = make(map[Stage]time.Time, len(vm.Stages))
+	for s, t := range vm.Stages {
+		out.Stages[s] = t
+	}
+	return out
+}
+
+// Update applies fn to the VM keyed by key and persists the state.
+func (r *Run) Update(key string, fn func(vm *VM)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vm, ok := r.VMs[key]
+	if !ok {
+		vm = &VM{}
+		r.VMs[key] = vm
+	}
+	fn(vm)
+	return r.save()
+}
+
+// Complete marks stage as done for the VM keyed by key and persists the state.
+func (r *Run) Complete(key string, stage Stage) error {
+	return r.Update(key, func(vm *VM) { vm.MarkDone(stage) })
+}
+
+// MarkDone records stage as completed now. Use it inside Update to persist a
+// stage together with the IDs it produced.
+func (v *VM) MarkDone(stage Stage) {
+	if v.Stages == nil {
+		v.Stages = make(map[Stage]time.Time)
+	}
+	v.Stages[stage] = time.Now()
+}
+
+// save writes the state file atomically. r.mu must be held.
+func (r *Run) save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run state: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2025, 11, 23, 10, 18, 0, 0, loc)
+
+	r, err := New(dir, KindBackup, now, "2025-11-23-10-18")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if !strings.HasPrefix(r.ID, "backup-20251123-101800-") {
+		t.Fatalf("unexpected run ID %s", r.ID)
+	}
+
+	if err := r.Update("web-01", func(vm *VM) {
+		vm.VMID = "server-1"
+		vm.TagID = "tag-1"
+		vm.MarkDone(StageSnapshot)
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := r.Complete("web-01", StageTagAvailable); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+
+	loaded, err := Open(dir, KindBackup, r.ID, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if !loaded.Now.Equal(now) || loaded.DateTag != "2025-11-23-10-18" {
+		t.Fatalf("run time not preserved: %v %s", loaded.Now, loaded.DateTag)
+	}
+	vm := loaded.Get("web-01")
+	if vm.VMID != "server-1" || vm.TagID != "tag-1" {
+		t.Fatalf("unexpected VM state: %+v", vm)
+	}
+	if !vm.Done(StageSnapshot) || !vm.Done(StageTagAvailable) || vm.Done(StageExport) {
+		t.Fatalf("unexpected stages: %+v", vm.Stages)
+	}
+	if loaded.Get("web-02").Done(StageSnapshot) {
+		t.Fatalf("expected unknown VM to have no completed stages")
+	}
+}
+
+func TestOpen_Errors(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir, KindRestore, time.Now(), "tag")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if _, err := Open(dir, KindBackup, r.ID, time.Time{}, ""); err == nil {
+		t.Fatalf("expected error when resuming a restore run as backup")
+	}
+	if _, err := Open(dir, KindRestore, "missing", time.Time{}, ""); err == nil {
+		t.Fatalf("expected error for unknown run ID")
+	}
+	if _, err := Load(dir, "../"+r.ID); err == nil {
+		t.Fatalf("expected error for run ID containing a path")
+	}
+}
+
+func TestReplacedServer(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir, KindRestore, time.Now(), "tag")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	spec := &Server{
+		ID:        "server-1",
+		Name:      "web-01",
+		FlavorID:  "flavor-1",
+		NICs:      []NIC{{NetworkID: "net-1", SGIDs: []string{"sg-1"}, FixedIP: "10.0.0.5", FloatingIPID: "fip-1"}},
+		VolumeIDs: []string{"data-1"},
+	}
+	if err := r.Update("restore-dst-vm", func(vm *VM) { vm.Replaced = spec }); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	loaded, err := Open(dir, KindRestore, r.ID, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got := loaded.Get("restore-dst-vm").Replaced
+	if got == nil || got.ID != "server-1" || len(got.NICs) != 1 || got.NICs[0].FloatingIPID != "fip-1" || got.VolumeIDs[0] != "data-1" {
+		t.Fatalf("replaced server not preserved: %+v", got)
+	}
+}
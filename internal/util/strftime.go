@@ -0,0 +1,170 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDateTagFormat is the strftime format of tag versions when
+// DATE_TAG_FORMAT is unset.
+const DefaultDateTagFormat = "%Y-%m-%d-%H-%M"
+
+// ErrNoMatch is returned by ParseStrftime when a string was not produced by
+// the given format.
+var ErrNoMatch = errors.New("does not match the strftime format")
+
+// strftimeToken is a supported strftime token. Most tokens have a Go layout
+// that formats and parses them; the others are formatted by format and,
+// except for %s, not parsed back. pattern matches the formatted value.
+type strftimeToken struct {
+	layout  string
+	format  func(time.Time) string
+	pattern string
+}
+
+// strftime-to-Go mappings, shared by ApplyStrftime and ParseStrftime.
+var strftimeMap = map[string]strftimeToken{
+	"%Y": {layout: "2006", pattern: `\d{4}`},
+	"%y": {layout: "06", pattern: `\d{2}`},
+	"%m": {layout: "01", pattern: `\d{2}`},
+	"%d": {layout: "02", pattern: `\d{2}`},
+	"%e": {layout: "_2", pattern: `[ \d]\d`},
+	"%j": {layout: "002", pattern: `\d{3}`},
+	"%H": {layout: "15", pattern: `\d{2}`},
+	"%I": {layout: "03", pattern: `\d{2}`},
+	"%M": {layout: "04", pattern: `\d{2}`},
+	"%S": {layout: "05", pattern: `\d{2}`},
+	"%p": {layout: "PM", pattern: `[AP]M`},
+	"%a": {layout: "Mon", pattern: `[A-Z][a-z]{2}`},
+	"%A": {layout: "Monday", pattern: `[A-Z][a-z]+`},
+	"%b": {layout: "Jan", pattern: `[A-Z][a-z]{2}`},
+	"%B": {layout: "January", pattern: `[A-Z][a-z]+`},
+	"%z": {layout: "-0700", pattern: `[+-]\d{4}`},
+	// The zone abbreviation is ambiguous, so the location passed to
+	// ParseStrftime is used instead.
+	"%Z": {format: func(t time.Time) string { return t.Format("MST") }, pattern: `[A-Za-z0-9+-]+`},
+	// Week of the year starting on Sunday (00-53) and ISO 8601 week (01-53).
+	"%U": {format: func(t time.Time) string {
+		return fmt.Sprintf("%02d", (t.YearDay()+6-int(t.Weekday()))/7)
+	}, pattern: `\d{2}`},
+	"%V": {format: func(t time.Time) string {
+		_, w := t.ISOWeek()
+		return fmt.Sprintf("%02d", w)
+	}, pattern: `\d{2}`},
+	"%s": {format: func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }, pattern: `-?\d+`},
+}
+
+// strftimePart is either a token of strftimeMap or a run of literal text.
+type strftimePart struct {
+	token   string
+	literal string
+}
+
+// splitStrftime splits format into tokens and literal text. Literal text,
+// digits included, is never interpreted as a Go layout; %% is a literal %
+// and an unknown %token is kept literally in quotes.
+func splitStrftime(format string) []strftimePart {
+	var parts []strftimePart
+	i := 0
+	for i < len(format) {
+		if format[i] == '%' && i+1 < len(format) {
+			tok := format[i : i+2]
+			if _, ok := strftimeMap[tok]; ok {
+				parts = append(parts, strftimePart{token: tok})
+			} else if tok == "%%" {
+				parts = append(parts, strftimePart{literal: "%"})
+			} else {
+				parts = append(parts, strftimePart{literal: "'" + tok + "'"})
+			}
+			i += 2
+			continue
+		}
+		// accumulate a run of literal chars until next '%'
+		start := i
+		i++
+		for i < len(format) && format[i] != '%' {
+			i++
+		}
+		parts = append(parts, strftimePart{literal: format[start:i]})
+	}
+	return parts
+}
+
+// ApplyStrftime formats t with a strftime-like format. Each token is
+// formatted on its own; the text between tokens is copied as is.
+func ApplyStrftime(format string, t time.Time) string {
+	var b strings.Builder
+	for _, p := range splitStrftime(format) {
+		if p.token == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		if tok := strftimeMap[p.token]; tok.format != nil {
+			b.WriteString(tok.format(t))
+		} else {
+			b.WriteString(t.Format(tok.layout))
+		}
+	}
+	return b.String()
+}
+
+// StrftimeRegexp returns an anchored regular expression matching every
+// string ApplyStrftime can produce for format. It has one capture group per
+// token.
+func StrftimeRegexp(format string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, p := range splitStrftime(format) {
+		if p.token == "" {
+			b.WriteString(regexp.QuoteMeta(p.literal))
+			continue
+		}
+		b.WriteString("(" + strftimeMap[p.token].pattern + ")")
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// ParseStrftime is the inverse of ApplyStrftime: it recovers the time in loc
+// encoded in s by format, e.g. 2025-11-22 from backup-2025-11-22.img and
+// backup-%Y-%m-%d.img. Fields missing from format take their zero value
+// (January 1st of year 0, midnight); %s, when present, determines the time
+// on its own. It returns an error wrapping ErrNoMatch when s was not
+// produced by format.
+func ParseStrftime(format, s string, loc *time.Location) (time.Time, error) {
+	m := StrftimeRegexp(format).FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("%q %w %q", s, ErrNoMatch, format)
+	}
+	// Let time.Parse validate and combine the captured fields, which are
+	// separated by a character none of the tokens produce.
+	var layouts, values []string
+	i := 1
+	for _, p := range splitStrftime(format) {
+		if p.token == "" {
+			continue
+		}
+		v := m[i]
+		i++
+		if p.token == "%s" {
+			sec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("%q is not a valid time for %q: %w", s, format, err)
+			}
+			return time.Unix(sec, 0).In(loc), nil
+		}
+		if tok := strftimeMap[p.token]; tok.format == nil {
+			layouts = append(layouts, tok.layout)
+			values = append(values, v)
+		}
+	}
+	t, err := time.ParseInLocation(strings.Join(layouts, "|"), strings.Join(values, "|"), loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a valid time for %q: %w", s, format, err)
+	}
+	return t, nil
+}
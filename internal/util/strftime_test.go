@@ -0,0 +1,151 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestApplyStrftime_LiteralDigits(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2025, 11, 23, 10, 18, 0, 0, loc)
+	in := "backup-%Y-%m-%d-%H-18.img"
+	got := ApplyStrftime(in, now)
+	want := "backup-2025-11-23-10-18.img"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestApplyStrftime_Default(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2025, 11, 23, 10, 18, 30, 0, loc)
+	in := "%Y-%m-%d-%H-%M"
+	got := ApplyStrftime(in, now)
+	want := "2025-11-23-10-18"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestStrftimeRegexp(t *testing.T) {
+	now := time.Date(2025, 11, 23, 10, 18, 5, 0, time.UTC)
+	for _, format := range []string{"%Y-%m-%d-%H-%M", "backup-%y%m%d.%S", "v1-%Y.img", "%Q-%d"} {
+		re := StrftimeRegexp(format)
+		if s := ApplyStrftime(format, now); !re.MatchString(s) {
+			t.Fatalf("expected %s to match %q (%s)", re, s, format)
+		}
+	}
+
+	re := StrftimeRegexp("%Y-%m-%d-%H-%M")
+	for _, s := range []string{"golden", "2025-11-23", "x2025-11-23-10-18", "2025-11-23-10-18.bak"} {
+		if re.MatchString(s) {
+			t.Fatalf("did not expect %q to match %s", s, re)
+		}
+	}
+}
+
+func TestParseStrftime(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	want := time.Date(2026, 10, 10, 2, 30, 0, 0, loc)
+	for _, format := range []string{"backup-%Y-%m-%d-%H-%M.img", "backup-%y%m%d%H%M.img"} {
+		got, err := ParseStrftime(format, ApplyStrftime(format, want), loc)
+		if err != nil {
+			t.Fatalf("ParseStrftime(%s) failed: %v", format, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("ParseStrftime(%s): expected %v, got %v", format, want, got)
+		}
+	}
+
+	got, err := ParseStrftime("backup-%Y-%m-%d.img", "backup-2026-10-10.img", loc)
+	if err != nil || !got.Equal(time.Date(2026, 10, 10, 0, 0, 0, 0, loc)) {
+		t.Fatalf("expected midnight of the day, got %v (%v)", got, err)
+	}
+	if _, err := ParseStrftime("backup-%Y-%m-%d.img", "other-2026-10-10.img", loc); !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected ErrNoMatch for a name that does not match, got %v", err)
+	}
+	if _, err := ParseStrftime("backup-%Y-%m-%d.img", "backup-2026-13-10.img", loc); err == nil || errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected invalid time error for month 13, got %v", err)
+	}
+}
+
+func TestStrftime_LiteralText(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2025, 11, 23, 10, 18, 0, 0, loc)
+	cases := map[string]string{
+		// Literal digits and text that looks like Go layouts stay as is.
+		"v1_%Y.img":           "v1_2025.img",
+		"Monthly-Jan-%m.img":  "Monthly-Jan-11.img",
+		"r2_%d-15-%H":         "r2_23-15-10",
+		"backup-%Q-%Y":        "backup-'%Q'-2025",
+		"100%":                "100%",
+		"%Y%m%d%H%M":          "202511231018",
+		"%y-01-%m/2006-%S.gz": "25-01-11/2006-00.gz",
+	}
+	for format, want := range cases {
+		got := ApplyStrftime(format, now)
+		if got != want {
+			t.Fatalf("ApplyStrftime(%q): expected %q, got %q", format, want, got)
+		}
+		if _, err := ParseStrftime(format, got, loc); err != nil {
+			t.Fatalf("ParseStrftime(%q, %q) failed: %v", format, got, err)
+		}
+	}
+
+	got, err := ParseStrftime("v1_%Y%m%d%H%M.img", "v1_202511231018.img", loc)
+	if err != nil || !got.Equal(now) {
+		t.Fatalf("expected %v, got %v (%v)", now, got, err)
+	}
+	if _, err := ParseStrftime("v1_%Y.img", "v2_2025.img", loc); !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected ErrNoMatch when a literal digit differs, got %v", err)
+	}
+}
+
+func TestApplyStrftime_Tokens(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	// Monday 2025-11-03 is the 307th day, in ISO week 45 and Sunday-based week 44.
+	now := time.Date(2025, 11, 3, 14, 5, 9, 0, loc)
+	cases := map[string]string{
+		"%j":       "307",
+		"%U":       "44",
+		"%V":       "45",
+		"%a %A":    "Mon Monday",
+		"%b %B":    "Nov November",
+		"%s":       "1762149909",
+		"%z %Z":    "+0800 CST",
+		"%I%p":     "02PM",
+		"[%e]":     "[ 3]",
+		"100%%-%d": "100%-03",
+	}
+	for format, want := range cases {
+		if got := ApplyStrftime(format, now); got != want {
+			t.Fatalf("ApplyStrftime(%q): expected %q, got %q", format, want, got)
+		}
+	}
+	if got := ApplyStrftime("%U", time.Date(2025, 1, 1, 0, 0, 0, 0, loc)); got != "00" {
+		t.Fatalf("expected days before the first Sunday in week 00, got %s", got)
+	}
+}
+
+func TestParseStrftime_Tokens(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	now := time.Date(2025, 11, 3, 14, 5, 9, 0, loc)
+	for _, format := range []string{
+		"%Y-%j-%H%M%S",
+		"%a %d %b %Y %I:%M:%S %p",
+		"%A, %B %e %Y %H:%M:%S %z",
+		"%Y-%m-%d %H:%M:%S %Z (week %V/%U)",
+		"snap-%s.img",
+		"100%%-%Y%m%d-%H%M%S",
+	} {
+		s := ApplyStrftime(format, now)
+		got, err := ParseStrftime(format, s, loc)
+		if err != nil {
+			t.Fatalf("ParseStrftime(%q, %q) failed: %v", format, s, err)
+		}
+		if !got.Equal(now) {
+			t.Fatalf("ParseStrftime(%q, %q): expected %v, got %v", format, s, now, got)
+		}
+	}
+}
@@ -2,93 +2,150 @@ package util
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"path"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	cloudsdk "github.com/Zillaforge/cloud-sdk"
+	vrmrepos "github.com/Zillaforge/cloud-sdk/models/vrm/repositories"
 	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
 	vrmcore "github.com/Zillaforge/cloud-sdk/modules/vrm/core"
 
 	config "nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/manifest"
 	rclone "nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
 )
 
-// strftime-to-Go mappings
-var strftimeMap = map[string]string{
-	"%Y": "2006",
-	"%y": "06",
-	"%m": "01",
-	"%d": "02",
-	"%H": "15",
-	"%M": "04",
-	"%S": "05",
-}
-
-// ApplyStrftime converts a strftime-like format into Go's time layout, and then formats the time.
-func ApplyStrftime(format string, t time.Time) string {
-	// Build the Go time layout from the strftime-like format by walking
-	// the string and substituting tokens while converting literal digit runs
-	// into placeholders so they won't be misinterpreted as Go layout tokens.
-	var b strings.Builder
-	i := 0
-	placeholderMap := make(map[string]string)
-	// generate alphabetic placeholders (Z, ZZ, ZZZ, ...)
-	var phIndex int
-	nextPlaceholder := func() string {
-		phIndex++
-		return fmt.Sprintf("__LIT_%s__", strings.Repeat("Z", phIndex))
-	}
-	digitRe := regexp.MustCompile(`\d+`)
-	for i < len(format) {
-		if format[i] == '%' && i+1 < len(format) {
-			tok := format[i : i+2]
-			if v, ok := strftimeMap[tok]; ok {
-				b.WriteString(v)
-				i += 2
-				continue
-			}
-			// unknown %token: write it literally (quote it)
-			b.WriteString("'" + tok + "'")
-			i += 2
+// Placeholders replaced in repository and image templates: the VM name and
+// ID, the project system code and the run ID.
+const (
+	VMPlaceholder      = "{{.VM}}"
+	VMIDPlaceholder    = "{{.VMID}}"
+	ProjectPlaceholder = "{{.Project}}"
+	RunIDPlaceholder   = "{{.RunID}}"
+)
+
+// TemplateVars holds the per-VM values substituted into name templates.
+type TemplateVars struct {
+	VM      string
+	VMID    string
+	Project string
+	RunID   string
+}
+
+// ApplyTemplate replaces the {{.VM}}, {{.VMID}}, {{.Project}} and {{.RunID}}
+// placeholders in format with vars. Placeholders whose value is empty, such
+// as the run ID of a dry run, are left as is. strftime tokens are left
+// untouched so the result can still be passed to ApplyStrftime or
+// BuildCSFilepath.
+func ApplyTemplate(format string, vars TemplateVars) string {
+	for _, r := range []struct{ placeholder, value string }{
+		{VMPlaceholder, vars.VM},
+		{VMIDPlaceholder, vars.VMID},
+		{ProjectPlaceholder, vars.Project},
+		{RunIDPlaceholder, vars.RunID},
+	} {
+		if r.value != "" {
+			format = strings.ReplaceAll(format, r.placeholder, r.value)
+		}
+	}
+	return format
+}
+
+// IsTrue reports whether v is a true-ish value (1, true, yes or y).
+func IsTrue(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
+
+// SplitList splits a comma-separated list, trimming whitespace and dropping
+// empty entries.
+func SplitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// ParseNICs parses a list of NICs separated by ";", each a comma-separated
+// list of network=<id> (required), any number of sg=<id> and an optional
+// ip=<fixed IP>, e.g. "network=net-1,sg=sg-1,sg=sg-2,ip=10.0.0.5;network=net-2".
+func ParseNICs(s string) ([]config.NIC, error) {
+	var nics []config.NIC
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
 			continue
 		}
-		// accumulate a run of literal chars until next '%'
-		start := i
-		for i < len(format) && format[i] != '%' {
-			i++
+		var nic config.NIC
+		for _, item := range SplitList(spec) {
+			k, v, ok := strings.Cut(item, "=")
+			v = strings.TrimSpace(v)
+			if !ok || v == "" {
+				return nil, fmt.Errorf("invalid NIC field %q (want key=value)", item)
+			}
+			switch strings.ToLower(strings.TrimSpace(k)) {
+			case "network":
+				nic.NetworkID = v
+			case "sg":
+				nic.SGIDs = append(nic.SGIDs, v)
+			case "ip":
+				if net.ParseIP(v) == nil {
+					return nil, fmt.Errorf("invalid fixed IP %q", v)
+				}
+				nic.FixedIP = v
+			default:
+				return nil, fmt.Errorf("unknown NIC field %q (want network, sg or ip)", k)
+			}
 		}
-		lit := format[start:i]
-		if lit != "" {
-			// Replace digit sequences in the literal with placeholders so
-			// they are not accidentally parsed as Go layout tokens like "1".
-			out := digitRe.ReplaceAllStringFunc(lit, func(s string) string {
-				ph := nextPlaceholder()
-				placeholderMap[ph] = s
-				return ph
-			})
-			b.WriteString(out)
+		if nic.NetworkID == "" {
+			return nil, fmt.Errorf("NIC %q has no network", strings.TrimSpace(spec))
 		}
+		nics = append(nics, nic)
 	}
-	layout := b.String()
-	formatted := t.Format(layout)
-	// Replace placeholders back to the original digit strings.
-	for ph, val := range placeholderMap {
-		formatted = strings.ReplaceAll(formatted, ph, val)
+	return nics, nil
+}
+
+// TaipeiLocation returns the Asia/Taipei timezone used for date tags and
+// retention periods, falling back to a fixed UTC+8 zone when the tz database
+// is unavailable.
+func TaipeiLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Taipei")
+	if err != nil {
+		log.Printf("warning: failed to load Asia/Taipei timezone: %v; falling back to fixed UTC+8", err)
+		loc = time.FixedZone("UTC+8", 8*3600)
 	}
-	return formatted
+	return loc
 }
 
 // BuildCSFilepath returns the path dss-public://{bucket}/{filename}.
 // filename may contain strftime tokens (e.g. %Y) which will be applied with time.Time t.
 func BuildCSFilepath(bucket string, filename string, t time.Time) string {
-	fname := filename
-	if strings.Contains(fname, "%") {
-		fname = ApplyStrftime(fname, t)
+	return fmt.Sprintf("dss-public://%s/%s", bucket, ImageName(filename, t))
+}
+
+// ImageName applies t to the image name template name, which may also be a
+// literal name without strftime tokens.
+func ImageName(name string, t time.Time) string {
+	if strings.Contains(name, "%") {
+		return ApplyStrftime(name, t)
 	}
-	return fmt.Sprintf("dss-public://%s/%s", bucket, fname)
+	return name
 }
 
 // RequireEnv verifies that the named environment variables are set and
@@ -108,63 +165,577 @@ func RequireEnv(names ...string) error {
 	return nil
 }
 
-// PruneRepositoryTags ensures that the number of tags in the repository
-// identified by repoID does not exceed maxTags. If there are more tags than
-// maxTags, the oldest tags are deleted until the number of tags is <= maxTags.
-func PruneRepositoryTags(ctx context.Context, vrmClient *vrmcore.Client, repoID string, maxTags int) error {
-	if maxTags <= 0 {
-		return nil
+// S3ConfigFromEnv reads the <prefix>_ENDPOINT, <prefix>_ACCESS_KEY,
+// <prefix>_SECRET_KEY and <prefix>_BUCKET variables, e.g. with prefix
+// BACKUP_DST_S3. All of them are required. The optional connection settings
+// are read by S3OptionsFromEnv.
+func S3ConfigFromEnv(prefix string) (rclone.S3Config, error) {
+	if err := RequireEnv(prefix+"_ENDPOINT", prefix+"_ACCESS_KEY", prefix+"_SECRET_KEY", prefix+"_BUCKET"); err != nil {
+		return rclone.S3Config{}, err
 	}
-	repoRes, err := vrmClient.Repositories().Get(ctx, repoID)
+	cfg := rclone.S3Config{
+		Endpoint:  os.Getenv(prefix + "_ENDPOINT"),
+		AccessKey: os.Getenv(prefix + "_ACCESS_KEY"),
+		SecretKey: os.Getenv(prefix + "_SECRET_KEY"),
+		Bucket:    os.Getenv(prefix + "_BUCKET"),
+	}
+	if err := S3OptionsFromEnv(prefix, &cfg); err != nil {
+		return rclone.S3Config{}, err
+	}
+	return cfg, nil
+}
+
+// S3OptionsFromEnv reads the optional S3 connection settings into cfg:
+// <prefix>_PROVIDER, <prefix>_REGION, <prefix>_FORCE_PATH_STYLE,
+// <prefix>_CA_CERT (a PEM file, which must exist), <prefix>_NO_CHECK_BUCKET
+// and <prefix>_STORAGE_CLASS.
+func S3OptionsFromEnv(prefix string, cfg *rclone.S3Config) error {
+	cfg.Provider = strings.TrimSpace(os.Getenv(prefix + "_PROVIDER"))
+	cfg.Region = strings.TrimSpace(os.Getenv(prefix + "_REGION"))
+	cfg.StorageClass = strings.TrimSpace(os.Getenv(prefix + "_STORAGE_CLASS"))
+	cfg.NoCheckBucket = IsTrue(os.Getenv(prefix + "_NO_CHECK_BUCKET"))
+	if v := os.Getenv(prefix + "_FORCE_PATH_STYLE"); v != "" {
+		pathStyle, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%s_FORCE_PATH_STYLE: invalid boolean %q", prefix, v)
+		}
+		cfg.ForcePathStyle = &pathStyle
+	}
+	if v := os.Getenv(prefix + "_CA_CERT"); v != "" {
+		if _, err := os.Stat(v); err != nil {
+			return fmt.Errorf("%s_CA_CERT: %w", prefix, err)
+		}
+		cfg.CACert = v
+	}
+	return nil
+}
+
+// LocationFromEnv reads the storage location whose backend is selected by
+// <prefix>_TYPE, e.g. with prefix BACKUP_DST:
+//
+//   - s3 (default): the S3ConfigFromEnv variables with prefix <prefix>_S3;
+//   - local: the directory <prefix>_PATH, such as an NFS mount;
+//   - sftp: <prefix>_SFTP_HOST, optionally <prefix>_SFTP_PORT, _USER, _PASS
+//     and _KEY_FILE, and the directory <prefix>_PATH;
+//   - any other rclone backend built in, such as swift: the comma-separated
+//     key=value backend options <prefix>_OPTIONS and the root <prefix>_PATH.
+//
+// The location is encrypted when <prefix>_CRYPT_PASSWORD or
+// <prefix>_CRYPT_KEY_FILE is set, see CryptConfigFromEnv, and compressed
+// before encryption when <prefix>_COMPRESS is gzip, at the optional gzip
+// level <prefix>_COMPRESS_LEVEL (-2 to 9).
+func LocationFromEnv(prefix string) (rclone.Location, error) {
+	loc, err := storageFromEnv(prefix)
 	if err != nil {
-		return fmt.Errorf("failed to get repository %s: %w", repoID, err)
+		return rclone.Location{}, err
+	}
+	crypt, ok, err := CryptConfigFromEnv(prefix)
+	if err != nil {
+		return rclone.Location{}, err
+	}
+	if ok {
+		if loc, err = loc.Encrypt(crypt); err != nil {
+			return rclone.Location{}, fmt.Errorf("%s_CRYPT: %w", prefix, err)
+		}
 	}
 
-	lister := repoRes.Tags()
-	deleter := vrmClient.Tags()
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv(prefix + "_COMPRESS"))); mode {
+	case "", "none", "off":
+	case "gzip":
+		level := rclone.DefaultCompressLevel
+		if v := os.Getenv(prefix + "_COMPRESS_LEVEL"); v != "" {
+			if level, err = strconv.Atoi(v); err != nil || level < -2 || level > 9 {
+				return rclone.Location{}, fmt.Errorf("%s_COMPRESS_LEVEL: invalid gzip level %q (want -2 to 9)", prefix, v)
+			}
+		}
+		loc = loc.Compress(level)
+	default:
+		return rclone.Location{}, fmt.Errorf("%s_COMPRESS: unsupported compression %q (rclone's compress backend supports gzip only)", prefix, mode)
+	}
+	return loc, nil
+}
+
+// CryptConfigFromEnv reads the encryption keys of the location with prefix:
+// <prefix>_CRYPT_PASSWORD and the optional <prefix>_CRYPT_SALT, or
+// <prefix>_CRYPT_KEY_FILE, a file holding the password on its first line and
+// the optional salt on the second. <prefix>_CRYPT_FILENAMES selects the
+// filename encryption (off, standard or obfuscate). ok is false when neither
+// a password nor a key file is set.
+func CryptConfigFromEnv(prefix string) (cfg rclone.CryptConfig, ok bool, err error) {
+	cfg = rclone.CryptConfig{
+		Password:  os.Getenv(prefix + "_CRYPT_PASSWORD"),
+		Salt:      os.Getenv(prefix + "_CRYPT_SALT"),
+		Filenames: strings.ToLower(strings.TrimSpace(os.Getenv(prefix + "_CRYPT_FILENAMES"))),
+	}
+	keyFile := os.Getenv(prefix + "_CRYPT_KEY_FILE")
+	if keyFile == "" {
+		return cfg, cfg.Password != "", nil
+	}
+	if cfg.Password != "" || cfg.Salt != "" {
+		return cfg, false, fmt.Errorf("set either %s_CRYPT_KEY_FILE or %s_CRYPT_PASSWORD/_SALT, not both", prefix, prefix)
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return cfg, false, fmt.Errorf("%s_CRYPT_KEY_FILE: %w", prefix, err)
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	cfg.Password = lines[0]
+	if len(lines) > 1 {
+		cfg.Salt = lines[1]
+	}
+	if cfg.Password == "" {
+		return cfg, false, fmt.Errorf("%s_CRYPT_KEY_FILE: %s has no password on its first line", prefix, keyFile)
+	}
+	return cfg, true, nil
+}
+
+// storageFromEnv reads the unencrypted location of LocationFromEnv.
+func storageFromEnv(prefix string) (rclone.Location, error) {
+	typ := strings.ToLower(strings.TrimSpace(os.Getenv(prefix + "_TYPE")))
+	switch typ {
+	case "", "s3":
+		cfg, err := S3ConfigFromEnv(prefix + "_S3")
+		if err != nil {
+			return rclone.Location{}, err
+		}
+		return cfg.Location(), nil
+	case "local":
+		if err := RequireEnv(prefix + "_PATH"); err != nil {
+			return rclone.Location{}, err
+		}
+		return rclone.LocalLocation(os.Getenv(prefix + "_PATH")), nil
+	case "sftp":
+		if err := RequireEnv(prefix + "_SFTP_HOST"); err != nil {
+			return rclone.Location{}, err
+		}
+		cfg := rclone.SFTPConfig{
+			Host:    os.Getenv(prefix + "_SFTP_HOST"),
+			User:    os.Getenv(prefix + "_SFTP_USER"),
+			Pass:    os.Getenv(prefix + "_SFTP_PASS"),
+			KeyFile: os.Getenv(prefix + "_SFTP_KEY_FILE"),
+			Path:    os.Getenv(prefix + "_PATH"),
+		}
+		if v := os.Getenv(prefix + "_SFTP_PORT"); v != "" {
+			port, err := strconv.Atoi(v)
+			if err != nil || port <= 0 || port > 65535 {
+				return rclone.Location{}, fmt.Errorf("%s_SFTP_PORT: invalid port %q", prefix, v)
+			}
+			cfg.Port = port
+		}
+		return cfg.Location()
+	}
+	if err := rclone.CheckBackend(typ); err != nil {
+		return rclone.Location{}, fmt.Errorf("%s_TYPE: %w", prefix, err)
+	}
+	loc := rclone.Location{Type: typ, Options: map[string]string{}, Root: os.Getenv(prefix + "_PATH")}
+	for _, item := range SplitList(os.Getenv(prefix + "_OPTIONS")) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return rclone.Location{}, fmt.Errorf("%s_OPTIONS: invalid option %q (want key=value)", prefix, item)
+		}
+		if err := rclone.CheckOptionName(strings.TrimSpace(k)); err != nil {
+			return rclone.Location{}, fmt.Errorf("%s_OPTIONS: %w", prefix, err)
+		}
+		loc.Options[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return loc, nil
+}
+
+// NewProjectClient creates an SDK client for cfg.BaseURL and scopes it to the
+// project identified by cfg.ProjectSysCode.
+func NewProjectClient(ctx context.Context, cfg *config.Config) (*cloudsdk.ProjectClient, error) {
+	client, err := cloudsdk.New(cfg.BaseURL, cfg.Token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SDK client: %w", err)
+	}
+
+	projClient, err := client.Project(ctx, cfg.ProjectSysCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create project client: %w", err)
+	}
+	return projClient, nil
+}
+
+// FindRepositoryID returns the ID of the VRM repository named name, or an
+// empty string when no such repository exists.
+func FindRepositoryID(ctx context.Context, vrmClient *vrmcore.Client, name string) (string, error) {
+	repos, err := vrmClient.Repositories().List(ctx, &vrmrepos.ListRepositoriesOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list repositories: %w", err)
+	}
+
+	for _, r := range repos {
+		if r == nil {
+			continue
+		}
+		if r.Name == name {
+			return r.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// ListRepositoryTags returns all tags of the repository identified by repoID,
+// sorted by CreatedAt ascending (oldest first).
+func ListRepositoryTags(ctx context.Context, vrmClient *vrmcore.Client, repoID string) ([]*vrmtags.Tag, error) {
+	repoRes, err := vrmClient.Repositories().Get(ctx, repoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository %s: %w", repoID, err)
+	}
 
 	// Fetch repository subresource to list tags scoped to this repo.
 	opts := &vrmtags.ListTagsOptions{Limit: -1}
-	tags, err := lister.List(ctx, opts)
+	tags, err := repoRes.Tags().List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].CreatedAt.Before(tags[j].CreatedAt) })
+	return tags, nil
+}
+
+// ParseTagRef splits a <repo>:<version> reference to a VRM tag. The version
+// may also be a tag ID.
+func ParseTagRef(ref string) (repo, version string, err error) {
+	repo, version, ok := strings.Cut(strings.TrimSpace(ref), ":")
+	if !ok || repo == "" || version == "" {
+		return "", "", fmt.Errorf("invalid tag reference %q (want <repo>:<version>)", ref)
+	}
+	return repo, version, nil
+}
+
+// MatchTag returns the tag of tags whose version or ID is version, or nil.
+func MatchTag(tags []*vrmtags.Tag, version string) *vrmtags.Tag {
+	for _, t := range tags {
+		if t != nil && (t.Name == version || t.ID == version) {
+			return t
+		}
+	}
+	return nil
+}
+
+// FindTag returns the tag referenced by ref, a <repo>:<version> reference,
+// and the ID of its repository. It fails when either does not exist.
+func FindTag(ctx context.Context, vrmClient *vrmcore.Client, ref string) (*vrmtags.Tag, string, error) {
+	repo, version, err := ParseTagRef(ref)
 	if err != nil {
-		return fmt.Errorf("failed to list tags: %w", err)
+		return nil, "", err
 	}
+	repoID, err := FindRepositoryID(ctx, vrmClient, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	if repoID == "" {
+		return nil, "", fmt.Errorf("repository %s not found", repo)
+	}
+	tags, err := ListRepositoryTags(ctx, vrmClient, repoID)
+	if err != nil {
+		return nil, "", err
+	}
+	tag := MatchTag(tags, version)
+	if tag == nil {
+		return nil, "", fmt.Errorf("tag %s not found in repository %s", version, repo)
+	}
+	return tag, repoID, nil
+}
 
-	if len(tags) <= maxTags {
+// Semaphore bounds how many goroutines run a pipeline stage at once. A nil
+// Semaphore does not limit.
+type Semaphore chan struct{}
+
+// NewSemaphore returns a Semaphore admitting n holders, or nil when n <= 0.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
 		return nil
 	}
-	// Sort by CreatedAt ascending (oldest first)
-	sort.Slice(tags, func(i, j int) bool { return tags[i].CreatedAt.Before(tags[j].CreatedAt) })
+	return make(Semaphore, n)
+}
+
+// Acquire blocks until a slot is free or ctx is done.
+func (s Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (s Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// Prune modes: PruneAfter deletes old tags only once the new tag is ready,
+// PruneBefore frees a slot before creating it for quota-constrained repos.
+const (
+	PruneAfter  = "after"
+	PruneBefore = "before"
+)
+
+// ParsePruneMode validates a prune mode; empty selects PruneAfter.
+func ParsePruneMode(v string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(v)); m {
+	case "":
+		return PruneAfter, nil
+	case PruneAfter, PruneBefore:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid prune mode %q (want %s or %s)", v, PruneAfter, PruneBefore)
+	}
+}
+
+// PruneRepositoryTags ensures that the number of tags in the repository
+// identified by repoID does not exceed maxTags. If there are more tags than
+// maxTags, the oldest tags are deleted until the number of tags is <= maxTags.
+// Tags whose ID is in exclude are never deleted but count towards maxTags.
+// Every tag of the repository is considered; see PruneOptions.Managed.
+func PruneRepositoryTags(ctx context.Context, vrmClient *vrmcore.Client, repoID string, maxTags int, exclude ...string) error {
+	_, err := PruneRepository(ctx, vrmClient, repoID, PruneOptions{Keep: maxTags, Exclude: exclude})
+	return err
+}
+
+// PinMarker pins a tag when it appears in a string value of the tag's extra
+// metadata, such as a description. An extra "pinned": true entry pins the
+// tag as well.
+const PinMarker = "vmbr:pin"
+
+// TagPins identifies tags that must never be pruned, e.g. for a legal hold
+// or a golden image taken before an upgrade.
+type TagPins struct {
+	// Tags lists pinned tag versions (names) or IDs.
+	Tags []string
+	// Patterns are globs matched against the tag version.
+	Patterns []string
+}
+
+// Pinned reports whether t is pinned by p or by a marker in its metadata.
+func (p TagPins) Pinned(t *vrmtags.Tag) bool {
+	if p.MatchName(t.Name) || slices.Contains(p.Tags, t.ID) {
+		return true
+	}
+	for k, v := range t.Extra {
+		switch v := v.(type) {
+		case bool:
+			if v && strings.EqualFold(k, "pinned") {
+				return true
+			}
+		case string:
+			if strings.EqualFold(k, "pinned") && strings.EqualFold(v, "true") {
+				return true
+			}
+			if strings.Contains(v, PinMarker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchName reports whether name is pinned by the explicit list or a
+// pattern. It also applies to S3 object names.
+func (p TagPins) MatchName(name string) bool {
+	if slices.Contains(p.Tags, name) {
+		return true
+	}
+	for _, pat := range p.Patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ManagedTags recognises the tags created by backup and restore runs by
+// their version, which matches DATE_TAG_FORMAT. The VRM API cannot attach
+// metadata to the tags it creates, so the version is the only mark they
+// carry. A nil *ManagedTags treats every tag as managed.
+type ManagedTags struct {
+	version *regexp.Regexp
+}
+
+// NewManagedTags returns the matcher for tags versioned with the strftime
+// format dateTagFormat.
+func NewManagedTags(dateTagFormat string) *ManagedTags {
+	return &ManagedTags{version: StrftimeRegexp(dateTagFormat)}
+}
+
+// Owns reports whether t was created by this tool.
+func (m *ManagedTags) Owns(t *vrmtags.Tag) bool {
+	return m == nil || m.version.MatchString(t.Name)
+}
+
+// PruneOptions selects the tags of a repository that are pruned.
+type PruneOptions struct {
+	// Keep is the number of newest tags kept when Policy is zero.
+	Keep int
+	// Policy, when set, replaces Keep with a retention policy evaluated in
+	// Location.
+	Policy   retention.Policy
+	Location *time.Location
+	// Exclude lists tag IDs that are never deleted but still count against
+	// Keep or Policy, such as the tag just created.
+	Exclude []string
+	// Pins are never deleted and do not count against Keep or Policy.
+	Pins TagPins
+	// Managed, when set, limits pruning to the tags it owns; other tags,
+	// e.g. uploaded by hand, are treated like pinned ones.
+	Managed *ManagedTags
+}
+
+// Enabled reports whether o prunes anything at all.
+func (o PruneOptions) Enabled() bool {
+	return o.Keep > 0 || !o.Policy.IsZero()
+}
+
+// PruneOptionsFor returns the prune options configured in cfg, keeping keep
+// tags unless cfg.Retention is set.
+func PruneOptionsFor(cfg *config.Config, keep int, exclude ...string) PruneOptions {
+	opts := PruneOptions{
+		Keep:     keep,
+		Policy:   cfg.Retention,
+		Location: cfg.Now.Location(),
+		Exclude:  exclude,
+		Pins:     TagPins{Tags: cfg.PinTags, Patterns: cfg.PinPatterns},
+	}
+	if !cfg.PruneAllTags {
+		format := cfg.DateTagFormat
+		if format == "" {
+			format = DefaultDateTagFormat
+		}
+		opts.Managed = NewManagedTags(format)
+	}
+	return opts
+}
+
+// SelectPruneTags returns the tags that opts prunes from tags, which must be
+// sorted oldest first as returned by ListRepositoryTags.
+func SelectPruneTags(tags []*vrmtags.Tag, opts PruneOptions) []*vrmtags.Tag {
+	candidates := make([]*vrmtags.Tag, 0, len(tags))
+	for _, t := range tags {
+		if t != nil && (opts.Pins.Pinned(t) || !opts.Managed.Owns(t)) {
+			continue
+		}
+		candidates = append(candidates, t)
+	}
+	if !opts.Policy.IsZero() {
+		return SelectTagsByPolicy(candidates, opts.Policy, opts.Location, opts.Exclude...)
+	}
+	return SelectTagsToPrune(candidates, opts.Keep, opts.Exclude...)
+}
+
+// PlanPruneTag is the ID of the placeholder PlanPruneTags adds for the tag a
+// run is about to create.
+const PlanPruneTag = "<new>"
+
+// PlanPruneTags returns the tags of a repository holding tags that a backup
+// or restore run with cfg would prune, selected as the run does: in the
+// PruneBefore mode keeping cfg.TagNum-1 tags before the new one is created,
+// otherwise keeping cfg.TagNum tags including the new one, which is added as
+// a placeholder and never pruned.
+func PlanPruneTags(cfg *config.Config, tags []*vrmtags.Tag) []*vrmtags.Tag {
+	if cfg.PruneMode == PruneBefore {
+		return SelectPruneTags(tags, PruneOptionsFor(cfg, cfg.TagNum-1))
+	}
+	tags = append(tags[:len(tags):len(tags)], &vrmtags.Tag{ID: PlanPruneTag, Name: cfg.DateTag, CreatedAt: cfg.Now})
+	return SelectPruneTags(tags, PruneOptionsFor(cfg, cfg.TagNum, PlanPruneTag))
+}
+
+// PruneRepository deletes the tags of the repository repoID selected by opts
+// and returns them.
+func PruneRepository(ctx context.Context, vrmClient *vrmcore.Client, repoID string, opts PruneOptions) ([]*vrmtags.Tag, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+	tags, err := ListRepositoryTags(ctx, vrmClient, repoID)
+	if err != nil {
+		return nil, err
+	}
+
+	deleter := vrmClient.Tags()
+	del := SelectPruneTags(tags, opts)
+	for _, t := range del {
+		// Delete the tag; bubble up any error.
+		if err := deleter.Delete(ctx, t.ID); err != nil {
+			return nil, fmt.Errorf("failed to delete tag %s: %w", t.ID, err)
+		}
+	}
+	return del, nil
+}
 
+// SelectTagsToPrune returns the tags PruneRepositoryTags would delete to keep
+// at most maxTags of tags, which must be sorted oldest first as returned by
+// ListRepositoryTags. It does not modify anything, so it also backs the
+// --dry-run plans. Tags whose ID is in exclude are kept regardless of age.
+func SelectTagsToPrune(tags []*vrmtags.Tag, maxTags int, exclude ...string) []*vrmtags.Tag {
+	if maxTags <= 0 || len(tags) <= maxTags {
+		return nil
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	var out []*vrmtags.Tag
 	toDelete := len(tags) - maxTags
-	for i := 0; i < toDelete; i++ {
-		t := tags[i]
+	for _, t := range tags {
+		if toDelete == 0 {
+			break
+		}
+		if t != nil && excluded[t.ID] {
+			continue
+		}
+		toDelete--
 		if t == nil || t.ID == "" {
 			continue
 		}
-		// Delete the tag; bubble up any error.
+		out = append(out, t)
+	}
+	return out
+}
 
-		if err := deleter.Delete(ctx, t.ID); err != nil {
-			return fmt.Errorf("failed to delete tag %s: %w", t.ID, err)
+// SelectTagsByPolicy returns the tags the retention policy deletes, oldest
+// first, classifying them by creation time in loc. Excluded tags are never
+// returned but still occupy their retention slots.
+func SelectTagsByPolicy(tags []*vrmtags.Tag, policy retention.Policy, loc *time.Location, exclude ...string) []*vrmtags.Tag {
+	excluded := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	byID := make(map[string]*vrmtags.Tag, len(tags))
+	for _, t := range tags {
+		if t != nil {
+			byID[t.ID] = t
 		}
 	}
-	return nil
+	var out []*vrmtags.Tag
+	for _, it := range retention.Select(policy, retention.FromTags(tags), loc) {
+		if !excluded[it.ID] {
+			out = append(out, byID[it.ID])
+		}
+	}
+	return out
 }
 
-// Transfer performs S3 transfer using rclone for backup or restore operations.
+// Transfer copies the image from the source to the destination location with
+// rclone for backup or restore operations; either may be on any backend.
+// The copy is verified against the source by size and checksum, and the
+// manifest of the image, if any, is copied alongside it.
 func Transfer(cfg *config.Config) error {
-	// Ensure transfer was enabled and S3 configs were initialized.
+	// Ensure transfer was enabled and both locations were initialized.
 	if cfg == nil {
 		return fmt.Errorf("nil config")
 	}
-	if !cfg.TransferS3 || cfg.SrcS3Cfg == nil || cfg.DstS3Cfg == nil {
-		return fmt.Errorf("S3 transfer not configured; set RESTORE_TRANSFR_FROM_S3=true or BACKUP_TRANSFR_TO_S3=true and provide S3 configuration env vars to enable transfer")
+	if !cfg.TransferS3 || cfg.SrcLocation == nil || cfg.DstLocation == nil {
+		return fmt.Errorf("S3 transfer not configured; set RESTORE_TRANSFR_FROM_S3=true or BACKUP_TRANSFR_TO_S3=true and provide the source and destination env vars to enable transfer")
 	}
 
-	fileName := cfg.BackupRestoreImage
-	if strings.Contains(fileName, "%") {
-		fileName = ApplyStrftime(fileName, cfg.Now)
-	}
+	fileName := ImageName(cfg.BackupRestoreImage, cfg.Now)
 
 	dstRemote := fileName
 
@@ -172,17 +743,36 @@ func Transfer(cfg *config.Config) error {
 	rclone.Init()
 	defer rclone.Close()
 
-	jobID, totalSize, err := rclone.CopyFileAsync(*cfg.SrcS3Cfg, fileName, *cfg.DstS3Cfg, dstRemote)
+	jobID, totalSize, err := rclone.CopyFileAsync(*cfg.SrcLocation, fileName, *cfg.DstLocation, dstRemote)
 	if err != nil {
 		return fmt.Errorf("failed to start transfer job: %w", err)
 	}
 
-	ok, dur, err := rclone.WaitJob(jobID, totalSize, 5*time.Second, true)
+	ok, dur, err := rclone.WaitJob(jobID, totalSize, 5*time.Second, true, *cfg.SrcLocation, *cfg.DstLocation)
 	if err != nil {
 		return fmt.Errorf("transfer job error: %w", err)
 	}
 	if !ok {
 		return fmt.Errorf("transfer job failed after %.2fs", dur)
 	}
-	return nil
+
+	// A successful job does not prove the copy is intact.
+	compared, err := rclone.Verify(*cfg.SrcLocation, fileName, *cfg.DstLocation, dstRemote, cfg.VerifyDownload)
+	if err != nil {
+		return fmt.Errorf("transferred image failed verification: %w", err)
+	}
+	if len(compared) == 0 {
+		log.Printf("warning: no common checksum for %s; only its size was verified", fileName)
+	} else {
+		log.Printf("Verified %s (size, %s)", fileName, strings.Join(compared, ", "))
+	}
+
+	// The manifest travels with the image; images backed up without one are
+	// transferred alone.
+	err = manifest.Copy(*cfg.SrcLocation, *cfg.DstLocation, fileName)
+	if errors.Is(err, manifest.ErrNotFound) {
+		log.Printf("No manifest for %s; transferred the image alone", fileName)
+		return nil
+	}
+	return err
 }
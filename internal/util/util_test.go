@@ -1,33 +1,20 @@
 package util
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
-)
 
-func TestApplyStrftime_LiteralDigits(t *testing.T) {
-	loc := time.FixedZone("UTC+8", 8*3600)
-	now := time.Date(2025, 11, 23, 10, 18, 0, 0, loc)
-	in := "backup-%Y-%m-%d-%H-18.img"
-	got := ApplyStrftime(in, now)
-	want := "backup-2025-11-23-10-18.img"
-	if got != want {
-		t.Fatalf("expected %s, got %s", want, got)
-	}
-}
+	vrmtags "github.com/Zillaforge/cloud-sdk/models/vrm/tags"
 
-func TestApplyStrftime_Default(t *testing.T) {
-	loc := time.FixedZone("UTC+8", 8*3600)
-	now := time.Date(2025, 11, 23, 10, 18, 30, 0, loc)
-	in := "%Y-%m-%d-%H-%M"
-	got := ApplyStrftime(in, now)
-	want := "2025-11-23-10-18"
-	if got != want {
-		t.Fatalf("expected %s, got %s", want, got)
-	}
-}
+	"nchc-vmbr/internal/config"
+	"nchc-vmbr/internal/rclone"
+	"nchc-vmbr/internal/retention"
+)
 
 func TestRequireEnv_AllPresent(t *testing.T) {
 	os.Setenv("FOO", "1")
@@ -56,3 +43,495 @@ func TestRequireEnv_Missing(t *testing.T) {
 		t.Fatalf("error message did not include missing vars: %s", msg)
 	}
 }
+
+func TestApplyTemplate(t *testing.T) {
+	got := ApplyTemplate("{{.VM}}-backup-%Y-%m-%d.img", TemplateVars{VM: "web-01"})
+	want := "web-01-backup-%Y-%m-%d.img"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	// Templates without the placeholder are returned unchanged.
+	if got := ApplyTemplate("backup.img", TemplateVars{VM: "web-01"}); got != "backup.img" {
+		t.Fatalf("expected template without placeholder to be unchanged, got %s", got)
+	}
+
+	vars := TemplateVars{VM: "web-01", Project: "proj-123", RunID: "backup-20251123-101800-a1b2c3"}
+	got = ApplyTemplate("{{.Project}}/{{.VM}}-%Y%m%d-{{.RunID}}.img", vars)
+	want = "proj-123/web-01-%Y%m%d-backup-20251123-101800-a1b2c3.img"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	// An unknown run ID, e.g. in a dry run, keeps its placeholder.
+	if got := ApplyTemplate("{{.VM}}-{{.RunID}}.img", TemplateVars{VM: "web-01"}); got != "web-01-{{.RunID}}.img" {
+		t.Fatalf("expected empty values to keep their placeholder, got %s", got)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := SplitList(" web-01, ,web-02,")
+	if len(got) != 2 || got[0] != "web-01" || got[1] != "web-02" {
+		t.Fatalf("unexpected split result: %q", got)
+	}
+	if got := SplitList(""); len(got) != 0 {
+		t.Fatalf("expected empty list, got %q", got)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(1)
+	ctx := context.Background()
+	if err := sem.Acquire(ctx); err != nil {
+		t.Fatalf("expected first acquire to succeed, got %v", err)
+	}
+
+	// A second holder must wait until the context gives up.
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := sem.Acquire(cctx); err == nil {
+		t.Fatalf("expected acquire on a full semaphore to fail when the context expires")
+	}
+
+	sem.Release()
+	if err := sem.Acquire(ctx); err != nil {
+		t.Fatalf("expected acquire after release to succeed, got %v", err)
+	}
+
+	// A nil semaphore never blocks.
+	var unlimited Semaphore = NewSemaphore(0)
+	for i := 0; i < 3; i++ {
+		if err := unlimited.Acquire(ctx); err != nil {
+			t.Fatalf("expected unlimited semaphore not to block, got %v", err)
+		}
+	}
+	unlimited.Release()
+}
+
+func TestSelectTagsToPrune(t *testing.T) {
+	base := time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)
+	var tags []*vrmtags.Tag
+	for i := 0; i < 4; i++ {
+		tags = append(tags, &vrmtags.Tag{ID: string(rune('a' + i)), CreatedAt: base.AddDate(0, 0, i)})
+	}
+
+	got := SelectTagsToPrune(tags, 1)
+	if len(got) != 3 || got[0].ID != "a" || got[2].ID != "c" {
+		t.Fatalf("expected the 3 oldest tags, got %+v", got)
+	}
+	if got := SelectTagsToPrune(tags, 4); len(got) != 0 {
+		t.Fatalf("expected nothing to prune, got %+v", got)
+	}
+	if got := SelectTagsToPrune(tags, 0); len(got) != 0 {
+		t.Fatalf("expected 0 to disable pruning, got %+v", got)
+	}
+}
+
+func TestSelectTagsToPrune_Exclude(t *testing.T) {
+	base := time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)
+	// "new" has the oldest CreatedAt but must survive because it is excluded.
+	tags := []*vrmtags.Tag{
+		{ID: "new", CreatedAt: base},
+		{ID: "a", CreatedAt: base.AddDate(0, 0, 1)},
+		{ID: "b", CreatedAt: base.AddDate(0, 0, 2)},
+	}
+	got := SelectTagsToPrune(tags, 2, "new")
+	if len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected only a to be pruned, got %+v", got)
+	}
+}
+
+func TestParsePruneMode(t *testing.T) {
+	for in, want := range map[string]string{"": PruneAfter, "after": PruneAfter, " Before ": PruneBefore} {
+		got, err := ParsePruneMode(in)
+		if err != nil || got != want {
+			t.Fatalf("ParsePruneMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParsePruneMode("never"); err == nil {
+		t.Fatalf("expected error for unknown prune mode")
+	}
+}
+
+func TestSelectTagsByPolicy(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	end := time.Date(2025, 11, 23, 2, 0, 0, 0, loc)
+	var tags []*vrmtags.Tag
+	for i := 9; i >= 0; i-- {
+		tags = append(tags, &vrmtags.Tag{ID: fmt.Sprintf("day-%d", i), CreatedAt: end.AddDate(0, 0, -i)})
+	}
+
+	got := SelectTagsByPolicy(tags, retention.Policy{Daily: 3}, loc)
+	if len(got) != 7 || got[0].ID != "day-9" || got[6].ID != "day-3" {
+		t.Fatalf("expected days 9..3 to be pruned oldest first, got %+v", got)
+	}
+
+	// Excluded tags survive even when the policy would drop them.
+	got = SelectTagsByPolicy(tags, retention.Policy{Daily: 3}, loc, "day-9")
+	if len(got) != 6 || got[0].ID != "day-8" {
+		t.Fatalf("expected day-9 to be excluded, got %+v", got)
+	}
+}
+
+func TestTagPins(t *testing.T) {
+	pins := TagPins{Tags: []string{"2025-01-01-00-00", "tag-id-7"}, Patterns: []string{"golden-*"}}
+	cases := []struct {
+		tag  *vrmtags.Tag
+		want bool
+	}{
+		{&vrmtags.Tag{ID: "1", Name: "2025-01-01-00-00"}, true},
+		{&vrmtags.Tag{ID: "tag-id-7", Name: "2025-02-01-00-00"}, true},
+		{&vrmtags.Tag{ID: "2", Name: "golden-pre-upgrade"}, true},
+		{&vrmtags.Tag{ID: "3", Name: "2025-03-01-00-00", Extra: map[string]interface{}{"pinned": true}}, true},
+		{&vrmtags.Tag{ID: "4", Name: "2025-03-02-00-00", Extra: map[string]interface{}{"description": "legal hold vmbr:pin"}}, true},
+		{&vrmtags.Tag{ID: "5", Name: "2025-03-03-00-00", Extra: map[string]interface{}{"pinned": false}}, false},
+		{&vrmtags.Tag{ID: "6", Name: "2025-03-04-00-00"}, false},
+	}
+	for _, c := range cases {
+		if got := pins.Pinned(c.tag); got != c.want {
+			t.Fatalf("Pinned(%+v) = %v, want %v", c.tag, got, c.want)
+		}
+	}
+}
+
+func TestSelectPruneTags_PinsDoNotCount(t *testing.T) {
+	base := time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)
+	tags := []*vrmtags.Tag{
+		{ID: "golden", Name: "golden", CreatedAt: base},
+		{ID: "a", Name: "a", CreatedAt: base.AddDate(0, 0, 1)},
+		{ID: "b", Name: "b", CreatedAt: base.AddDate(0, 0, 2)},
+		{ID: "c", Name: "c", CreatedAt: base.AddDate(0, 0, 3)},
+	}
+	opts := PruneOptions{Keep: 2, Pins: TagPins{Patterns: []string{"golden*"}}}
+
+	// The pinned tag survives and keeps no slot, so b and c are kept.
+	got := SelectPruneTags(tags, opts)
+	if len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected only a to be pruned, got %+v", got)
+	}
+
+	opts = PruneOptions{Policy: retention.Policy{Last: 1}, Location: time.UTC, Pins: TagPins{Tags: []string{"a"}}}
+	got = SelectPruneTags(tags, opts)
+	if len(got) != 2 || got[0].ID != "golden" || got[1].ID != "b" {
+		t.Fatalf("expected golden and b to be pruned by policy, got %+v", got)
+	}
+}
+
+func TestManagedTags(t *testing.T) {
+	m := NewManagedTags(DefaultDateTagFormat)
+	cases := []struct {
+		tag  *vrmtags.Tag
+		want bool
+	}{
+		{&vrmtags.Tag{Name: "2025-11-23-10-18"}, true},
+		{&vrmtags.Tag{Name: "before-upgrade"}, false},
+		{&vrmtags.Tag{Name: "2025-11-23"}, false},
+		{&vrmtags.Tag{Name: "custom", Extra: map[string]interface{}{"description": "nightly (vmbr:managed)"}}, false},
+	}
+	for i, c := range cases {
+		if got := m.Owns(c.tag); got != c.want {
+			t.Fatalf("case %d: expected Owns=%v for %+v", i, c.want, c.tag)
+		}
+	}
+
+	var all *ManagedTags
+	if !all.Owns(&vrmtags.Tag{Name: "before-upgrade"}) {
+		t.Fatalf("expected a nil matcher to own every tag")
+	}
+}
+
+func TestSelectPruneTags_OnlyManaged(t *testing.T) {
+	base := time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)
+	tags := []*vrmtags.Tag{
+		{ID: "manual", Name: "before-upgrade", CreatedAt: base},
+		{ID: "a", Name: "2025-11-02-00-00", CreatedAt: base.AddDate(0, 0, 1)},
+		{ID: "b", Name: "2025-11-03-00-00", CreatedAt: base.AddDate(0, 0, 2)},
+		{ID: "c", Name: "2025-11-04-00-00", CreatedAt: base.AddDate(0, 0, 3)},
+	}
+
+	// The hand-made tag is neither pruned nor counted, so b and c are kept.
+	opts := PruneOptions{Keep: 2, Managed: NewManagedTags(DefaultDateTagFormat)}
+	got := SelectPruneTags(tags, opts)
+	if len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected only a to be pruned, got %+v", got)
+	}
+
+	opts.Managed = nil
+	got = SelectPruneTags(tags, opts)
+	if len(got) != 2 || got[0].ID != "manual" || got[1].ID != "a" {
+		t.Fatalf("expected manual and a to be pruned, got %+v", got)
+	}
+}
+
+func TestPlanPruneTags(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2025, 11, 23, 2, 0, 0, 0, loc)
+	tags := []*vrmtags.Tag{
+		{ID: "d2", Name: "2025-11-21-02-00", CreatedAt: now.AddDate(0, 0, -2)},
+		{ID: "d1", Name: "2025-11-22-02-00", CreatedAt: now.AddDate(0, 0, -1)},
+	}
+
+	// With a single tag kept, the new one replaces every old tag.
+	cfg := &config.Config{Now: now, DateTag: "2025-11-23-02-00", PruneMode: PruneAfter, TagNum: 1}
+	got := PlanPruneTags(cfg, tags)
+	if len(got) != 2 || got[0].ID != "d2" || got[1].ID != "d1" {
+		t.Fatalf("expected d2 and d1 to be pruned after the new tag, got %+v", got)
+	}
+	// The PruneBefore mode keeps TagNum-1 tags, and keeping none disables
+	// pruning as it always has.
+	cfg.PruneMode = PruneBefore
+	if got := PlanPruneTags(cfg, tags); len(got) != 0 {
+		t.Fatalf("expected nothing pruned before the new tag, got %+v", got)
+	}
+	cfg.TagNum = 2
+	if got := PlanPruneTags(cfg, tags); len(got) != 1 || got[0].ID != "d2" {
+		t.Fatalf("expected d2 to be pruned to free a slot, got %+v", got)
+	}
+
+	// The new tag takes today's slot, so only yesterday's backup is kept.
+	cfg = &config.Config{Now: now, DateTag: "2025-11-23-02-00", PruneMode: PruneAfter, Retention: retention.Policy{Daily: 2}}
+	got = PlanPruneTags(cfg, tags)
+	if len(got) != 1 || got[0].ID != "d2" {
+		t.Fatalf("expected d2 to be pruned after the new tag, got %+v", got)
+	}
+	cfg.PruneMode = PruneBefore
+	if got := PlanPruneTags(cfg, tags); len(got) != 0 {
+		t.Fatalf("expected nothing pruned before the new tag exists, got %+v", got)
+	}
+}
+
+func TestParseTagRef(t *testing.T) {
+	repo, version, err := ParseTagRef("web-01-backups:2025-11-22-10:18")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if repo != "web-01-backups" || version != "2025-11-22-10:18" {
+		t.Fatalf("unexpected reference parts: %q %q", repo, version)
+	}
+	for _, bad := range []string{"", "web-01-backups", "web-01-backups:", ":2025-11-22"} {
+		if _, _, err := ParseTagRef(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestMatchTag(t *testing.T) {
+	tags := []*vrmtags.Tag{nil, {ID: "tag-1", Name: "2025-11-22-10-18"}, {ID: "tag-2", Name: "golden"}}
+	if got := MatchTag(tags, "golden"); got == nil || got.ID != "tag-2" {
+		t.Fatalf("expected tag-2 by version, got %+v", got)
+	}
+	if got := MatchTag(tags, "tag-1"); got == nil || got.Name != "2025-11-22-10-18" {
+		t.Fatalf("expected tag-1 by ID, got %+v", got)
+	}
+	if got := MatchTag(tags, "missing"); got != nil {
+		t.Fatalf("expected no match, got %+v", got)
+	}
+}
+
+func TestParseNICs(t *testing.T) {
+	nics, err := ParseNICs("network=net-1, sg=sg-1, sg=sg-2, ip=10.0.0.5; network=net-2,sg=sg-3;")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(nics) != 2 {
+		t.Fatalf("expected 2 NICs, got %+v", nics)
+	}
+	if n := nics[0]; n.NetworkID != "net-1" || len(n.SGIDs) != 2 || n.SGIDs[1] != "sg-2" || n.FixedIP != "10.0.0.5" {
+		t.Fatalf("unexpected first NIC: %+v", n)
+	}
+	if n := nics[1]; n.NetworkID != "net-2" || len(n.SGIDs) != 1 || n.FixedIP != "" {
+		t.Fatalf("unexpected second NIC: %+v", n)
+	}
+
+	if nics, err := ParseNICs(""); err != nil || len(nics) != 0 {
+		t.Fatalf("expected no NICs for an empty string, got %+v (%v)", nics, err)
+	}
+	for _, bad := range []string{"sg=sg-1", "network=net-1,ip=10.0.0", "network=net-1,mac=aa", "network"} {
+		if _, err := ParseNICs(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestLocationFromEnv(t *testing.T) {
+	os.Setenv("TEST_DST_S3_ENDPOINT", "https://s3.example.com")
+	defer os.Unsetenv("TEST_DST_S3_ENDPOINT")
+	os.Setenv("TEST_DST_S3_ACCESS_KEY", "ak")
+	defer os.Unsetenv("TEST_DST_S3_ACCESS_KEY")
+	os.Setenv("TEST_DST_S3_SECRET_KEY", "sk")
+	defer os.Unsetenv("TEST_DST_S3_SECRET_KEY")
+	os.Setenv("TEST_DST_S3_BUCKET", "archive")
+	defer os.Unsetenv("TEST_DST_S3_BUCKET")
+
+	loc, err := LocationFromEnv("TEST_DST")
+	if err != nil {
+		t.Fatalf("LocationFromEnv failed: %v", err)
+	}
+	if loc.Type != "s3" || loc.Root != "archive" || loc.Options["endpoint"] != "https://s3.example.com" {
+		t.Fatalf("expected the S3 bucket by default, got %+v", loc)
+	}
+
+	os.Setenv("TEST_DST_TYPE", "local")
+	defer os.Unsetenv("TEST_DST_TYPE")
+	if _, err := LocationFromEnv("TEST_DST"); err == nil || !strings.Contains(err.Error(), "TEST_DST_PATH") {
+		t.Fatalf("expected TEST_DST_PATH to be required, got %v", err)
+	}
+	os.Setenv("TEST_DST_PATH", "/mnt/nfs/backups")
+	defer os.Unsetenv("TEST_DST_PATH")
+	if loc, err = LocationFromEnv("TEST_DST"); err != nil || loc.Fs() != ":local:/mnt/nfs/backups" {
+		t.Fatalf("unexpected local location %+v, %v", loc, err)
+	}
+
+	os.Setenv("TEST_DST_TYPE", "SFTP")
+	os.Setenv("TEST_DST_SFTP_HOST", "backup.example.com")
+	defer os.Unsetenv("TEST_DST_SFTP_HOST")
+	os.Setenv("TEST_DST_SFTP_USER", "vmbr")
+	defer os.Unsetenv("TEST_DST_SFTP_USER")
+	os.Setenv("TEST_DST_SFTP_PORT", "2222")
+	defer os.Unsetenv("TEST_DST_SFTP_PORT")
+	loc, err = LocationFromEnv("TEST_DST")
+	if err != nil {
+		t.Fatalf("LocationFromEnv failed for sftp: %v", err)
+	}
+	if loc.Type != "sftp" || loc.String() != "sftp://vmbr@backup.example.com:2222/mnt/nfs/backups" {
+		t.Fatalf("unexpected sftp location %+v", loc)
+	}
+	os.Setenv("TEST_DST_SFTP_PORT", "ssh")
+	if _, err := LocationFromEnv("TEST_DST"); err == nil {
+		t.Fatalf("expected an error for an invalid port")
+	}
+
+	os.Setenv("TEST_DST_TYPE", "swift")
+	os.Setenv("TEST_DST_OPTIONS", "user=vmbr, key=secret,auth=https://keystone.example.com/v3")
+	defer os.Unsetenv("TEST_DST_OPTIONS")
+	os.Setenv("TEST_DST_PATH", "backups")
+	loc, err = LocationFromEnv("TEST_DST")
+	if err != nil {
+		t.Fatalf("LocationFromEnv failed for swift: %v", err)
+	}
+	if loc.Fs() != ":swift,auth='https://keystone.example.com/v3',key=secret,user=vmbr:backups" {
+		t.Fatalf("unexpected swift fs %s", loc.Fs())
+	}
+
+	os.Setenv("TEST_DST_OPTIONS", "user=vmbr,key:x=secret")
+	if _, err := LocationFromEnv("TEST_DST"); err == nil {
+		t.Fatalf("expected an error for an invalid option name")
+	}
+
+	os.Setenv("TEST_DST_TYPE", "nosuchbackend")
+	if _, err := LocationFromEnv("TEST_DST"); err == nil {
+		t.Fatalf("expected an error for an unknown storage type")
+	}
+}
+
+func TestS3OptionsFromEnv(t *testing.T) {
+	var cfg rclone.S3Config
+	if err := S3OptionsFromEnv("TEST_S3", &cfg); err != nil || cfg.ForcePathStyle != nil || cfg.Provider != "" {
+		t.Fatalf("expected no options by default, got %+v, %v", cfg, err)
+	}
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caCert, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+	os.Setenv("TEST_S3_PROVIDER", "Ceph")
+	defer os.Unsetenv("TEST_S3_PROVIDER")
+	os.Setenv("TEST_S3_REGION", "tw-1")
+	defer os.Unsetenv("TEST_S3_REGION")
+	os.Setenv("TEST_S3_FORCE_PATH_STYLE", "false")
+	defer os.Unsetenv("TEST_S3_FORCE_PATH_STYLE")
+	os.Setenv("TEST_S3_CA_CERT", caCert)
+	defer os.Unsetenv("TEST_S3_CA_CERT")
+	os.Setenv("TEST_S3_NO_CHECK_BUCKET", "true")
+	defer os.Unsetenv("TEST_S3_NO_CHECK_BUCKET")
+	os.Setenv("TEST_S3_STORAGE_CLASS", "GLACIER")
+	defer os.Unsetenv("TEST_S3_STORAGE_CLASS")
+	if err := S3OptionsFromEnv("TEST_S3", &cfg); err != nil {
+		t.Fatalf("S3OptionsFromEnv failed: %v", err)
+	}
+	if cfg.Provider != "Ceph" || cfg.Region != "tw-1" || cfg.ForcePathStyle == nil || *cfg.ForcePathStyle ||
+		cfg.CACert != caCert || !cfg.NoCheckBucket || cfg.StorageClass != "GLACIER" {
+		t.Fatalf("unexpected options %+v", cfg)
+	}
+
+	os.Setenv("TEST_S3_FORCE_PATH_STYLE", "maybe")
+	if err := S3OptionsFromEnv("TEST_S3", &cfg); err == nil {
+		t.Fatalf("expected an error for an invalid boolean")
+	}
+	os.Setenv("TEST_S3_FORCE_PATH_STYLE", "true")
+	os.Setenv("TEST_S3_CA_CERT", filepath.Join(t.TempDir(), "missing.pem"))
+	if err := S3OptionsFromEnv("TEST_S3", &cfg); err == nil || !strings.Contains(err.Error(), "TEST_S3_CA_CERT") {
+		t.Fatalf("expected an error for a missing CA certificate, got %v", err)
+	}
+}
+
+func TestCryptConfigFromEnv(t *testing.T) {
+	if _, ok, err := CryptConfigFromEnv("TEST_DST"); ok || err != nil {
+		t.Fatalf("expected no encryption by default, got %v, %v", ok, err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "crypt.key")
+	if err := os.WriteFile(keyFile, []byte("secret\r\npepper\n"), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	os.Setenv("TEST_DST_CRYPT_KEY_FILE", keyFile)
+	defer os.Unsetenv("TEST_DST_CRYPT_KEY_FILE")
+	os.Setenv("TEST_DST_CRYPT_FILENAMES", "Standard")
+	defer os.Unsetenv("TEST_DST_CRYPT_FILENAMES")
+	cfg, ok, err := CryptConfigFromEnv("TEST_DST")
+	if err != nil || !ok || cfg.Password != "secret" || cfg.Salt != "pepper" || cfg.Filenames != "standard" {
+		t.Fatalf("unexpected crypt config %+v, %v, %v", cfg, ok, err)
+	}
+
+	os.Setenv("TEST_DST_CRYPT_PASSWORD", "other")
+	defer os.Unsetenv("TEST_DST_CRYPT_PASSWORD")
+	if _, _, err := CryptConfigFromEnv("TEST_DST"); err == nil {
+		t.Fatalf("expected an error with both a password and a key file")
+	}
+
+	os.Unsetenv("TEST_DST_CRYPT_KEY_FILE")
+	os.Setenv("TEST_DST_TYPE", "local")
+	defer os.Unsetenv("TEST_DST_TYPE")
+	os.Setenv("TEST_DST_PATH", "/mnt/nfs/backups")
+	defer os.Unsetenv("TEST_DST_PATH")
+	loc, err := LocationFromEnv("TEST_DST")
+	if err != nil {
+		t.Fatalf("LocationFromEnv failed: %v", err)
+	}
+	if loc.Type != "crypt" || loc.Wrapped == nil || loc.Wrapped.Root != "/mnt/nfs/backups" || loc.String() != "/mnt/nfs/backups (crypt)" {
+		t.Fatalf("expected the local directory encrypted, got %+v", loc)
+	}
+}
+
+func TestLocationFromEnv_Compress(t *testing.T) {
+	os.Setenv("TEST_DST_TYPE", "local")
+	defer os.Unsetenv("TEST_DST_TYPE")
+	os.Setenv("TEST_DST_PATH", "/mnt/nfs/backups")
+	defer os.Unsetenv("TEST_DST_PATH")
+	os.Setenv("TEST_DST_CRYPT_PASSWORD", "secret")
+	defer os.Unsetenv("TEST_DST_CRYPT_PASSWORD")
+	os.Setenv("TEST_DST_COMPRESS", "gzip")
+	defer os.Unsetenv("TEST_DST_COMPRESS")
+	os.Setenv("TEST_DST_COMPRESS_LEVEL", "9")
+	defer os.Unsetenv("TEST_DST_COMPRESS_LEVEL")
+
+	loc, err := LocationFromEnv("TEST_DST")
+	if err != nil {
+		t.Fatalf("LocationFromEnv failed: %v", err)
+	}
+	// Images are compressed before they are encrypted.
+	if loc.Type != "compress" || loc.Options["level"] != "9" || loc.Wrapped == nil || loc.Wrapped.Type != "crypt" {
+		t.Fatalf("expected the encrypted location compressed, got %+v", loc)
+	}
+
+	os.Setenv("TEST_DST_COMPRESS_LEVEL", "10")
+	if _, err := LocationFromEnv("TEST_DST"); err == nil {
+		t.Fatalf("expected an error for an invalid level")
+	}
+	os.Setenv("TEST_DST_COMPRESS", "zstd")
+	if _, err := LocationFromEnv("TEST_DST"); err == nil {
+		t.Fatalf("expected an error for an unsupported compression")
+	}
+	os.Setenv("TEST_DST_COMPRESS", "none")
+	if loc, err = LocationFromEnv("TEST_DST"); err != nil || loc.Type != "crypt" {
+		t.Fatalf("expected no compression, got %+v, %v", loc, err)
+	}
+}